@@ -2,9 +2,12 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/google/subcommands"
@@ -30,15 +33,6 @@ var regionToKey = map[string]pyxtea.Key{
 	"kr": pyxtea.KeyKR,
 }
 
-var keyToRegion = map[pyxtea.Key]string{
-	pyxtea.KeyUS: "us",
-	pyxtea.KeyJP: "jp",
-	pyxtea.KeyTH: "th",
-	pyxtea.KeyEU: "eu",
-	pyxtea.KeyID: "id",
-	pyxtea.KeyKR: "kr",
-}
-
 func getRegionKey(regionCode string) pyxtea.Key {
 	key, ok := regionToKey[regionCode]
 	if !ok {
@@ -47,28 +41,174 @@ func getRegionKey(regionCode string) pyxtea.Key {
 	return key
 }
 
-func getKeyRegion(key pyxtea.Key) string {
-	region, ok := keyToRegion[key]
-	if !ok {
-		panic("programming error: unexpected key")
-	}
-	return region
+func getPakKey(region string, patterns []string) pyxtea.Key {
+	return getPakKeyIndexed(region, patterns, nil)
 }
 
-func getPakKey(region string, patterns []string) pyxtea.Key {
+// getPakKeyIndexed is like getPakKey, but takes the region from the index
+// cache when possible. index may be nil.
+func getPakKeyIndexed(region string, patterns []string, index *pak.IndexCache) pyxtea.Key {
 	if region == "" {
 		log.Println("Auto-detecting pak region (use -region to improve startup delay.)")
-		key := pak.MustDetectRegion(patterns, xteaKeys)
-		log.Printf("Detected pak region as %s.", strings.ToUpper(getKeyRegion(key)))
+		detect := pak.DetectRegion
+		if index != nil {
+			detect = index.DetectRegion
+		}
+		key, err := detect(patterns, xteaKeys)
+		if errors.Is(err, pak.ErrRegionUndetermined) {
+			key = xteaKeys[0]
+			log.Printf("Pak region can not be detected (%v); using %s.", err, strings.ToUpper(pak.RegionName(key)))
+			return key
+		} else if err != nil {
+			log.Fatalln("Error auto-detecting pak region:", err)
+		}
+		log.Printf("Detected pak region as %s.", strings.ToUpper(pak.RegionName(key)))
 		return key
 	}
 	return getRegionKey(region)
 }
 
+// defaultIndexCacheDir returns the default for -index-cache flags.
+func defaultIndexCacheDir() string {
+	dir, err := pak.DefaultIndexCacheDir()
+	if err != nil {
+		return ""
+	}
+	return dir
+}
+
+// openIndexCache opens the index cache in dir. If dir is empty, or the cache
+// can not be opened, nil is returned and the index cache is not used.
+func openIndexCache(dir string) *pak.IndexCache {
+	if dir == "" {
+		return nil
+	}
+	index, err := pak.NewIndexCache(dir)
+	if err != nil {
+		log.Printf("Warning: not using index cache: %v", err)
+		return nil
+	}
+	return index
+}
+
+// regionFlag is a -region flag that may be given multiple times. A region
+// code sets the region of all pak files, and "<code>:<glob>" sets the region
+// of pak files matching the glob. The code "auto" detects the region.
+type regionFlag struct {
+	region string
+	rules  []pak.KeyRule
+}
+
+func (r *regionFlag) String() string {
+	values := []string{}
+	if r.region != "" {
+		values = append(values, r.region)
+	}
+	for _, rule := range r.rules {
+		code := "auto"
+		if !rule.Detect {
+			code = pak.RegionName(rule.Key)
+		}
+		values = append(values, code+":"+rule.Pattern)
+	}
+	return strings.Join(values, ",")
+}
+
+func (r *regionFlag) Set(value string) error {
+	code, pattern := value, ""
+	if i := strings.IndexByte(value, ':'); i != -1 {
+		code, pattern = value[:i], value[i+1:]
+	}
+	_, known := regionToKey[code]
+	if !known && code != "auto" {
+		return fmt.Errorf("invalid region %q (valid regions: us, jp, th, eu, id, kr, auto)", code)
+	}
+	if pattern == "" {
+		if code == "auto" {
+			code = ""
+		}
+		r.region = code
+		return nil
+	}
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+	r.rules = append(r.rules, pak.KeyRule{Pattern: pattern, Key: regionToKey[code], Detect: code == "auto"})
+	return nil
+}
+
+// regionUsage is the usage of -region flags using regionFlag.
+const regionUsage = "region to use (us, jp, th, eu, id, kr, auto); may be given as <region>:<glob> to set the region of matching pak files"
+
+// options returns the key and load options for pak files matching patterns
+// with the selected regions. index may be nil.
+func (r *regionFlag) options(patterns []string, index *pak.IndexCache) (pyxtea.Key, *pak.LoadOptions) {
+	if len(r.rules) == 0 {
+		return getPakKeyIndexed(r.region, patterns, index), &pak.LoadOptions{Index: index}
+	}
+
+	// With per-file regions, the paks are not expected to share a region,
+	// so any pak files without a region are detected one by one.
+	key, rules := pyxtea.Key{}, r.rules
+	if r.region == "" {
+		rules = append(rules[:len(rules):len(rules)], pak.KeyRule{Pattern: "*", Detect: true})
+	} else {
+		key = getRegionKey(r.region)
+	}
+	return key, &pak.LoadOptions{KeyRules: rules, DetectKeys: xteaKeys, Index: index}
+}
+
+// newFS returns an empty filesystem that loads pak files matching patterns
+// with the selected regions. index may be nil.
+func (r *regionFlag) newFS(patterns []string, index *pak.IndexCache) *pak.FS {
+	key, opts := r.options(patterns, index)
+	fs := pak.NewFS(key)
+	fs.SetIndexCache(opts.Index)
+	fs.SetKeyRules(opts.KeyRules, opts.DetectKeys)
+	return fs
+}
+
+// loadPaks loads the pak files matching patterns with the selected regions.
+// index may be nil.
+func (r *regionFlag) loadPaks(patterns []string, index *pak.IndexCache) (*pak.FS, error) {
+	key, opts := r.options(patterns, index)
+	return pak.LoadPaksWithOptions(key, patterns, opts)
+}
+
+// keyFor returns the key for a single pak file. If no region was selected
+// for it, its region is detected.
+func (r *regionFlag) keyFor(path string) (pyxtea.Key, error) {
+	rule := pak.KeyRule{Pattern: "*", Detect: true}
+	if r.region != "" {
+		rule = pak.KeyRule{Pattern: "*", Key: getRegionKey(r.region)}
+	}
+	fs := pak.NewFS(pyxtea.Key{})
+	fs.SetKeyRules(append(r.rules[:len(r.rules):len(r.rules)], rule), xteaKeys)
+	key, err := fs.KeyFor(path)
+	if errors.Is(err, pak.ErrRegionUndetermined) {
+		log.Printf("Region of %s can not be detected; using %s.", path, strings.ToUpper(pak.RegionName(key)))
+		return key, nil
+	} else if err != nil {
+		return pyxtea.Key{}, err
+	}
+	if rule.Detect {
+		log.Printf("Detected region of %s as %s.", path, strings.ToUpper(pak.RegionName(key)))
+	}
+	return key, nil
+}
+
 func main() {
 	subcommands.Register(subcommands.HelpCommand(), "")
 	subcommands.Register(&cmdPakMount{}, "paks")
 	subcommands.Register(&cmdPakExtract{}, "paks")
+	subcommands.Register(&cmdPakInspect{}, "paks")
+	subcommands.Register(&cmdPakCarve{}, "paks")
+	subcommands.Register(&cmdPakGrep{}, "paks")
+	subcommands.Register(&cmdPakDupes{}, "paks")
+	subcommands.Register(&cmdPakRepack{}, "paks")
+	subcommands.Register(&cmdPakRekey{}, "paks")
+	subcommands.Register(&cmdPakUnpack{}, "paks")
+	subcommands.Register(&cmdPakPack{}, "paks")
 	subcommands.Register(&cmdUpdateListServe{}, "updatelists")
 	subcommands.Register(&cmdUpdateListEncrypt{}, "updatelists")
 	subcommands.Register(&cmdUpdateListDecrypt{}, "updatelists")
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"time"
 
 	"github.com/google/subcommands"
@@ -13,17 +14,38 @@ import (
 )
 
 type cmdPakMount struct {
-	region string
-	flat   bool
-	open   bool
+	region     regionFlag
+	flat       bool
+	open       bool
+	watch      time.Duration
+	cacheSize  int64
+	indexCache string
 }
 
 func (*cmdPakMount) Name() string     { return "pak-mount" }
 func (*cmdPakMount) Synopsis() string { return "mounts a set of pak files" }
 func (*cmdPakMount) Usage() string {
-	return `pak-mount [-flat] [-region <code>] <pak files> <mount point>:
+	return `pak-mount [-flat] [-region <code>] [-watch <interval>] [-cache-size <MiB>] [-index-cache <dir>] <pak files> <mount point>:
 	Mounts a set of ordered pak files as a unified filesystem.
 	You can specify globs like projectg*.pak to get PangYa-like behavior.
+	Pak files may also be HTTP URLs, which are read using range requests.
+
+	With -flat, every file is placed in the root directory under its base
+	name. Files whose names collide are renamed with a suffix taken from
+	their source directory, and the renames are logged.
+
+	-region may be given more than once, as <region>:<glob>, to mix pak
+	files encrypted for different regions, e.g. -region kr -region
+	us:overlay*.pak. Pak files with no region given are auto-detected.
+
+	With -watch, the pak files are checked for changes at the given interval,
+	and the filesystem is reloaded when pak files are added, removed or
+	modified. Pak files on HTTP servers are loaded once and kept as they are.
+
+	The decoded file tables of local pak files, and the detected region,
+	are cached in the directory given by -index-cache, which makes later
+	mounts of the same files start faster. Cached tables are discarded when
+	pak files change. Set -index-cache to an empty string to disable it.
 
 	On Windows, the mount point must be a drive letter specification, e.g. P:
 	On other OSes, the mount point should be a directory, like $HOME/pak.
@@ -32,9 +54,12 @@ func (*cmdPakMount) Usage() string {
 }
 
 func (p *cmdPakMount) SetFlags(f *flag.FlagSet) {
-	f.BoolVar(&p.flat, "flat", false, "flatten the hierarchy (not implemented yet)")
-	f.StringVar(&p.region, "region", "", "region to use (us, jp, th, eu, id, kr)")
+	f.BoolVar(&p.flat, "flat", false, "flatten the hierarchy into a single directory")
+	f.Var(&p.region, "region", regionUsage)
 	f.BoolVar(&p.open, "open", true, "when true (default) open folder upon mounting")
+	f.DurationVar(&p.watch, "watch", 0, "interval to check pak files for changes at, e.g. 5s (disabled by default)")
+	f.Int64Var(&p.cacheSize, "cache-size", 256, "size of the decompressed file cache in MiB (0 disables)")
+	f.StringVar(&p.indexCache, "index-cache", defaultIndexCacheDir(), "directory to cache decoded file tables in (empty disables)")
 }
 
 func (p *cmdPakMount) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
@@ -54,55 +79,146 @@ func (p *cmdPakMount) Execute(_ context.Context, f *flag.FlagSet, _ ...interface
 		log.Printf("Warning: couldn't make mount dir: %v", err)
 	}
 
-	fs, err := pak.LoadPaks(getPakKey(p.region, pakfiles), pakfiles)
+	index := openIndexCache(p.indexCache)
+
+	var fs *pak.FS
+	var watcher *pak.Watcher
+	if p.watch > 0 {
+		fs = p.region.newFS(pakfiles, index)
+		watcher = pak.NewWatcher(fs, pakfiles)
+		if _, err := watcher.Update(); err != nil {
+			log.Fatalf("Loading pak files: %v", err)
+		}
+	} else {
+		fs, err = p.region.loadPaks(pakfiles, index)
+		if err != nil {
+			log.Fatalf("Loading pak files: %v", err)
+		}
+	}
+
+	if p.flat {
+		flat, renamed, stop := fs.Flatten()
+		defer stop()
+		fs = flat
+		for _, name := range renamed {
+			log.Printf("Renamed colliding file %q to %q", name.Path, name.Name)
+		}
+	}
+
+	if p.cacheSize > 0 {
+		fs.SetCache(pak.NewCache(p.cacheSize << 20))
+	}
+
+	h, err := fs.StartMount(mountpoint)
 	if err != nil {
-		log.Fatalf("Loading pak files: %v", err)
+		log.Printf("Mounting filesystem: %v", err)
+		return subcommands.ExitFailure
 	}
 
-	// We don't currently have a good callback for when fuse mounting has succeeded.
+	if p.open {
+		if err := openfolder(mountpoint); err != nil {
+			fmt.Printf("Tried to open folder %s, failed: %v\n", mountpoint, err)
+		}
+	}
+
+	i := make(chan os.Signal, 1)
+	signal.Notify(i, os.Interrupt)
 	go func() {
-		for i := 0; i < 50; i++ {
-			time.Sleep(100 * time.Millisecond)
-			if stat, err := os.Stat(mountpoint); !os.IsNotExist(err) {
-				if stat.IsDir() {
-					if err := openfolder(mountpoint); err != nil {
-						fmt.Printf("Tried to mount folder %s, failed: %v\n", mountpoint, err)
-					}
-				}
-				return
-			}
+		<-i
+		fmt.Println("Received interrupt, unmounting.")
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := h.Unmount(ctx); err != nil {
+			fmt.Println("Unmounting filesystem:", err)
+			os.Exit(1)
 		}
-		fmt.Println("Timed out waiting for mount point")
 	}()
 
-	if err := fs.Mount(mountpoint); err != nil {
-		log.Printf("Mounting filesystem: %v", err)
+	if watcher != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go watcher.Run(ctx, p.watch)
+	}
+
+	err = h.Wait()
+	if cache := fs.Cache(); cache != nil {
+		stats := cache.Stats()
+		log.Printf("Cache: %d hits, %d misses, %d evictions, %d files (%d bytes) cached.", stats.Hits, stats.Misses, stats.Evictions, stats.Entries, stats.Bytes)
+	}
+	if err != nil {
+		log.Printf("Serving filesystem: %v", err)
 		return subcommands.ExitFailure
 	}
 	return subcommands.ExitSuccess
 }
 
 type cmdPakExtract struct {
-	out    string
-	region string
-	flat   bool
+	out         string
+	region      regionFlag
+	flat        bool
+	indexCache  string
+	unsafePaths string
+	collisions  string
+	shadowed    bool
+	mapFile     string
+}
+
+var extractPolicies = map[string]pak.ExtractPolicy{
+	"reject":  pak.RejectUnsafePaths,
+	"rewrite": pak.RewriteUnsafePaths,
+	"skip":    pak.SkipUnsafePaths,
+}
+
+var flatCollisions = map[string]pak.FlatCollision{
+	"error":   pak.CollisionError,
+	"counter": pak.CollisionCounter,
+	"dirhash": pak.CollisionDirHash,
+	"first":   pak.CollisionKeepFirst,
+	"last":    pak.CollisionKeepLast,
 }
 
 func (*cmdPakExtract) Name() string     { return "pak-extract" }
 func (*cmdPakExtract) Synopsis() string { return "extracts a set of pak files" }
 func (*cmdPakExtract) Usage() string {
-	return `pak-extract [-flat] [-region <code>] [-o <output directory>] <pak files>:
+	return `pak-extract [-flat [-collisions <strategy>] [-shadowed] [-map <file>]] [-region <code>] [-index-cache <dir>] [-unsafe-paths reject|rewrite|skip] [-o <output directory>] <pak files>:
 	Extracts a set of pak files into a directory.
 	
 	This will treat the set of pak files as a single incremental archive.
+	Pak files may also be HTTP URLs, in which case only the needed parts of
+	the file are downloaded using range requests.
+
+	Regions and decoded file tables are handled as described for pak-mount.
+
+	Paths that would be unsafe to extract to, such as absolute paths, paths
+	containing .. or drive letters, and Windows device names like CON, stop
+	extraction by default. With -unsafe-paths rewrite, such files are
+	extracted to safe paths within the output directory instead, and with
+	-unsafe-paths skip, they are not extracted. Either way, each affected
+	file is logged.
+
+	With -flat, files with the same name in different directories collide,
+	as do names that differ only in case. By default, this stops
+	extraction. -collisions selects another strategy: counter and dirhash
+	keep the first name and suffix the others with a counter or a hash of
+	their directory, while first and last extract only the first or last
+	file in pak order. Files hidden by a file of the same name in a later
+	pak are only extracted with -shadowed; they never stop extraction, and
+	are suffixed unless first or last is selected. With -map, the flat
+	names and original paths of the extracted files are written to a JSON
+	file, so that the flattening can be reversed.
 
 `
 }
 
 func (p *cmdPakExtract) SetFlags(f *flag.FlagSet) {
 	f.StringVar(&p.out, "o", "", "destination to extract to")
-	f.BoolVar(&p.flat, "flat", false, "flatten the hierarchy (not implemented yet)")
-	f.StringVar(&p.region, "region", "", "region to use (us, jp, th, eu, id, kr)")
+	f.BoolVar(&p.flat, "flat", false, "flatten the hierarchy into a single directory")
+	f.Var(&p.region, "region", regionUsage)
+	f.StringVar(&p.indexCache, "index-cache", defaultIndexCacheDir(), "directory to cache decoded file tables in (empty disables)")
+	f.StringVar(&p.unsafePaths, "unsafe-paths", "reject", "what to do with unsafe paths (reject, rewrite, skip)")
+	f.StringVar(&p.collisions, "collisions", "error", "what to do with colliding names with -flat (error, counter, dirhash, first, last)")
+	f.BoolVar(&p.shadowed, "shadowed", false, "also extract files hidden by a later pak with -flat")
+	f.StringVar(&p.mapFile, "map", "", "file to write the mapping of flat names to paths to with -flat")
 }
 
 func (p *cmdPakExtract) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
@@ -111,29 +227,55 @@ func (p *cmdPakExtract) Execute(_ context.Context, f *flag.FlagSet, _ ...interfa
 		return subcommands.ExitUsageError
 	}
 
+	policy, ok := extractPolicies[p.unsafePaths]
+	if !ok {
+		log.Printf("Invalid unsafe path policy %q (valid policies: reject, rewrite, skip)", p.unsafePaths)
+		return subcommands.ExitUsageError
+	}
+	collisions, ok := flatCollisions[p.collisions]
+	if !ok {
+		log.Printf("Invalid collision strategy %q (valid strategies: error, counter, dirhash, first, last)", p.collisions)
+		return subcommands.ExitUsageError
+	}
+
 	if p.out != "" {
 		if err := os.MkdirAll(p.out, 0o775); err != nil {
 			log.Printf("Warning: couldn't make output dir: %v", err)
 		}
 	}
 
-	fs, err := pak.LoadPaks(getPakKey(p.region, f.Args()), f.Args())
+	index := openIndexCache(p.indexCache)
+	fs, err := p.region.loadPaks(f.Args(), index)
 	if err != nil {
 		log.Printf("Loading pak files: %v", err)
 		return subcommands.ExitFailure
 	}
 
+	opts := &pak.ExtractOptions{Policy: policy, Collisions: collisions, Shadowed: p.shadowed, MappingFile: p.mapFile}
+	var report *pak.ExtractReport
 	if p.flat {
-		if err = fs.ExtractFlat(p.out); err != nil {
-			log.Printf("Extracting pak files: %v", err)
-			return subcommands.ExitFailure
-		}
+		report, err = fs.ExtractFlatWithOptions(p.out, opts)
 	} else {
-		if err = fs.Extract(p.out); err != nil {
-			log.Printf("Extracting pak files: %v", err)
-			return subcommands.ExitFailure
+		report, err = fs.ExtractWithOptions(p.out, opts)
+	}
+	for _, unsafe := range report.Unsafe {
+		if unsafe.Target == "" {
+			log.Printf("Skipped %q (%s)", unsafe.Path, unsafe.Reason)
+		} else {
+			log.Printf("Extracted %q to %q (%s)", unsafe.Path, unsafe.Target, unsafe.Reason)
 		}
 	}
+	for _, name := range report.Collisions {
+		if name.Name == "" {
+			log.Printf("Skipped colliding file %q", name.Path)
+		} else {
+			log.Printf("Renamed colliding file %q to %q", name.Path, name.Name)
+		}
+	}
+	if err != nil {
+		log.Printf("Extracting pak files: %v", err)
+		return subcommands.ExitFailure
+	}
 
 	return subcommands.ExitSuccess
 }
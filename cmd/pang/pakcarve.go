@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/google/subcommands"
+	"github.com/pangbox/pangfiles/pak"
+)
+
+type cmdPakCarve struct {
+	out     string
+	region  regionFlag
+	all     bool
+	list    bool
+	minSize int64
+}
+
+func (*cmdPakCarve) Name() string     { return "pak-carve" }
+func (*cmdPakCarve) Synopsis() string { return "recovers orphaned data from a pak file" }
+func (*cmdPakCarve) Usage() string {
+	return `pak-carve [-list] [-all] [-min-size <bytes>] [-region <code>] [-o <output directory>] <pak file>:
+	Recovers data from the parts of a pak file not referenced by its file
+	table, such as assets left behind by older file tables.
+
+	Unreferenced regions are searched for known file types, stored either
+	raw or LZ compressed. Each file found is decoded and written to the
+	output directory, named after its offset in the pak file. As the length
+	of orphaned data is unknown, files may contain trailing garbage.
+
+	With -all, data in which no file type was recognized is also written,
+	with the .bin extension. With -list, nothing is written.
+
+`
+}
+
+func (p *cmdPakCarve) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&p.out, "o", "", "destination to extract to")
+	f.Var(&p.region, "region", regionUsage)
+	f.BoolVar(&p.all, "all", false, "also extract data of unrecognized type")
+	f.BoolVar(&p.list, "list", false, "only list unreferenced regions and orphaned files")
+	f.Int64Var(&p.minSize, "min-size", 16, "minimum size of unreferenced regions to search")
+}
+
+// fileTypeName returns a readable name for the file type of an orphan.
+func fileTypeName(fileType byte) string {
+	switch fileType {
+	case pak.FileTypeLz:
+		return "lz"
+	case pak.FileTypeLz2:
+		return "lz2"
+	default:
+		return "raw"
+	}
+}
+
+func (p *cmdPakCarve) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 1 {
+		log.Println("Specify exactly one pak file to carve.")
+		return subcommands.ExitUsageError
+	}
+	path := f.Arg(0)
+
+	file, err := pak.OpenFile(path)
+	if err != nil {
+		log.Printf("Opening pak file: %v", err)
+		return subcommands.ExitFailure
+	}
+	if closer, ok := file.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	key, err := p.region.keyFor(path)
+	if err != nil {
+		log.Printf("Selecting key: %v", err)
+		return subcommands.ExitFailure
+	}
+	reader, err := pak.NewReader(key, file)
+	if err != nil {
+		log.Printf("Opening pak file: %v", err)
+		return subcommands.ExitFailure
+	}
+
+	layout, err := reader.Layout()
+	if err != nil {
+		log.Printf("Reading file table: %v", err)
+		return subcommands.ExitFailure
+	}
+	unused := int64(0)
+	for _, gap := range layout.Gaps {
+		unused += gap.Len()
+		if p.list {
+			fmt.Printf("unreferenced 0x%08x-0x%08x %10d bytes\n", gap.Start, gap.End, gap.Len())
+		}
+	}
+	log.Printf("%d unreferenced bytes in %d regions.", unused, len(layout.Gaps))
+
+	orphans, err := reader.Carve(&pak.CarveOptions{IncludeUnknown: p.all, MinSize: p.minSize, Layout: layout})
+	if err != nil {
+		log.Printf("Carving pak file: %v", err)
+		return subcommands.ExitFailure
+	}
+
+	if !p.list && p.out != "" {
+		if err := os.MkdirAll(p.out, 0o775); err != nil {
+			log.Printf("Warning: couldn't make output dir: %v", err)
+		}
+	}
+
+	for _, orphan := range orphans {
+		ext := orphan.Ext
+		if ext == "" {
+			ext = ".bin"
+		}
+		name := fmt.Sprintf("orphan_%08x%s", orphan.Region.Start, ext)
+		if p.list {
+			fmt.Printf("%s 0x%08x-0x%08x %4s %10d bytes decoded\n", name, orphan.Region.Start, orphan.Region.End, fileTypeName(orphan.FileType), len(orphan.Data))
+			continue
+		}
+		if err := ioutil.WriteFile(filepath.Join(p.out, name), orphan.Data, 0o644); err != nil {
+			log.Printf("Writing orphaned file: %v", err)
+			return subcommands.ExitFailure
+		}
+	}
+	log.Printf("Found %d orphaned files.", len(orphans))
+
+	return subcommands.ExitSuccess
+}
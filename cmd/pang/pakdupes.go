@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"sort"
+
+	"github.com/google/subcommands"
+	"github.com/pangbox/pangfiles/pak"
+)
+
+type cmdPakDupes struct {
+	region regionFlag
+	top    int
+}
+
+func (*cmdPakDupes) Name() string { return "pak-dupes" }
+func (*cmdPakDupes) Synopsis() string {
+	return "reports files stored more than once in a set of pak files"
+}
+func (*cmdPakDupes) Usage() string {
+	return `pak-dupes [-top <n>] [-region <code>] <pak files>:
+	Groups the files of a set of pak files by their decompressed contents,
+	and reports the space wasted by storing the same contents more than
+	once. Files shadowed by later pak files are included.
+
+`
+}
+
+func (p *cmdPakDupes) SetFlags(f *flag.FlagSet) {
+	f.Var(&p.region, "region", regionUsage)
+	f.IntVar(&p.top, "top", 20, "number of groups to list, by wasted space (0 lists all)")
+}
+
+func (p *cmdPakDupes) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() < 1 {
+		log.Println("Not enough arguments. Specify a pak or set of paks to analyze.")
+		return subcommands.ExitUsageError
+	}
+
+	// The filesystem is only used to select the key of each pak file.
+	fs := p.region.newFS(f.Args(), nil)
+	readers, names := []*pak.Reader{}, map[*pak.Reader]string{}
+	for _, pattern := range f.Args() {
+		paths, err := filepath.Glob(pattern)
+		if err != nil || len(paths) == 0 {
+			paths = []string{pattern}
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			file, err := pak.OpenFile(path)
+			if err != nil {
+				log.Printf("Opening pak file: %v", err)
+				return subcommands.ExitFailure
+			}
+			if closer, ok := file.(io.Closer); ok {
+				defer closer.Close()
+			}
+			key, err := fs.KeyFor(path)
+			if err != nil && !errors.Is(err, pak.ErrRegionUndetermined) {
+				log.Printf("Opening pak file %q: %v", path, err)
+				return subcommands.ExitFailure
+			}
+			reader, err := pak.NewReader(key, file)
+			if err != nil {
+				log.Printf("Opening pak file %q: %v", path, err)
+				return subcommands.ExitFailure
+			}
+			readers = append(readers, reader)
+			names[reader] = filepath.Base(path)
+		}
+	}
+
+	groups, err := pak.FindDuplicates(readers)
+	if err != nil {
+		log.Printf("Analyzing pak files: %v", err)
+		return subcommands.ExitFailure
+	}
+
+	wasted, copies := int64(0), 0
+	for _, group := range groups {
+		wasted += group.Wasted
+		copies += len(group.Files) - 1
+	}
+	for i, group := range groups {
+		if p.top > 0 && i >= p.top {
+			break
+		}
+		fmt.Printf("%x: %d bytes, %d copies, %d bytes wasted\n", group.Hash[:8], group.Size, len(group.Files), group.Wasted)
+		for _, file := range group.Files {
+			fmt.Printf("\t%s: %s (offset 0x%08x, %d bytes packed)\n", names[file.Reader], file.Path, file.Entry.Offset, file.Entry.PackedFileSize)
+		}
+	}
+	log.Printf("%d groups of duplicates, %d redundant copies, %d bytes wasted.", len(groups), copies, wasted)
+	return subcommands.ExitSuccess
+}
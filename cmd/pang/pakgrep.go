@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/google/subcommands"
+	"github.com/pangbox/pangfiles/pak"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// textEncodings are the encodings pak-grep can search text in.
+var textEncodings = map[string]encoding.Encoding{
+	"utf-8":     unicode.UTF8,
+	"euc-kr":    korean.EUCKR,
+	"shift-jis": japanese.ShiftJIS,
+	"utf-16le":  unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM),
+}
+
+// stringList is a flag that may be specified multiple times.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+type cmdPakGrep struct {
+	region    regionFlag
+	regexp    bool
+	hex       bool
+	encodings string
+	context   int
+	list      bool
+	workers   int
+	include   stringList
+	exclude   stringList
+	skipExts  string
+}
+
+func (*cmdPakGrep) Name() string     { return "pak-grep" }
+func (*cmdPakGrep) Synopsis() string { return "searches the contents of a set of pak files" }
+func (*cmdPakGrep) Usage() string {
+	return `pak-grep [-regexp | -hex | -encoding <list>] [-include <glob>] [-exclude <glob>] [-skip-ext <list>] [-C <bytes>] [-l] [-region <code>] <pattern> <pak files>:
+	Searches the decompressed contents of every file in a set of pak files.
+
+	By default, the pattern is text, which is searched for in each of the
+	encodings listed by -encoding (utf-8, euc-kr, shift-jis, utf-16le).
+	With -regexp, the pattern is a regular expression. With -hex, the
+	pattern is a sequence of hexadecimal bytes, such as "44 44 53 20".
+
+	Each match is printed with its file, offset and surrounding bytes.
+	-include and -exclude may be given multiple times; globs without a slash
+	are matched against file names, others against full paths.
+
+`
+}
+
+func (p *cmdPakGrep) SetFlags(f *flag.FlagSet) {
+	f.Var(&p.region, "region", regionUsage)
+	f.BoolVar(&p.regexp, "regexp", false, "treat the pattern as a regular expression")
+	f.BoolVar(&p.hex, "hex", false, "treat the pattern as hexadecimal bytes")
+	f.StringVar(&p.encodings, "encoding", "utf-8,euc-kr", "comma-separated encodings to search text in")
+	f.IntVar(&p.context, "C", 16, "bytes of context to print around each match")
+	f.BoolVar(&p.list, "l", false, "only print the names of matching files")
+	f.IntVar(&p.workers, "j", 0, "number of files to search in parallel (defaults to the number of CPUs)")
+	f.Var(&p.include, "include", "only search files matching the glob")
+	f.Var(&p.exclude, "exclude", "skip files matching the glob")
+	f.StringVar(&p.skipExts, "skip-ext", "", "comma-separated extensions of files to skip, e.g. .dds,.ogg")
+}
+
+// matcher builds the matcher for the pattern.
+func (p *cmdPakGrep) matcher(pattern string) (pak.Matcher, error) {
+	switch {
+	case p.regexp && p.hex:
+		return nil, fmt.Errorf("-regexp and -hex can not be combined")
+	case p.regexp:
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		return pak.RegexpMatcher(re), nil
+	case p.hex:
+		b, err := hex.DecodeString(strings.Join(strings.Fields(pattern), ""))
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex pattern: %w", err)
+		}
+		return pak.BytesMatcher(b), nil
+	}
+
+	patterns := [][]byte{}
+	for _, name := range strings.Split(p.encodings, ",") {
+		enc, ok := textEncodings[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unknown encoding %q (valid encodings: utf-8, euc-kr, shift-jis, utf-16le)", name)
+		}
+		b, err := enc.NewEncoder().Bytes([]byte(pattern))
+		if err != nil {
+			log.Printf("Warning: pattern can not be encoded as %s: %v", name, err)
+			continue
+		}
+		patterns = append(patterns, b)
+	}
+	if len(patterns) == 0 {
+		return nil, fmt.Errorf("pattern can not be encoded in any of the encodings")
+	}
+	return pak.BytesMatcher(patterns...), nil
+}
+
+// quoteBytes formats binary data for display, escaping non-printable bytes.
+func quoteBytes(b []byte) string {
+	s := strconv.QuoteToASCII(string(b))
+	return s[1 : len(s)-1]
+}
+
+func (p *cmdPakGrep) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() < 2 {
+		log.Println("Not enough arguments. Specify a pattern and a pak or set of paks to search.")
+		return subcommands.ExitUsageError
+	}
+	pattern, paks := f.Arg(0), f.Args()[1:]
+
+	m, err := p.matcher(pattern)
+	if err != nil {
+		log.Printf("Invalid pattern: %v", err)
+		return subcommands.ExitUsageError
+	}
+
+	opts := &pak.SearchOptions{
+		Include: p.include,
+		Exclude: p.exclude,
+		Context: p.context,
+		Workers: p.workers,
+	}
+	if p.skipExts != "" {
+		for _, ext := range strings.Split(p.skipExts, ",") {
+			ext = strings.TrimSpace(ext)
+			if !strings.HasPrefix(ext, ".") {
+				ext = "." + ext
+			}
+			opts.SkipExts = append(opts.SkipExts, ext)
+		}
+	}
+
+	fs, err := p.region.loadPaks(paks, nil)
+	if err != nil {
+		log.Printf("Loading pak files: %v", err)
+		return subcommands.ExitFailure
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+
+	count, last := 0, ""
+	err = fs.Search(m, opts, func(match pak.Match) {
+		count++
+		if p.list {
+			if match.Path != last {
+				fmt.Fprintln(w, match.Path)
+			}
+			last = match.Path
+			return
+		}
+		fmt.Fprintf(w, "%s:0x%08x: %s[%s]%s\n", match.Path, match.Offset, quoteBytes(match.Before), quoteBytes(match.Data), quoteBytes(match.After))
+	})
+	if err != nil {
+		log.Printf("Searching pak files: %v", err)
+		return subcommands.ExitFailure
+	}
+	if count == 0 {
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/google/subcommands"
+	"github.com/pangbox/pangfiles/pak"
+	"golang.org/x/text/encoding/korean"
+)
+
+type cmdPakInspect struct {
+	region    regionFlag
+	signature int
+}
+
+func (*cmdPakInspect) Name() string     { return "pak-inspect" }
+func (*cmdPakInspect) Synopsis() string { return "dumps the raw structure of a pak file" }
+func (*cmdPakInspect) Usage() string {
+	return `pak-inspect [-region <code>] [-signature <byte>] <pak file>:
+	Dumps the raw structure of a single pak file, for format research.
+
+	This prints the trailer, and for each file table entry its offset in
+	the file table, its header bytes before and after XTEA deciphering, the
+	decoded entry, its raw and decoded path bytes and the region holding its
+	data. Finally, a map of the file is printed, including any gaps not
+	referenced by the file table.
+
+	With -signature, the file is read using the standard layout even if its
+	trailer signature is not recognized. -region must be given in that case.
+
+`
+}
+
+func (p *cmdPakInspect) SetFlags(f *flag.FlagSet) {
+	f.Var(&p.region, "region", regionUsage)
+	f.IntVar(&p.signature, "signature", -1, "trailer signature to accept, e.g. 0x12 (detected by default)")
+}
+
+func (p *cmdPakInspect) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 1 {
+		log.Println("Specify exactly one pak file to inspect.")
+		return subcommands.ExitUsageError
+	}
+	path := f.Arg(0)
+
+	if p.signature >= 0 && p.region.String() == "" {
+		log.Println("A region must be specified when using -signature.")
+		return subcommands.ExitUsageError
+	}
+	if p.signature > 0xFF {
+		log.Println("The signature must be a single byte.")
+		return subcommands.ExitUsageError
+	}
+
+	file, err := pak.OpenFile(path)
+	if err != nil {
+		log.Printf("Opening pak file: %v", err)
+		return subcommands.ExitFailure
+	}
+	if closer, ok := file.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	var reader *pak.Reader
+	key, err := p.region.keyFor(path)
+	if err == nil && p.signature >= 0 {
+		format := pak.Format{Name: "custom", Signature: byte(p.signature)}
+		reader, err = pak.NewReaderWithFormat(key, file, format)
+	} else if err == nil {
+		reader, err = pak.NewReader(key, file)
+	}
+	if err != nil {
+		log.Printf("Opening pak file: %v", err)
+		var ferr *pak.FormatError
+		if errors.As(err, &ferr) && ferr.Plausible() {
+			log.Printf("The file looks like a standard pak; try -signature 0x%02x.", ferr.TrailerData.Signature)
+		}
+		return subcommands.ExitFailure
+	}
+
+	layout, err := reader.Layout()
+	if err != nil {
+		log.Printf("Reading file table: %v", err)
+		return subcommands.ExitFailure
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	dumpLayout(w, reader, layout)
+	if err := w.Flush(); err != nil {
+		log.Printf("Writing output: %v", err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// describeType returns a readable description of an entry type byte.
+func describeType(t byte) string {
+	entryType := fmt.Sprintf("entry type 0x%02x", t&pak.EntryTypeMask)
+	switch t & pak.EntryTypeMask {
+	case pak.EntryTypeXOR:
+		entryType = "xor"
+	case pak.EntryTypeXTEA:
+		entryType = "xtea"
+	case pak.EntryTypeBasic:
+		entryType = "basic"
+	}
+	fileType := fmt.Sprintf("file type 0x%02x", t&pak.FileTypeMask)
+	switch t & pak.FileTypeMask {
+	case pak.FileTypeBasic:
+		fileType = "uncompressed"
+	case pak.FileTypeLz:
+		fileType = "lz"
+	case pak.FileTypeDir:
+		fileType = "directory"
+	case pak.FileTypeLz2:
+		fileType = "lz2"
+	}
+	return entryType + ", " + fileType
+}
+
+// mapRegion is a region of the file, labelled for the file map.
+type mapRegion struct {
+	pak.Region
+	label string
+}
+
+func dumpLayout(w io.Writer, reader *pak.Reader, layout *pak.Layout) {
+	trailer := reader.Trailer()
+	format := reader.Format()
+	decoder := korean.EUCKR.NewDecoder()
+
+	fmt.Fprintf(w, "File size:         %d (0x%x)\n", layout.Size, layout.Size)
+	fmt.Fprintf(w, "Trailer offset:    0x%08x\n", layout.Trailer.Start)
+	fmt.Fprintf(w, "Trailer bytes:     % 02x\n", layout.RawTrailer)
+	fmt.Fprintf(w, "File list offset:  0x%08x\n", trailer.FileListOffset)
+	fmt.Fprintf(w, "File count:        %d\n", trailer.FileCount)
+	fmt.Fprintf(w, "Signature:         0x%02x (%s)\n", trailer.Signature, format.Name)
+	fmt.Fprintln(w)
+
+	regions := []mapRegion{
+		{layout.Table, "file table"},
+		{layout.Trailer, "trailer"},
+	}
+	damaged := 0
+	for _, entry := range layout.Entries {
+		path, err := decoder.Bytes(entry.PathBytes)
+		decoded := fmt.Sprintf("%q", path)
+		if err != nil {
+			decoded = fmt.Sprintf("(invalid EUC-KR: %v)", err)
+		}
+		e := entry.Entry
+		data := entry.Data()
+
+		fmt.Fprintf(w, "Entry %d @ 0x%08x (%d bytes)\n", entry.Index, entry.TableOffset, entry.Len())
+		fmt.Fprintf(w, "  Header:          % 02x\n", entry.Header)
+		fmt.Fprintf(w, "  Deciphered:      % 02x\n", entry.Deciphered)
+		fmt.Fprintf(w, "  Path length:     %d\n", e.PathLength)
+		fmt.Fprintf(w, "  Type:            0x%02x (%s)\n", e.Type, describeType(e.Type))
+		fmt.Fprintf(w, "  Offset:          0x%08x\n", e.Offset)
+		fmt.Fprintf(w, "  Packed size:     %d\n", e.PackedFileSize)
+		fmt.Fprintf(w, "  Real size:       %d\n", e.RealFileSize)
+		fmt.Fprintf(w, "  Raw path:        % 02x\n", entry.RawPath)
+		fmt.Fprintf(w, "  Path bytes:      % 02x\n", entry.PathBytes)
+		fmt.Fprintf(w, "  Path:            %s\n", decoded)
+		if entry.Err != nil {
+			fmt.Fprintf(w, "  Error:           %v\n", entry.Err)
+			damaged++
+		}
+		if data.Len() > 0 {
+			fmt.Fprintf(w, "  Data:            0x%08x-0x%08x\n", data.Start, data.End)
+			regions = append(regions, mapRegion{data, fmt.Sprintf("entry %d: %s", entry.Index, decoded)})
+		}
+		if data.End > layout.Size {
+			fmt.Fprintf(w, "  Warning:         data extends past the end of the file\n")
+		}
+		fmt.Fprintln(w)
+	}
+
+	unused := int64(0)
+	for _, gap := range layout.Gaps {
+		regions = append(regions, mapRegion{gap, "unused"})
+		unused += gap.Len()
+	}
+	sort.SliceStable(regions, func(i, j int) bool { return regions[i].Start < regions[j].Start })
+
+	fmt.Fprintln(w, "File map:")
+	for _, region := range regions {
+		fmt.Fprintf(w, "  0x%08x-0x%08x %10d  %s\n", region.Start, region.End, region.Len(), region.label)
+	}
+	fmt.Fprintf(w, "\n%d unused bytes in %d gaps\n", unused, len(layout.Gaps))
+	if damaged > 0 {
+		fmt.Fprintf(w, "%d of %d entries could not be decoded\n", damaged, trailer.FileCount)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/subcommands"
+	"github.com/pangbox/pangfiles/crypto/pyxtea"
+	"github.com/pangbox/pangfiles/pak"
+)
+
+var entryTypeNames = map[string]byte{
+	"xor":   pak.EntryTypeXOR,
+	"xtea":  pak.EntryTypeXTEA,
+	"basic": pak.EntryTypeBasic,
+}
+
+type cmdPakRekey struct {
+	out       string
+	from      regionFlag
+	to        string
+	entryType string
+}
+
+func (*cmdPakRekey) Name() string     { return "pak-rekey" }
+func (*cmdPakRekey) Synopsis() string { return "converts pak files to another region" }
+func (*cmdPakRekey) Usage() string {
+	return `pak-rekey [-from <code>] -to <code> [-entry-type xor|xtea|basic] -o <output directory> <pak files>:
+	Rewrites the file tables of a set of pak files for the key of another
+	region. Each pak file is written to the output directory under its own
+	name. File data is copied unchanged.
+
+	With -entry-type, every file entry is converted to the given
+	obfuscation. Otherwise, entries keep their obfuscation.
+
+	The region of each pak file is auto-detected unless -from is given.
+	-from may be given more than once, as <region>:<glob>, to convert pak
+	files from different regions at once.
+	Each output file is verified by reading it back with the new key.
+
+`
+}
+
+func (p *cmdPakRekey) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&p.out, "o", "", "directory to write pak files to")
+	f.Var(&p.from, "from", "region of the pak files (us, jp, th, eu, id, kr, auto); may be given as <region>:<glob> to set the region of matching pak files")
+	f.StringVar(&p.to, "to", "", "region to convert to (us, jp, th, eu, id, kr)")
+	f.StringVar(&p.entryType, "entry-type", "", "obfuscation to convert file entries to (xor, xtea, basic)")
+}
+
+func (p *cmdPakRekey) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() < 1 || p.out == "" || p.to == "" {
+		log.Println("Not enough arguments. Specify a region with -to, an output directory with -o and a pak or set of paks to convert.")
+		return subcommands.ExitUsageError
+	}
+
+	opts := &pak.RekeyOptions{}
+	if p.entryType != "" {
+		entryType, ok := entryTypeNames[strings.ToLower(p.entryType)]
+		if !ok {
+			log.Printf("Invalid entry type %q (valid entry types: xor, xtea, basic)", p.entryType)
+			return subcommands.ExitUsageError
+		}
+		opts.EntryType = entryType
+	}
+	key := getRegionKey(p.to)
+
+	if err := os.MkdirAll(p.out, 0o775); err != nil {
+		log.Printf("Creating output directory: %v", err)
+		return subcommands.ExitFailure
+	}
+
+	for _, pattern := range f.Args() {
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			log.Printf("Invalid pattern %q: %v", pattern, err)
+			return subcommands.ExitUsageError
+		}
+		for _, path := range paths {
+			if err := p.rekey(path, key, opts); err != nil {
+				log.Printf("Converting %s: %v", path, err)
+				return subcommands.ExitFailure
+			}
+			log.Printf("Converted %s.", path)
+		}
+	}
+	return subcommands.ExitSuccess
+}
+
+// rekey converts the pak file at path, writing it to the output directory.
+// The output is written to a temporary file, which is only renamed into
+// place once it has been verified.
+func (p *cmdPakRekey) rekey(path string, key pyxtea.Key, opts *pak.RekeyOptions) error {
+	out := filepath.Join(p.out, filepath.Base(path))
+	if same, err := samePath(path, out); err != nil {
+		return err
+	} else if same {
+		return fmt.Errorf("output file %s would overwrite input", out)
+	}
+
+	data, err := pak.OpenFile(path)
+	if err != nil {
+		return err
+	}
+	if closer, ok := data.(io.Closer); ok {
+		defer closer.Close()
+	}
+	srckey, err := p.from.keyFor(path)
+	if err != nil {
+		return err
+	}
+	src, err := pak.NewReader(srckey, data)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(p.out, "tmp-*.pak")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	err = pak.Rekey(tmp, src, key, opts)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	written, err := pak.OpenFile(tmp.Name())
+	if err != nil {
+		return err
+	}
+	dst, err := pak.NewReader(key, written)
+	if err == nil {
+		err = pak.VerifyRekey(src, dst)
+	}
+	if closer, ok := written.(io.Closer); ok {
+		closer.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("verifying output: %w", err)
+	}
+	return os.Rename(tmp.Name(), out)
+}
+
+// samePath returns true if a and b refer to the same file.
+func samePath(a, b string) (bool, error) {
+	sa, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+	sb, err := os.Stat(b)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return os.SameFile(sa, sb), nil
+}
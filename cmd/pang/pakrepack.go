@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/google/subcommands"
+	"github.com/pangbox/pangfiles/crypto/pyxtea"
+	"github.com/pangbox/pangfiles/pak"
+)
+
+type cmdPakRepack struct {
+	out    string
+	region regionFlag
+	to     string
+	dedup  bool
+}
+
+func (*cmdPakRepack) Name() string     { return "pak-repack" }
+func (*cmdPakRepack) Synopsis() string { return "combines a set of pak files into one" }
+func (*cmdPakRepack) Usage() string {
+	return `pak-repack [-dedup] [-region <code>] [-to <code>] -o <output pak> <pak files>:
+	Writes the unified contents of a set of pak files to a single pak file.
+	File data is copied without being recompressed.
+
+	The pak file is written for the region of the input pak files, or for
+	the region given with -to. -to is required if the input pak files are
+	given different regions with -region <region>:<glob>.
+
+	With -dedup, files with identical contents are stored only once, with
+	each of their file entries pointing at the same data.
+
+`
+}
+
+func (p *cmdPakRepack) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&p.out, "o", "", "pak file to write")
+	f.Var(&p.region, "region", regionUsage)
+	f.StringVar(&p.to, "to", "", "region to write the pak file for (us, jp, th, eu, id, kr)")
+	f.BoolVar(&p.dedup, "dedup", false, "store files with identical contents only once")
+}
+
+func (p *cmdPakRepack) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() < 1 || p.out == "" {
+		log.Println("Not enough arguments. Specify an output file with -o and a pak or set of paks to repack.")
+		return subcommands.ExitUsageError
+	}
+
+	key, opts := p.region.options(f.Args(), nil)
+	outkey := key
+	if p.to != "" {
+		outkey = getRegionKey(p.to)
+	} else if outkey == (pyxtea.Key{}) {
+		log.Println("The input pak files have different regions. Specify the region to write with -to.")
+		return subcommands.ExitUsageError
+	}
+
+	fs, err := pak.LoadPaksWithOptions(key, f.Args(), opts)
+	if err != nil {
+		log.Printf("Loading pak files: %v", err)
+		return subcommands.ExitFailure
+	}
+
+	out, err := os.Create(p.out)
+	if err != nil {
+		log.Printf("Creating output file: %v", err)
+		return subcommands.ExitFailure
+	}
+	stats, err := fs.WritePak(outkey, out, &pak.WriterOptions{Dedup: p.dedup})
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Printf("Writing pak file: %v", err)
+		return subcommands.ExitFailure
+	}
+
+	log.Printf("Wrote %d files (%d bytes of data).", stats.Files, stats.Bytes)
+	if p.dedup {
+		log.Printf("Deduplicated %d files, saving %d bytes.", stats.Deduplicated, stats.SavedBytes)
+	}
+	return subcommands.ExitSuccess
+}
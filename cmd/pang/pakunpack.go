@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"log"
+	"os"
+
+	"github.com/google/subcommands"
+	"github.com/pangbox/pangfiles/pak"
+)
+
+type cmdPakUnpack struct {
+	out    string
+	region regionFlag
+}
+
+func (*cmdPakUnpack) Name() string     { return "pak-unpack" }
+func (*cmdPakUnpack) Synopsis() string { return "unpacks a pak file for rebuilding with pak-pack" }
+func (*cmdPakUnpack) Usage() string {
+	return `pak-unpack [-region <code>] -o <output directory> <pak file>:
+	Unpacks a single pak file into a directory, along with a manifest.json
+	describing the file table: entry order, entry and file types, path
+	padding, and any data not referenced by the file table.
+
+	File contents are written decompressed under files/. Files whose paths
+	can not be used on disk are written under unnamed/. Where compressing a
+	file again would not reproduce its original data, the original data is
+	kept under packed/.
+
+	The directory can be turned back into an identical pak file using
+	pak-pack.
+
+`
+}
+
+func (p *cmdPakUnpack) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&p.out, "o", "", "directory to unpack to")
+	f.Var(&p.region, "region", regionUsage)
+}
+
+func (p *cmdPakUnpack) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 1 || p.out == "" {
+		log.Println("Specify an output directory with -o and exactly one pak file to unpack.")
+		return subcommands.ExitUsageError
+	}
+	path := f.Arg(0)
+
+	data, err := pak.OpenFile(path)
+	if err != nil {
+		log.Printf("Opening pak file: %v", err)
+		return subcommands.ExitFailure
+	}
+	if closer, ok := data.(io.Closer); ok {
+		defer closer.Close()
+	}
+	key, err := p.region.keyFor(path)
+	if err != nil {
+		log.Printf("Selecting key: %v", err)
+		return subcommands.ExitFailure
+	}
+	r, err := pak.NewReader(key, data)
+	if err != nil {
+		log.Printf("Reading pak file: %v", err)
+		return subcommands.ExitFailure
+	}
+
+	m, err := pak.Unpack(r, p.out)
+	if err != nil {
+		log.Printf("Unpacking pak file: %v", err)
+		return subcommands.ExitFailure
+	}
+	log.Printf("Unpacked %d entries.", len(m.Entries))
+	return subcommands.ExitSuccess
+}
+
+type cmdPakPack struct {
+	out string
+}
+
+func (*cmdPakPack) Name() string     { return "pak-pack" }
+func (*cmdPakPack) Synopsis() string { return "rebuilds a pak file unpacked by pak-unpack" }
+func (*cmdPakPack) Usage() string {
+	return `pak-pack -o <output pak> <directory>:
+	Rebuilds a pak file from a directory written by pak-unpack.
+
+	If no files were changed, the pak file is identical to the original.
+	Changed files are listed, and their data is stored after the original
+	data, leaving the data and file entries of other files untouched.
+
+`
+}
+
+func (p *cmdPakPack) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&p.out, "o", "", "pak file to write")
+}
+
+func (p *cmdPakPack) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 1 || p.out == "" {
+		log.Println("Specify an output file with -o and exactly one directory to pack.")
+		return subcommands.ExitUsageError
+	}
+
+	out, err := os.Create(p.out)
+	if err != nil {
+		log.Printf("Creating output file: %v", err)
+		return subcommands.ExitFailure
+	}
+	stats, err := pak.Pack(out, f.Arg(0))
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Printf("Writing pak file: %v", err)
+		return subcommands.ExitFailure
+	}
+
+	for _, path := range stats.Modified {
+		log.Printf("Modified %s", path)
+	}
+	log.Printf("Wrote %d entries (%d modified).", stats.Entries, len(stats.Modified))
+	return subcommands.ExitSuccess
+}
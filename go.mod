@@ -1,14 +1,19 @@
 module github.com/pangbox/pangfiles
 
-go 1.14
+go 1.18
 
 require (
 	bazil.org/fuse v0.0.0-20200524192727-fb710f7dfd05
 	github.com/billziss-gh/cgofuse v1.5.0
-	github.com/go-restruct/restruct v1.2.0-alpha
 	github.com/google/subcommands v1.2.0
 	github.com/stretchr/testify v1.7.0
 	golang.org/x/exp v0.0.0-20210715201039-d37aa40e8013
 	golang.org/x/sys v0.0.0-20220722155257-8c9f86f7a55f
 	golang.org/x/text v0.3.8
 )
+
+require (
+	github.com/davecgh/go-spew v1.1.0 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
+)
@@ -0,0 +1,96 @@
+package pak
+
+import (
+	"bytes"
+	"io"
+	"strings"
+
+	"github.com/pangbox/pangfiles/crypto/pyxtea"
+	"golang.org/x/exp/mmap"
+)
+
+// sizedReaderAt adapts an io.ReaderAt with a known size to ReaderAtLen.
+type sizedReaderAt struct {
+	io.ReaderAt
+	size int64
+}
+
+// Len implements ReaderAtLen.
+func (r sizedReaderAt) Len() int {
+	return int(r.size)
+}
+
+// NewReaderFromBytes returns a new reader for a pak file held in memory.
+func NewReaderFromBytes(k pyxtea.Key, data []byte) (*Reader, error) {
+	return NewReader(k, bytes.NewReader(data))
+}
+
+// NewReaderFromReaderAt returns a new reader for a pak file of the given
+// size, read from r.
+func NewReaderFromReaderAt(k pyxtea.Key, r io.ReaderAt, size int64) (*Reader, error) {
+	return NewReader(k, sizedReaderAt{r, size})
+}
+
+// NewReaderFromURL returns a new reader for a pak file on an HTTP server.
+// Only the parts of the file that are needed are downloaded, using range
+// requests. If opts is nil, default options are used.
+func NewReaderFromURL(k pyxtea.Key, url string, opts *HTTPOptions) (*Reader, error) {
+	r, err := NewHTTPReaderAt(url, opts)
+	if err != nil {
+		return nil, err
+	}
+	return NewReaderFromReaderAt(k, r, r.Size())
+}
+
+// isURL returns true if path refers to an HTTP URL instead of a local file.
+func isURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// OpenFile opens a pak file from a local path or an HTTP URL, for use with
+// NewReader. If the result implements io.Closer, it should be closed when it
+// is no longer needed.
+func OpenFile(path string) (ReaderAtLen, error) {
+	if isURL(path) {
+		r, err := NewHTTPReaderAt(path, nil)
+		if err != nil {
+			return nil, err
+		}
+		return sizedReaderAt{r, r.Size()}, nil
+	}
+	return mmap.Open(path)
+}
+
+// AddPakFromBytes adds a new pak on the filesystem from a pak file held in
+// memory.
+func (fs *FS) AddPakFromBytes(data []byte) error {
+	reader, err := NewReaderFromBytes(fs.key, data)
+	if err != nil {
+		return err
+	}
+	return fs.AddPak(reader)
+}
+
+// AddPakFromReaderAt adds a new pak on the filesystem from a pak file of the
+// given size, read from r.
+func (fs *FS) AddPakFromReaderAt(r io.ReaderAt, size int64) error {
+	reader, err := NewReaderFromReaderAt(fs.key, r, size)
+	if err != nil {
+		return err
+	}
+	return fs.AddPak(reader)
+}
+
+// AddPakFromURL adds a new pak on the filesystem from a pak file on an HTTP
+// server. If opts is nil, default options are used.
+func (fs *FS) AddPakFromURL(url string, opts *HTTPOptions) error {
+	key, err := fs.loadkey(url)
+	if err != nil {
+		return err
+	}
+	reader, err := NewReaderFromURL(key, url, opts)
+	if err != nil {
+		return err
+	}
+	return fs.AddPak(reader)
+}
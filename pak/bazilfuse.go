@@ -5,11 +5,9 @@ package pak
 
 import (
 	"context"
-	"fmt"
-	"log"
 	"os"
-	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
 
 	"bazil.org/fuse"
@@ -23,66 +21,151 @@ const (
 	FuseImplementation = "bazilfuse"
 )
 
-// Mount mounts a pak filesystem via FUSE.
-func (fs *FS) Mount(mountpoint string) error {
+// StartMount mounts a pak filesystem via FUSE. It returns once the mount is
+// live; use the returned handle to wait for or stop serving.
+func (fs *FS) StartMount(mountpoint string) (*MountHandle, error) {
 	c, err := fuse.Mount(
 		mountpoint,
 		fuse.FSName("pakfs"),
 		fuse.Subtype("pakfs"),
 	)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+
+	b := &bazilfs{
+		fs:     fs,
+		server: fusefs.New(c, nil),
+		nodes:  map[uint64]fusefs.Node{},
 	}
-	defer c.Close()
+	unsubscribe := fs.subscribe(b.invalidate)
+
+	// The mount is live once fuse.Mount has returned.
+	h := newMountHandle(mountpoint)
+	h.unmount = func() error { return fuse.Unmount(mountpoint) }
+	h.setReady()
 
-	i := make(chan os.Signal, 1)
-	signal.Notify(i, os.Interrupt)
 	go func() {
-		<-i
-		fmt.Println("Received interrupt, exiting.")
-		if err := fuse.Unmount(mountpoint); err != nil {
-			fmt.Println("fuse.Unmount:", err)
+		err := b.server.Serve(b)
+		unsubscribe()
+		if cerr := c.Close(); err == nil {
+			err = cerr
 		}
-		os.Exit(0)
+		h.finish(err)
 	}()
 
-	return fusefs.Serve(c, fs)
+	return h, nil
+}
+
+// bazilfs implements the FUSE filesystem. Nodes refer to paths, which are
+// resolved against the current tree of the filesystem on each operation, so
+// that they remain valid across reloads.
+type bazilfs struct {
+	fs     *FS
+	server *fusefs.Server
+
+	mu    sync.Mutex
+	nodes map[uint64]fusefs.Node
 }
 
 // Root implements FUSE
-func (fs *FS) Root() (fusefs.Node, error) {
-	return &fusedir{fs.rootdir, fs}, nil
+func (b *bazilfs) Root() (fusefs.Node, error) {
+	return b.dirnode(b.fs.current().root()), nil
+}
+
+// dirnode returns the node for a directory, reusing an existing node with the
+// same inode if the kernel still holds a reference to it.
+func (b *bazilfs) dirnode(dir fsdir) fusefs.Node {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n, ok := b.nodes[dir.inode].(*fusedir); ok {
+		return n
+	}
+	n := &fusedir{path: dir.path, inode: dir.inode, fs: b}
+	b.nodes[dir.inode] = n
+	return n
+}
+
+// filenode returns the node for a file, like dirnode.
+func (b *bazilfs) filenode(file fsfile) fusefs.Node {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n, ok := b.nodes[file.inode].(*fusefile); ok {
+		return n
+	}
+	n := &fusefile{path: file.path, inode: file.inode, fs: b}
+	b.nodes[file.inode] = n
+	return n
+}
+
+func (b *bazilfs) forget(inode uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.nodes, inode)
+}
+
+func (b *bazilfs) node(inode uint64) fusefs.Node {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.nodes[inode]
+}
+
+// invalidate drops kernel caches for paths changed by a reload.
+func (b *bazilfs) invalidate(changes []fschange) {
+	t := b.fs.current()
+	for _, change := range changes {
+		if change.op == changeModified {
+			if n := b.node(change.inode); n != nil {
+				_ = b.server.InvalidateNodeAttr(n)
+				_ = b.server.InvalidateNodeData(n)
+			}
+			continue
+		}
+		parent, name := "", change.path
+		if i := strings.LastIndex(change.path, "/"); i != -1 {
+			parent, name = change.path[:i], change.path[i+1:]
+		}
+		if dir, ok := t.dir(parent); ok {
+			if n := b.node(dir.inode); n != nil {
+				_ = b.server.InvalidateEntry(n, name)
+			}
+		}
+	}
 }
 
 // fusedir implements a pseudo directory for the purpose of supporting FUSE.
 type fusedir struct {
-	dir *fsdir
-	fs  *FS
+	path  string
+	inode uint64
+	fs    *bazilfs
 }
 
 // Attr implements FUSE
 func (d *fusedir) Attr(ctx context.Context, a *fuse.Attr) error {
-	a.Inode = d.dir.inode
+	a.Inode = d.inode
 	a.Mode = os.ModeDir | 0o555
 	return nil
 }
 
+// Forget implements FUSE
+func (d *fusedir) Forget() {
+	d.fs.forget(d.inode)
+}
+
 // Lookup implements FUSE
 func (d *fusedir) Lookup(ctx context.Context, name string) (fusefs.Node, error) {
-	path := d.dir.path
+	path := d.path
 	if path != "" {
 		path += "/"
 	}
 	path += name
 
-	i := searchdirs(d.fs.dirtbl, path)
-	if i < len(d.fs.dirtbl) && d.fs.dirtbl[i].path == path {
-		return &fusedir{dir: d.fs.dirtbl[i], fs: d.fs}, nil
+	t := d.fs.fs.current()
+	if dir, ok := t.dir(path); ok {
+		return d.fs.dirnode(dir), nil
 	}
-
-	i = searchfiles(d.fs.filetbl, path)
-	if i < len(d.fs.filetbl) && d.fs.filetbl[i].path == path {
-		return &fusefile{file: d.fs.filetbl[i], fs: d.fs}, nil
+	if file, ok := t.file(path); ok {
+		return d.fs.filenode(file), nil
 	}
 
 	return nil, syscall.ENOENT
@@ -91,44 +174,18 @@ func (d *fusedir) Lookup(ctx context.Context, name string) (fusefs.Node, error)
 // ReadDirAll implements FUSE
 func (d *fusedir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 	dirents := []fuse.Dirent{}
-
-	prefix := d.dir.path
-	if prefix != "" {
-		prefix += "/"
-	}
-	i := searchdirs(d.fs.dirtbl, prefix)
-	for ; i < len(d.fs.dirtbl); i++ {
-		subdir := d.fs.dirtbl[i]
-		if !strings.HasPrefix(subdir.path, prefix) {
-			break
-		}
-		if subdir.path == "" {
-			continue
-		}
-		dirname := subdir.path[len(prefix):]
-		if strings.ContainsRune(dirname, '/') {
-			continue
-		}
+	dirs, files := d.fs.fs.current().readdir(d.path)
+	for _, subdir := range dirs {
 		dirents = append(dirents, fuse.Dirent{
 			Inode: subdir.inode,
-			Name:  dirname,
+			Name:  basename(subdir.path),
 			Type:  fuse.DT_Dir,
 		})
 	}
-
-	i = searchfiles(d.fs.filetbl, prefix)
-	for ; i < len(d.fs.filetbl); i++ {
-		file := d.fs.filetbl[i]
-		if !strings.HasPrefix(file.path, prefix) {
-			break
-		}
-		dirname := file.path[len(prefix):]
-		if strings.ContainsRune(dirname, '/') {
-			continue
-		}
+	for _, file := range files {
 		dirents = append(dirents, fuse.Dirent{
 			Inode: file.inode,
-			Name:  dirname,
+			Name:  basename(file.path),
 			Type:  fuse.DT_File,
 		})
 	}
@@ -138,16 +195,22 @@ func (d *fusedir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 
 // fusefile implements a file for FUSE.
 type fusefile struct {
-	file *fsfile
-	fs   *FS
+	path  string
+	inode uint64
+	fs    *bazilfs
 }
 
 // Attr implements FUSE
 func (f *fusefile) Attr(ctx context.Context, a *fuse.Attr) error {
-	a.Inode = f.file.inode
+	file, ok := f.fs.fs.current().file(f.path)
+	if !ok {
+		return syscall.ENOENT
+	}
+
+	a.Inode = f.inode
 	a.Mode = 0o444
 
-	size, err := f.file.size()
+	size, err := file.size()
 	if err != nil {
 		return err
 	}
@@ -156,9 +219,18 @@ func (f *fusefile) Attr(ctx context.Context, a *fuse.Attr) error {
 	return nil
 }
 
+// Forget implements FUSE
+func (f *fusefile) Forget() {
+	f.fs.forget(f.inode)
+}
+
 // ReadAll implements FUSE
 func (f *fusefile) ReadAll(ctx context.Context) ([]byte, error) {
-	data, err := f.file.reader.ReadFile(f.file.entry)
+	file, ok := f.fs.fs.current().file(f.path)
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	data, err := f.fs.fs.readcached(&file)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,111 @@
+package pak
+
+import (
+	"container/list"
+	"sync"
+)
+
+// CacheStats contains statistics about a Cache.
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Entries   int
+	Bytes     int64
+	MaxBytes  int64
+}
+
+type cachekey struct {
+	reader *Reader
+	entry  FileEntryData
+}
+
+type cacheitem struct {
+	key  cachekey
+	data []byte
+}
+
+// Cache is a least-recently-used cache of decompressed file data, limited
+// by the total number of bytes cached. It is safe for concurrent use.
+type Cache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	bytes    int64
+	lru      *list.List
+	items    map[cachekey]*list.Element
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// NewCache returns a new cache that holds up to maxBytes of file data.
+func NewCache(maxBytes int64) *Cache {
+	return &Cache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		items:    map[cachekey]*list.Element{},
+	}
+}
+
+func (c *Cache) get(key cachekey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.hits++
+		c.lru.MoveToFront(e)
+		return e.Value.(*cacheitem).data, true
+	}
+	c.misses++
+	return nil, false
+}
+
+func (c *Cache) add(key cachekey, data []byte) {
+	size := int64(len(data))
+	if size > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.items[key]; ok {
+		return
+	}
+	for c.bytes+size > c.maxBytes {
+		c.evict()
+	}
+	c.items[key] = c.lru.PushFront(&cacheitem{key, data})
+	c.bytes += size
+}
+
+func (c *Cache) evict() {
+	e := c.lru.Back()
+	item := e.Value.(*cacheitem)
+	c.lru.Remove(e)
+	delete(c.items, item.key)
+	c.bytes -= int64(len(item.data))
+	c.evictions++
+}
+
+// Purge removes all entries from the cache.
+func (c *Cache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Init()
+	c.items = map[cachekey]*list.Element{}
+	c.bytes = 0
+}
+
+// Stats returns statistics about the usage of the cache.
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Entries:   len(c.items),
+		Bytes:     c.bytes,
+		MaxBytes:  c.maxBytes,
+	}
+}
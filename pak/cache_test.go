@@ -0,0 +1,63 @@
+package pak
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheEviction(t *testing.T) {
+	c := NewCache(10)
+	r := &Reader{}
+	key := func(n uint32) cachekey { return cachekey{r, FileEntryData{Offset: n}} }
+
+	c.add(key(1), []byte("aaaa"))
+	c.add(key(2), []byte("bbbb"))
+	_, ok := c.get(key(1))
+	assert.True(t, ok)
+
+	// Adding a third entry exceeds the budget, evicting the least recently
+	// used entry.
+	c.add(key(3), []byte("cccc"))
+	_, ok = c.get(key(2))
+	assert.False(t, ok)
+	data, ok := c.get(key(1))
+	assert.True(t, ok)
+	assert.Equal(t, []byte("aaaa"), data)
+
+	// Entries larger than the entire budget are never cached.
+	c.add(key(4), []byte("dddddddddddd"))
+	_, ok = c.get(key(4))
+	assert.False(t, ok)
+
+	assert.Equal(t, CacheStats{
+		Hits:      2,
+		Misses:    2,
+		Evictions: 1,
+		Entries:   2,
+		Bytes:     8,
+		MaxBytes:  10,
+	}, c.Stats())
+
+	c.Purge()
+	assert.Equal(t, 0, c.Stats().Entries)
+	assert.Equal(t, int64(0), c.Stats().Bytes)
+}
+
+func TestReadCached(t *testing.T) {
+	data := []byte("file data")
+	r := &Reader{r: bytes.NewReader(data)}
+	file := &fsfile{"file", FileEntryData{PackedFileSize: uint32(len(data)), RealFileSize: uint32(len(data))}, r, 1}
+
+	fs := NewFS(r.k)
+	fs.SetCache(NewCache(1024))
+	for i := 0; i < 3; i++ {
+		out, err := fs.readcached(file)
+		assert.NoError(t, err)
+		assert.Equal(t, data, out)
+	}
+	stats := fs.Cache().Stats()
+	assert.Equal(t, uint64(2), stats.Hits)
+	assert.Equal(t, uint64(1), stats.Misses)
+}
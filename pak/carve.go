@@ -0,0 +1,179 @@
+package pak
+
+import (
+	"bytes"
+)
+
+// lzProbeLen is the amount of decoded output required before an LZ decode
+// that fails is still considered plausible. Data that is not LZ compressed
+// tends to produce an invalid back-reference almost immediately.
+const lzProbeLen = 256
+
+// Orphan is data found in a region of a pak file that is not referenced by
+// the file table, such as data left behind by an older file table.
+type Orphan struct {
+	// Region is the region of the pak file holding the orphaned data. As
+	// the length of orphaned data is not known, the region extends to the
+	// start of the next recognized file or the end of the unused gap.
+	Region Region
+	// FileType is the encoding the data was decoded with; one of
+	// FileTypeBasic, FileTypeLz or FileTypeLz2.
+	FileType byte
+	// Ext is the extension of the file type recognized by DetectFileType,
+	// or an empty string if it was not recognized.
+	Ext string
+	// Data is the decoded data. It may contain trailing garbage.
+	Data []byte
+}
+
+// CarveOptions configures Reader.Carve.
+type CarveOptions struct {
+	// IncludeUnknown includes the parts of unused gaps in which no file
+	// type could be recognized, as raw data.
+	IncludeUnknown bool
+
+	// MinSize is the minimum size of a gap to search. Smaller gaps, which
+	// are usually alignment padding, are skipped.
+	MinSize int64
+
+	// Layout is the layout of the pak file, as returned by Reader.Layout.
+	// If nil, the file table is read to find it.
+	Layout *Layout
+}
+
+// carvestart is a candidate start of an orphaned file within a gap.
+type carvestart struct {
+	pos      int
+	fileType byte
+}
+
+// Carve searches the regions of the pak file not referenced by the file
+// table for orphaned files. Files are found by looking for known magic bytes
+// stored either raw or at the start of LZ compressed data. If opts is nil,
+// default options are used.
+func (r *Reader) Carve(opts *CarveOptions) ([]Orphan, error) {
+	if opts == nil {
+		opts = &CarveOptions{}
+	}
+	layout := opts.Layout
+	if layout == nil {
+		var err error
+		layout, err = r.Layout()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	orphans := []Orphan{}
+	for _, gap := range layout.Gaps {
+		if gap.Len() < opts.MinSize {
+			continue
+		}
+		buf := make([]byte, gap.Len())
+		if _, err := r.r.ReadAt(buf, gap.Start); err != nil {
+			return nil, err
+		}
+		orphans = append(orphans, carveGap(buf, gap.Start, opts.IncludeUnknown)...)
+	}
+	return orphans, nil
+}
+
+// carveGap finds orphaned files in the data of a gap starting at base.
+func carveGap(buf []byte, base int64, unknown bool) []Orphan {
+	starts := carveStarts(buf)
+	orphans := []Orphan{}
+
+	if unknown && (len(starts) == 0 || starts[0].pos > 0) {
+		end := len(buf)
+		if len(starts) > 0 {
+			end = starts[0].pos
+		}
+		orphans = append(orphans, Orphan{
+			Region:   Region{Start: base, End: base + int64(end)},
+			FileType: FileTypeBasic,
+			Data:     buf[:end],
+		})
+	}
+
+	for i, start := range starts {
+		end := len(buf)
+		if i+1 < len(starts) {
+			end = starts[i+1].pos
+		}
+		data := decodeOrphan(buf[start.pos:end], start.fileType)
+		orphans = append(orphans, Orphan{
+			Region:   Region{Start: base + int64(start.pos), End: base + int64(end)},
+			FileType: start.fileType,
+			Ext:      DetectFileType(data),
+			Data:     data,
+		})
+	}
+	return orphans
+}
+
+// carveStarts returns the positions in buf at which a recognized file type
+// appears to start.
+func carveStarts(buf []byte) []carvestart {
+	starts := []carvestart{}
+	for i := 0; i < len(buf); i++ {
+		if DetectFileType(buf[i:]) != "" {
+			// Magic bytes following the flags of plausible LZ data at i-1
+			// belong to that data.
+			if n := len(starts); n > 0 && starts[n-1].pos == i-1 {
+				continue
+			}
+			starts = append(starts, carvestart{i, FileTypeBasic})
+			continue
+		}
+		if i+1 >= len(buf) {
+			continue
+		}
+		for _, fileType := range []byte{FileTypeLz, FileTypeLz2} {
+			if lzMagic(buf[i:], fileType) && plausibleLz(buf[i:], fileType) {
+				starts = append(starts, carvestart{i, fileType})
+				break
+			}
+		}
+	}
+	return starts
+}
+
+// lzMagic returns true if buf begins with LZ data whose first items are
+// literals forming known magic bytes.
+func lzMagic(buf []byte, fileType byte) bool {
+	flags := buf[0]
+	if fileType == FileTypeLz2 {
+		flags ^= 0xC8
+	}
+	for _, m := range magics {
+		if len(m.prefix) > 8 || flags&(1<<len(m.prefix)-1) != 0 {
+			continue
+		}
+		if bytes.HasPrefix(buf[1:], m.prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// plausibleLz returns true if buf decodes as LZ data for long enough to be
+// plausible.
+func plausibleLz(buf []byte, fileType byte) bool {
+	out, err := decodeLz(buf, fileType)
+	return err == nil || len(out) >= lzProbeLen
+}
+
+func decodeLz(buf []byte, fileType byte) ([]byte, error) {
+	entry := FileEntryData{Type: fileType, PackedFileSize: uint32(len(buf))}
+	return decompress(entry, bytes.NewReader(buf))
+}
+
+// decodeOrphan decodes orphaned data. Decoding errors are expected, as the
+// data may be followed by garbage; the data decoded up to the error is kept.
+func decodeOrphan(buf []byte, fileType byte) []byte {
+	if fileType == FileTypeBasic {
+		return buf
+	}
+	out, _ := decodeLz(buf, fileType)
+	return out
+}
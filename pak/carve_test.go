@@ -0,0 +1,114 @@
+package pak_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pangbox/pangfiles/pak"
+	"github.com/pangbox/pangfiles/pak/paktest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectFileType(t *testing.T) {
+	tests := []struct {
+		data []byte
+		ext  string
+	}{
+		{[]byte("DDS |\x00\x00\x00"), ".dds"},
+		{[]byte("\x89PNG\r\n\x1a\n\x00"), ".png"},
+		{[]byte("RIFF\x00\x00\x00\x00WAVEfmt "), ".wav"},
+		{[]byte("RIFF\x00\x00\x00\x00AVI LIST"), ""},
+		{[]byte("BM\x36\x00\x00\x00\x00\x00\x00\x00"), ".bmp"},
+		{[]byte("BMW is a car"), ""},
+		{[]byte("plain text"), ""},
+		{nil, ""},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.ext, pak.DetectFileType(test.data), "%q", test.data)
+	}
+}
+
+func TestCarve(t *testing.T) {
+	dds := append([]byte("DDS |"), bytes.Repeat([]byte("texture data "), 100)...)
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{1, 2, 3, 4, 5}, 20)...)
+	ogg := append([]byte("OggS"), bytes.Repeat([]byte("vorbis audio "), 100)...)
+
+	// Orphan files by pointing their entries at the data of another file.
+	orphan := func(entry *pak.FileEntryData) {
+		entry.Offset = 0
+		entry.PackedFileSize = 4
+		entry.RealFileSize = 4
+	}
+	image := paktest.Pak{Key: testKey, Files: []paktest.File{
+		{Path: "keep.txt", Data: []byte("keep"), EntryType: pak.EntryTypeXTEA},
+		{Path: "a.dds", Data: dds, FileType: pak.FileTypeLz, EntryType: pak.EntryTypeXTEA, Header: orphan},
+		{Path: "b.png", Data: png, EntryType: pak.EntryTypeXTEA, Header: orphan},
+		{Path: "c.ogg", Data: ogg, FileType: pak.FileTypeLz2, EntryType: pak.EntryTypeXTEA, Header: orphan},
+	}}
+	r, err := pak.NewReaderFromBytes(testKey, image.Bytes())
+	require.NoError(t, err)
+
+	orphans, err := r.Carve(nil)
+	require.NoError(t, err)
+	require.Len(t, orphans, 3)
+
+	assert.Equal(t, int64(4), orphans[0].Region.Start)
+	assert.Equal(t, byte(pak.FileTypeLz), orphans[0].FileType)
+	assert.Equal(t, ".dds", orphans[0].Ext)
+	assert.Equal(t, dds, orphans[0].Data)
+
+	assert.Equal(t, byte(pak.FileTypeBasic), orphans[1].FileType)
+	assert.Equal(t, ".png", orphans[1].Ext)
+	assert.Equal(t, png, orphans[1].Data)
+
+	assert.Equal(t, byte(pak.FileTypeLz2), orphans[2].FileType)
+	assert.Equal(t, ".ogg", orphans[2].Ext)
+	assert.Equal(t, ogg, orphans[2].Data)
+}
+
+func TestCarveUnknown(t *testing.T) {
+	image := paktest.Pak{Key: testKey, Files: []paktest.File{
+		{Path: "keep.txt", Data: []byte("keep"), EntryType: pak.EntryTypeXTEA},
+		{Path: "lost.txt", Data: []byte("unrecognized"), EntryType: pak.EntryTypeXTEA, Header: func(entry *pak.FileEntryData) {
+			entry.Offset = 0
+			entry.PackedFileSize = 4
+		}},
+	}}
+	r, err := pak.NewReaderFromBytes(testKey, image.Bytes())
+	require.NoError(t, err)
+
+	orphans, err := r.Carve(nil)
+	require.NoError(t, err)
+	assert.Empty(t, orphans)
+
+	orphans, err = r.Carve(&pak.CarveOptions{IncludeUnknown: true})
+	require.NoError(t, err)
+	require.Len(t, orphans, 1)
+	assert.Equal(t, "", orphans[0].Ext)
+	assert.Equal(t, []byte("unrecognized"), orphans[0].Data)
+}
+
+func TestCarveWithLayout(t *testing.T) {
+	image := paktest.Pak{Key: testKey, Files: []paktest.File{
+		{Path: "keep.txt", Data: []byte("keep"), EntryType: pak.EntryTypeXTEA},
+		{Path: "lost.txt", Data: []byte("unrecognized"), EntryType: pak.EntryTypeXTEA, Header: func(entry *pak.FileEntryData) {
+			entry.Offset = 0
+			entry.PackedFileSize = 4
+		}},
+	}}
+	r, err := pak.NewReaderFromBytes(testKey, image.Bytes())
+	require.NoError(t, err)
+	layout, err := r.Layout()
+	require.NoError(t, err)
+
+	orphans, err := r.Carve(&pak.CarveOptions{IncludeUnknown: true, Layout: layout})
+	require.NoError(t, err)
+	require.Len(t, orphans, 1)
+	assert.Equal(t, []byte("unrecognized"), orphans[0].Data)
+
+	// Only the gaps of the given layout are searched.
+	orphans, err = r.Carve(&pak.CarveOptions{IncludeUnknown: true, Layout: &pak.Layout{Size: layout.Size}})
+	require.NoError(t, err)
+	assert.Empty(t, orphans)
+}
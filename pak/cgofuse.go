@@ -9,6 +9,7 @@ import (
 	"errors"
 	"log"
 	"strings"
+	"sync"
 
 	"github.com/billziss-gh/cgofuse/fuse"
 )
@@ -20,21 +21,47 @@ const (
 	FuseImplementation = "cgofuse"
 )
 
-// Mount mounts a pak filesystem via FUSE.
-func (fs *FS) Mount(mountpoint string) error {
-	fusefs := &cfsfuse{fs: fs, cache: makecache()}
+// StartMount mounts a pak filesystem via FUSE. It returns once the mount is
+// live; use the returned handle to wait for or stop serving.
+func (fs *FS) StartMount(mountpoint string) (*MountHandle, error) {
+	h := newMountHandle(mountpoint)
+	fusefs := &cfsfuse{fs: fs, fd: map[uint64]cfusefd{}, handle: h}
 	host := fuse.NewFileSystemHost(fusefs)
-	if !host.Mount(mountpoint, nil) {
-		return errors.New("failed to mount filesystem")
+	fusefs.host = host
+	h.unmount = func() error {
+		if !host.Unmount() {
+			return errors.New("failed to unmount filesystem")
+		}
+		return nil
 	}
-	return nil
+
+	// Changes are subscribed to before mounting, so that none made while
+	// the mount starts are missed.
+	unsubscribe := fs.subscribe(fusefs.invalidate)
+	go func() {
+		defer unsubscribe()
+		if !host.Mount(mountpoint, nil) {
+			h.finish(errors.New("failed to mount filesystem"))
+			return
+		}
+		h.finish(nil)
+	}()
+
+	if err := h.waitReady(); err != nil {
+		return nil, err
+	}
+	return h, nil
 }
 
 type cfsfuse struct {
 	fuse.FileSystemBase
-	fs    *FS
-	fd    []cfusefd
-	cache cache
+	fs     *FS
+	handle *MountHandle
+	host   *fuse.FileSystemHost
+
+	fdmu   sync.Mutex
+	fd     map[uint64]cfusefd
+	nextfd uint64
 }
 
 type cfusefile struct {
@@ -51,14 +78,12 @@ func (f *cfsfuse) lookup(path string) (*cfusefile, int) {
 	if len(path) > 0 && path[0] == '/' {
 		path = path[1:]
 	}
-	if path == "" {
-		return &cfusefile{dir: f.fs.rootdir, fs: f}, 0
-	}
-	if i := searchdirs(f.fs.dirtbl, path); i < len(f.fs.dirtbl) && f.fs.dirtbl[i].path == path {
-		return &cfusefile{dir: f.fs.dirtbl[i], fs: f}, 0
+	t := f.fs.current()
+	if dir, ok := t.dir(path); ok {
+		return &cfusefile{dir: &dir, fs: f}, 0
 	}
-	if i := searchfiles(f.fs.filetbl, path); i < len(f.fs.filetbl) && f.fs.filetbl[i].path == path {
-		return &cfusefile{file: f.fs.filetbl[i], fs: f}, 0
+	if file, ok := t.file(path); ok {
+		return &cfusefile{file: &file, fs: f}, 0
 	}
 	return nil, -fuse.ENOENT
 }
@@ -78,23 +103,56 @@ func (f *cfsfuse) getdattr(d *fsdir, stat *fuse.Stat_t) {
 	stat.Mode = fuse.S_IFDIR | 0o555
 }
 
+// Init is called by cgofuse once the filesystem is mounted.
+func (f *cfsfuse) Init() {
+	f.handle.setReady()
+}
+
+// invalidate notifies the operating system of paths changed by a reload,
+// where supported.
+func (f *cfsfuse) invalidate(changes []fschange) {
+	for _, change := range changes {
+		path := "/" + change.path
+		action := uint32(0)
+		switch {
+		case change.op == changeModified:
+			action = fuse.NOTIFY_TRUNCATE | fuse.NOTIFY_UTIME
+		case change.op == changeAdded && change.dir:
+			action = fuse.NOTIFY_MKDIR
+		case change.op == changeAdded:
+			action = fuse.NOTIFY_CREATE
+		case change.op == changeRemoved && change.dir:
+			action = fuse.NOTIFY_RMDIR
+		case change.op == changeRemoved:
+			action = fuse.NOTIFY_UNLINK
+		}
+		f.host.Notify(path, action)
+	}
+}
+
 func (f *cfsfuse) Open(path string, flags int) (errc int, fh uint64) {
 	d, errc := f.lookup(path)
 	if errc != 0 || d.file == nil {
 		return errc, ^uint64(0)
 	}
-	data := f.cache.get(path)
-	if data == nil {
-		var err error
-		data, err = d.file.reader.ReadFile(d.file.entry)
-		if err != nil {
-			log.Printf("Error reading file for %q: %s", path, err)
-		}
-		f.cache.set(path, data)
+	data, err := f.fs.readcached(d.file)
+	if err != nil {
+		log.Printf("Error reading file for %q: %s", path, err)
+		return -fuse.EIO, ^uint64(0)
 	}
 
-	f.fd = append(f.fd, cfusefd{data: data})
-	return 0, uint64(len(f.fd) - 1)
+	f.fdmu.Lock()
+	defer f.fdmu.Unlock()
+	f.nextfd++
+	f.fd[f.nextfd] = cfusefd{data: data}
+	return 0, f.nextfd
+}
+
+func (f *cfsfuse) Release(path string, fh uint64) (errc int) {
+	f.fdmu.Lock()
+	defer f.fdmu.Unlock()
+	delete(f.fd, fh)
+	return 0
 }
 
 func (f *cfsfuse) Getattr(path string, stat *fuse.Stat_t, fh uint64) (errc int) {
@@ -119,17 +177,19 @@ func (f *cfsfuse) Getattr(path string, stat *fuse.Stat_t, fh uint64) (errc int)
 }
 
 func (f *cfsfuse) Read(path string, buff []byte, offset int64, fh uint64) (n int) {
-	if int(fh) > len(f.fd) || fh < 0 {
+	f.fdmu.Lock()
+	fd, ok := f.fd[fh]
+	f.fdmu.Unlock()
+	if !ok {
+		return -fuse.EBADF
+	}
+	if offset < 0 || offset >= int64(len(fd.data)) {
 		return 0
 	}
-	fd := f.fd[fh]
 	size := len(buff)
 	if size > len(fd.data)-int(offset) {
 		size = len(fd.data) - int(offset)
 	}
-	if offset < 0 {
-		return 0
-	}
 	n = copy(buff, fd.data[offset:int(offset)+size])
 	return
 }
@@ -137,41 +197,16 @@ func (f *cfsfuse) Read(path string, buff []byte, offset int64, fh uint64) (n int
 func (f *cfsfuse) Readdir(path string, fill func(name string, stat *fuse.Stat_t, ofst int64) bool, offset int64, fh uint64) (errc int) {
 	fill(".", nil, 0)
 	fill("..", nil, 0)
-	prefix := path
-	if len(prefix) > 0 && prefix[0] == '/' {
-		prefix = prefix[1:]
-	}
-	if prefix != "" {
-		prefix += "/"
-	}
-	for i := searchdirs(f.fs.dirtbl, prefix); i < len(f.fs.dirtbl); i++ {
-		subdir := f.fs.dirtbl[i]
-		if !strings.HasPrefix(subdir.path, prefix) {
-			break
-		}
-		if subdir.path == "" {
-			continue
-		}
-		dirname := subdir.path[len(prefix):]
-		if strings.ContainsRune(dirname, '/') {
-			continue
-		}
+	dirs, files := f.fs.current().readdir(strings.TrimPrefix(path, "/"))
+	for _, subdir := range dirs {
 		stat := &fuse.Stat_t{}
-		f.getdattr(subdir, stat)
-		fill(dirname, stat, 0)
+		f.getdattr(&subdir, stat)
+		fill(basename(subdir.path), stat, 0)
 	}
-	for i := searchfiles(f.fs.filetbl, prefix); i < len(f.fs.filetbl); i++ {
-		file := f.fs.filetbl[i]
-		if !strings.HasPrefix(file.path, prefix) {
-			break
-		}
-		filename := file.path[len(prefix):]
-		if strings.ContainsRune(filename, '/') {
-			continue
-		}
+	for _, file := range files {
 		stat := &fuse.Stat_t{}
-		f.getfattr(file, stat)
-		fill(filename, nil, 0)
+		f.getfattr(&file, stat)
+		fill(basename(file.path), stat, 0)
 	}
 	return 0
 }
@@ -0,0 +1,59 @@
+package pak
+
+import (
+	"encoding/binary"
+)
+
+// Compress compresses data with the LZ77 scheme used by pak files. The
+// fileType must be FileTypeLz or FileTypeLz2.
+func Compress(data []byte, fileType byte) []byte {
+	obfuscate := fileType&FileTypeMask == FileTypeLz2
+	out := []byte{}
+	last := map[[2]byte]int{}
+
+	for i := 0; i < len(data); {
+		flagpos := len(out)
+		out = append(out, 0)
+		flags := byte(0)
+		items := [8][]byte{}
+
+		n := 0
+		for ; n < 8 && i < len(data); n++ {
+			size, off := 0, 0
+			if i+1 < len(data) {
+				if p, ok := last[[2]byte{data[i], data[i+1]}]; ok && i-p <= 0xFFF {
+					off = i - p
+					for size < 17 && size < off && i+size < len(data) && data[p+size] == data[i+size] {
+						size++
+					}
+				}
+			}
+			if size >= 2 {
+				value := uint16(off) | uint16(size-2)<<12
+				items[n] = []byte{byte(value), byte(value >> 8)}
+				flags |= 1 << n
+			} else {
+				size = 1
+				items[n] = []byte{data[i]}
+			}
+			for j := i; j < i+size && j+1 < len(data); j++ {
+				last[[2]byte{data[j], data[j+1]}] = j
+			}
+			i += size
+		}
+
+		if obfuscate {
+			flags ^= 0xC8
+		}
+		out[flagpos] = flags
+		for j := 0; j < n; j++ {
+			if obfuscate && len(items[j]) == 2 {
+				value := binary.LittleEndian.Uint16(items[j]) ^ valuePad[(flags>>3)&7]
+				binary.LittleEndian.PutUint16(items[j], value)
+			}
+			out = append(out, items[j]...)
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,171 @@
+package pak_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pangbox/pangfiles/pak"
+	"github.com/pangbox/pangfiles/pak/paktest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// These tests are most useful when run with the race detector enabled.
+
+func layerPak(layer int, files int) paktest.Pak {
+	p := paktest.Pak{Key: testKey}
+	for i := 0; i < files; i++ {
+		p.Files = append(p.Files, paktest.File{
+			Path:      fmt.Sprintf("layer%02d/l%02d_file%02d.txt", layer, layer, i),
+			Data:      []byte(fmt.Sprintf("layer %d file %d", layer, i)),
+			FileType:  pak.FileTypeLz,
+			EntryType: pak.EntryTypeXTEA,
+		})
+	}
+	// Every layer also overrides a shared file.
+	p.Files = append(p.Files, paktest.File{
+		Path:      "shared/override.txt",
+		Data:      []byte(fmt.Sprintf("layer %d", layer)),
+		EntryType: pak.EntryTypeXTEA,
+	})
+	return p
+}
+
+// readConcurrently exercises the read APIs of fs until stop is closed.
+func readConcurrently(fs *pak.FS, stop chan struct{}, wg *sync.WaitGroup) {
+	readers := []func(){
+		func() {
+			_, _ = fs.ReadFile("override.txt")
+		},
+		func() {
+			for i := 0; i < fs.NumFiles(); i++ {
+				_, _, _ = fs.ReadFileByIndex(i)
+			}
+		},
+		func() {
+			_ = fs.Walk("", func(path string, entry pak.DirEntry, err error) error { return nil })
+		},
+		func() {
+			_, _ = fs.Glob("layer*/*.txt")
+			_, _ = fs.ReadDir("shared")
+			_, _ = fs.Stat("shared/override.txt")
+		},
+		func() {
+			_ = fs.Search(pak.BytesMatcher([]byte("file 1")), &pak.SearchOptions{Workers: 2}, func(pak.Match) {})
+		},
+	}
+	for _, read := range readers {
+		wg.Add(1)
+		go func(read func()) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					read()
+				}
+			}
+		}(read)
+	}
+}
+
+func TestConcurrentAddPak(t *testing.T) {
+	const layers, files = 16, 8
+
+	fs := pak.NewFS(testKey)
+	require.NoError(t, fs.AddPak(mustReader(t, layerPak(0, files))))
+	flat, _, unflatten := fs.Flatten()
+	defer unflatten()
+
+	stop := make(chan struct{})
+	readwg := sync.WaitGroup{}
+	readConcurrently(fs, stop, &readwg)
+	readConcurrently(flat, stop, &readwg)
+
+	// Layers are added from several goroutines at once; none may be lost.
+	readers := []*pak.Reader{}
+	for layer := 1; layer < layers; layer++ {
+		readers = append(readers, mustReader(t, layerPak(layer, files)))
+	}
+	addwg := sync.WaitGroup{}
+	for _, reader := range readers {
+		addwg.Add(1)
+		go func(reader *pak.Reader) {
+			defer addwg.Done()
+			assert.NoError(t, fs.AddPak(reader))
+		}(reader)
+	}
+	addwg.Wait()
+	close(stop)
+	readwg.Wait()
+
+	assert.Equal(t, layers*files+1, fs.NumFiles())
+	assert.Equal(t, layers*files+1, flat.NumFiles())
+	for layer := 0; layer < layers; layer++ {
+		entry, err := fs.Stat(fmt.Sprintf("layer%02d/l%02d_file%02d.txt", layer, layer, files-1))
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(fmt.Sprintf("layer %d file %d", layer, files-1))), entry.Size)
+	}
+}
+
+func TestConcurrentWatcherUpdate(t *testing.T) {
+	dir := t.TempDir()
+	mtime := time.Now().Add(-time.Hour)
+	base := layerPak(0, 8)
+	writeTestPak(t, filepath.Join(dir, "projectg100.pak"), mtime, base.Files...)
+
+	fs := pak.NewFS(testKey)
+	w := pak.NewWatcher(fs, []string{filepath.Join(dir, "projectg*.pak")})
+	_, err := w.Update()
+	require.NoError(t, err)
+
+	stop := make(chan struct{})
+	wg := sync.WaitGroup{}
+	readConcurrently(fs, stop, &wg)
+
+	// Layers are added and removed on disk while the filesystem is read,
+	// and while other paks are added directly.
+	patch := filepath.Join(dir, "projectg101.pak")
+	direct := []*pak.Reader{}
+	for i := 0; i < 8; i++ {
+		direct = append(direct, mustReader(t, layerPak(10+i, 2)))
+	}
+	for i := 0; i < 8; i++ {
+		if i%2 == 0 {
+			writeTestPak(t, patch, mtime.Add(time.Duration(i)*time.Minute), layerPak(1, 4).Files...)
+		} else {
+			require.NoError(t, os.Remove(patch))
+		}
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := w.Update()
+			assert.NoError(t, err)
+		}()
+		go func(reader *pak.Reader) {
+			defer wg.Done()
+			assert.NoError(t, fs.AddPak(reader))
+		}(direct[i])
+	}
+	close(stop)
+	wg.Wait()
+
+	// Paks added directly survive updates, and stay below the watched paks.
+	writeTestPak(t, patch, mtime.Add(time.Hour), layerPak(1, 4).Files...)
+	_, err = w.Update()
+	require.NoError(t, err)
+	for i := range direct {
+		data, err := fs.ReadFile(fmt.Sprintf("l%02d_file01.txt", 10+i))
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("layer %d file 1", 10+i), string(data))
+	}
+	data, err := fs.ReadFile("override.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "layer 1", string(data))
+	assert.NoError(t, fs.RemovePak(direct[0]))
+}
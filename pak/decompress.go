@@ -2,43 +2,89 @@ package pak
 
 import (
 	"encoding/binary"
+	"errors"
 	"io"
 )
 
+// ErrInvalidBackReference is returned when compressed data refers to data
+// before the start of the file.
+var ErrInvalidBackReference = errors.New("invalid lz back-reference")
+
 var valuePad = []uint16{
 	0xFF21, 0x834F, 0x675F, 0x0034, 0xF237, 0x815F, 0x4765, 0x0233,
 }
 
+// maxLzRatio bounds the ratio of decompressed to compressed LZ data: each
+// flag byte is followed by up to 8 back-references of 2 bytes, each of which
+// expands to at most 17 bytes.
+const maxLzRatio = 8
+
+// decompress reads and decodes the data of a file entry. On error, the data
+// decoded so far is returned along with the error.
 func decompress(entry FileEntryData, f io.ReaderAt) ([]byte, error) {
-	var out []byte
+	return decompressInto(nil, nil, entry, f)
+}
 
+// decompressInto is like decompress, but appends the decoded data to dst.
+// If scratch is not nil, compressed data is read into it, and it is grown as
+// needed, so that no allocations are made once dst and scratch are large
+// enough.
+func decompressInto(dst []byte, scratch *[]byte, entry FileEntryData, f io.ReaderAt) ([]byte, error) {
+	n := int(entry.PackedFileSize)
 	if entry.Type&FileTypeMask == FileTypeBasic {
-		out = make([]byte, entry.PackedFileSize)
-		_, err := f.ReadAt(out, int64(entry.Offset))
-		if err != nil {
-			return nil, err
+		dst = grow(dst, n)
+		if n > 0 {
+			if _, err := f.ReadAt(dst[len(dst):len(dst)+n], int64(entry.Offset)); err != nil {
+				return nil, err
+			}
 		}
-		return out, nil
+		return dst[:len(dst)+n], nil
 	}
 
-	buf := [2]byte{}
+	var packed []byte
+	if scratch != nil {
+		*scratch = grow((*scratch)[:0], n)
+		packed = (*scratch)[:n]
+	} else {
+		packed = make([]byte, n)
+	}
+	if n > 0 {
+		if _, err := f.ReadAt(packed, int64(entry.Offset)); err != nil {
+			return dst, err
+		}
+	}
 
-	var counter, seq, realseq byte
+	// The real file size is untrusted, so only as much space as the packed
+	// data can decode to is reserved up front.
+	size := int(entry.RealFileSize)
+	if limit := n * maxLzRatio; size > limit {
+		size = limit
+	}
+	return decodeLzInto(grow(dst, size), packed, entry.Type)
+}
 
-	off := int64(entry.Offset)
+// grow returns dst with capacity for at least n more bytes.
+func grow(dst []byte, n int) []byte {
+	if cap(dst)-len(dst) >= n {
+		return dst
+	}
+	grown := make([]byte, len(dst), len(dst)+n)
+	copy(grown, dst)
+	return grown
+}
 
-	readlen := int64(entry.PackedFileSize)
-	for j := int64(0); j < readlen; {
+// decodeLzInto decodes LZ data of the given file type, appending it to out.
+// On error, the data decoded so far is returned along with the error.
+func decodeLzInto(out, packed []byte, fileType byte) ([]byte, error) {
+	start := len(out)
+	var counter, seq, realseq byte
+	for j := 0; j < len(packed); {
 		if counter == 0 {
-			_, err := f.ReadAt(buf[0:1], off+j)
-			if err != nil {
-				return []byte{}, err
-			}
-			seq = buf[0]
+			seq = packed[j]
 			realseq = seq
 			j++
 
-			if entry.Type&FileTypeMask == FileTypeLz2 {
+			if fileType&FileTypeMask == FileTypeLz2 {
 				seq ^= 0xC8
 			}
 		} else {
@@ -46,27 +92,32 @@ func decompress(entry FileEntryData, f io.ReaderAt) ([]byte, error) {
 		}
 
 		if seq&1 == 1 {
-			_, err := f.ReadAt(buf[0:2], off+j)
-			if err != nil {
-				return []byte{}, err
+			if j+2 > len(packed) {
+				return out, io.EOF
 			}
-			value := binary.LittleEndian.Uint16(buf[0:2])
+			value := binary.LittleEndian.Uint16(packed[j : j+2])
 			j += 2
 
-			if entry.Type&FileTypeMask == FileTypeLz2 {
+			if fileType&FileTypeMask == FileTypeLz2 {
 				value ^= valuePad[(realseq>>3)&7]
 			}
 
 			off := int(value & 0xFFF)
 			size := int((value >> 12) + 2)
+			if off > len(out)-start {
+				return out, ErrInvalidBackReference
+			}
+			// Like copy, a reference overlapping the data being written
+			// reads the zeroes appended for it, rather than repeating
+			// earlier output.
+			from := len(out) - off
 			out = append(out, make([]byte, size)...)
-			copy(out[len(out)-size:], out[len(out)-off-size:len(out)-off])
+			copy(out[len(out)-size:], out[from:from+size])
 		} else {
-			_, err := f.ReadAt(buf[0:1], off+j)
-			if err != nil {
-				return []byte{}, err
+			if j >= len(packed) {
+				return out, io.EOF
 			}
-			out = append(out, buf[0])
+			out = append(out, packed[j])
 			j++
 		}
 		counter = (counter + 1) & 7
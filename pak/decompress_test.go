@@ -0,0 +1,95 @@
+package pak_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pangbox/pangfiles/pak"
+	"github.com/pangbox/pangfiles/pak/paktest"
+	"github.com/stretchr/testify/assert"
+)
+
+// maxExpansion is the most output a compressed stream can produce per byte:
+// a flag byte followed by eight 2-byte references yields 8*17 bytes from 17.
+const maxExpansion = 8
+
+var compressSamples = [][]byte{
+	{},
+	[]byte("a"),
+	[]byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"),
+	[]byte("abcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabc"),
+	[]byte("The quick brown fox jumps over the lazy dog. The quick brown fox jumps over the lazy dog."),
+	bytes.Repeat([]byte{0x00, 0x01, 0x02, 0x03, 0xFF}, 2000),
+}
+
+// decompressPacked reads a raw compressed stream through a single-entry pak.
+func decompressPacked(t *testing.T, packed []byte, fileType byte) ([]byte, error) {
+	r, err := pak.NewReader(testKey, paktest.Pak{
+		Files: []paktest.File{{Path: "file", FileType: fileType, Packed: packed}},
+	}.Reader())
+	if err != nil {
+		t.Fatalf("opening synthetic pak: %v", err)
+	}
+	entry := pak.FileEntryData{Type: fileType, PackedFileSize: uint32(len(packed))}
+	return r.ReadFile(entry)
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	for _, fileType := range []byte{pak.FileTypeLz, pak.FileTypeLz2} {
+		for _, sample := range compressSamples {
+			out, err := decompressPacked(t, paktest.Compress(sample, fileType), fileType)
+			assert.NoError(t, err)
+			assert.Equal(t, len(sample), len(out))
+			assert.True(t, bytes.Equal(sample, out))
+		}
+	}
+}
+
+func TestDecompressInvalidBackReference(t *testing.T) {
+	_, err := decompressPacked(t, []byte{0x01, 0x05, 0x00}, pak.FileTypeLz)
+	assert.ErrorIs(t, err, pak.ErrInvalidBackReference)
+}
+
+func FuzzDecompress(f *testing.F) {
+	for _, sample := range compressSamples {
+		f.Add(paktest.Compress(sample, pak.FileTypeLz), byte(pak.FileTypeLz))
+		f.Add(paktest.Compress(sample, pak.FileTypeLz2), byte(pak.FileTypeLz2))
+	}
+
+	f.Fuzz(func(t *testing.T, packed []byte, fileType byte) {
+		fileType &= pak.FileTypeMask
+		if fileType != pak.FileTypeLz && fileType != pak.FileTypeLz2 {
+			return
+		}
+
+		var out []byte
+		allocated := allocBytes(func() {
+			out, _ = decompressPacked(t, packed, fileType)
+		})
+		if len(out) > maxExpansion*len(packed) {
+			t.Fatalf("decompressed %d bytes into %d bytes", len(packed), len(out))
+		}
+		checkAllocBound(t, allocated, len(packed))
+	})
+}
+
+func FuzzCompressRoundTrip(f *testing.F) {
+	for _, sample := range compressSamples {
+		f.Add(sample, false)
+		f.Add(sample, true)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte, obfuscate bool) {
+		fileType := byte(pak.FileTypeLz)
+		if obfuscate {
+			fileType = pak.FileTypeLz2
+		}
+		out, err := decompressPacked(t, paktest.Compress(data, fileType), fileType)
+		if err != nil {
+			t.Fatalf("decompressing round-trip data: %v", err)
+		}
+		if !bytes.Equal(data, out) {
+			t.Fatalf("round-trip mismatch: got % 02x, want % 02x", out, data)
+		}
+	})
+}
@@ -0,0 +1,180 @@
+package pak
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/pangbox/pangfiles/crypto/pyxtea"
+)
+
+// DuplicateFile is a copy of a file in a group of duplicates.
+type DuplicateFile struct {
+	// Reader is the pak file containing the copy.
+	Reader *Reader
+	// Path is the path of the copy.
+	Path string
+	// Entry is the file entry of the copy.
+	Entry FileEntryData
+}
+
+// DuplicateGroup is a set of file entries with identical decompressed
+// contents.
+type DuplicateGroup struct {
+	// Hash is the SHA-256 hash of the contents.
+	Hash [sha256.Size]byte
+	// Size is the decompressed size of the contents.
+	Size int64
+	// Files are the entries with these contents, in pak and file table
+	// order.
+	Files []DuplicateFile
+	// Wasted is the number of bytes of packed data that would not need to
+	// be stored if every entry shared a single copy. Entries that already
+	// share data are not counted.
+	Wasted int64
+}
+
+// dataloc identifies a region of packed data in a pak.
+type dataloc struct {
+	reader *Reader
+	offset uint32
+}
+
+// FindDuplicates reads every file of the given paks, including files that
+// are shadowed by later paks, and groups files with identical decompressed
+// contents. Only groups of more than one file are returned, ordered by
+// wasted space, largest first.
+func FindDuplicates(readers []*Reader) ([]DuplicateGroup, error) {
+	groups := map[[sha256.Size]byte]*DuplicateGroup{}
+	var buf []byte
+	for _, reader := range readers {
+		files := []DuplicateFile{}
+		err := reader.ReadFileTable(func(path string, entry FileEntryData) bool {
+			if entry.Type&FileTypeMask != FileTypeDir {
+				files = append(files, DuplicateFile{reader, path, entry})
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			data, err := reader.ReadFileInto(file.Entry, buf)
+			if err != nil {
+				return nil, fmt.Errorf("reading %q: %w", file.Path, err)
+			}
+			buf = data
+			hash := sha256.Sum256(data)
+			group, ok := groups[hash]
+			if !ok {
+				group = &DuplicateGroup{Hash: hash, Size: int64(len(data))}
+				groups[hash] = group
+			}
+			group.Files = append(group.Files, file)
+		}
+	}
+
+	result := []DuplicateGroup{}
+	for _, group := range groups {
+		if len(group.Files) < 2 {
+			continue
+		}
+		group.Wasted = wasted(group.Files)
+		result = append(result, *group)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Wasted != result[j].Wasted {
+			return result[i].Wasted > result[j].Wasted
+		}
+		return result[i].Files[0].Path < result[j].Files[0].Path
+	})
+	return result, nil
+}
+
+// wasted returns the packed bytes used by all but the smallest distinct copy
+// of the data of files.
+func wasted(files []DuplicateFile) int64 {
+	seen := map[dataloc]bool{}
+	total, smallest := int64(0), int64(-1)
+	for _, file := range files {
+		loc := dataloc{file.Reader, file.Entry.Offset}
+		if seen[loc] {
+			continue
+		}
+		seen[loc] = true
+		size := int64(file.Entry.PackedFileSize)
+		total += size
+		if smallest == -1 || size < smallest {
+			smallest = size
+		}
+	}
+	return total - smallest
+}
+
+// Duplicates groups the files of every pak in the filesystem, including
+// shadowed files, by their decompressed contents. See FindDuplicates.
+func (fs *FS) Duplicates() ([]DuplicateGroup, error) {
+	return FindDuplicates(fs.current().readers)
+}
+
+// WritePak writes the files and directory entries of the filesystem to w as
+// a single pak file. Entries are written in the order of the file tables
+// they come from, skipping entries shadowed by later paks, so a filesystem
+// of a single pak is written with its original table. File data is copied
+// as stored, without being recompressed. The file table is encoded with k,
+// which need not be the key of any of the paks, as the paks of a filesystem
+// may each use their own key. Set Dedup in opts to store files with
+// identical contents only once.
+func (fs *FS) WritePak(k pyxtea.Key, w io.Writer, opts *WriterOptions) (WriterStats, error) {
+	t := fs.current()
+	pw := NewWriter(k, w, opts)
+	written := map[string]bool{}
+	for _, reader := range t.readers {
+		type tableentry struct {
+			path  string
+			entry FileEntryData
+		}
+		entries := []tableentry{}
+		err := reader.ReadFileTable(func(path string, entry FileEntryData) bool {
+			entries = append(entries, tableentry{path, entry})
+			return true
+		})
+		if err != nil {
+			return pw.Stats(), err
+		}
+
+		for _, e := range entries {
+			entry := e.entry
+			entry.Type &= FileTypeMask
+			if e.entry.Type&FileTypeMask == FileTypeDir {
+				dir, ok := t.dir(cleanpath(e.path))
+				if !ok || dir.reader != reader || *dir.entry != e.entry || written[dir.path] {
+					continue
+				}
+				written[dir.path] = true
+				if err := pw.WriteDir(e.path, entry); err != nil {
+					return pw.Stats(), err
+				}
+				continue
+			}
+
+			file, ok := t.filebyname(basename(e.path))
+			if !ok || file.reader != reader || file.entry != e.entry || written[file.path] {
+				continue
+			}
+			written[file.path] = true
+			packed, err := reader.ReadPacked(e.entry)
+			if err != nil {
+				return pw.Stats(), fmt.Errorf("reading %q: %w", file.path, err)
+			}
+			if err := pw.WriteRaw(file.path, entry, packed); err != nil {
+				return pw.Stats(), err
+			}
+		}
+	}
+	if err := pw.Close(); err != nil {
+		return pw.Stats(), err
+	}
+	return pw.Stats(), nil
+}
@@ -0,0 +1,110 @@
+package pak_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pangbox/pangfiles/crypto/pyxtea"
+	"github.com/pangbox/pangfiles/pak"
+	"github.com/pangbox/pangfiles/pak/paktest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDuplicates(t *testing.T) {
+	content := bytes.Repeat([]byte("duplicated "), 50)
+	fs := pak.NewFS(testKey)
+	require.NoError(t, fs.AddPak(mustReader(t, paktest.Pak{Key: testKey, Files: []paktest.File{
+		{Path: "a/tex.dds", Data: content, EntryType: pak.EntryTypeXTEA},
+		{Path: "b/copy.dds", Data: content, FileType: pak.FileTypeLz, EntryType: pak.EntryTypeXTEA},
+		{Path: "unique.txt", Data: []byte("unique"), EntryType: pak.EntryTypeXTEA},
+	}})))
+	// A later pak shadows a.dds with the same contents.
+	require.NoError(t, fs.AddPak(mustReader(t, paktest.Pak{Key: testKey, Files: []paktest.File{
+		{Path: "a/tex.dds", Data: content, FileType: pak.FileTypeLz2, EntryType: pak.EntryTypeXTEA},
+	}})))
+
+	groups, err := fs.Duplicates()
+	require.NoError(t, err)
+	require.Len(t, groups, 1)
+	group := groups[0]
+	assert.Equal(t, int64(len(content)), group.Size)
+	paths := []string{}
+	smallest, total := int64(-1), int64(0)
+	for _, file := range group.Files {
+		paths = append(paths, file.Path)
+		size := int64(file.Entry.PackedFileSize)
+		total += size
+		if smallest == -1 || size < smallest {
+			smallest = size
+		}
+	}
+	assert.Equal(t, []string{"a/tex.dds", "b/copy.dds", "a/tex.dds"}, paths)
+	assert.Equal(t, total-smallest, group.Wasted)
+}
+
+func TestWritePakDedup(t *testing.T) {
+	content := bytes.Repeat([]byte("duplicated "), 50)
+	fs := pak.NewFS(testKey)
+	require.NoError(t, fs.AddPak(mustReader(t, paktest.Pak{Key: testKey, Files: []paktest.File{
+		{Path: "a/one.dds", Data: content, FileType: pak.FileTypeLz, EntryType: pak.EntryTypeXTEA},
+		{Path: "b/two.dds", Data: content, EntryType: pak.EntryTypeXOR},
+		{Path: "c/three.txt", Data: []byte("three"), EntryType: pak.EntryTypeXTEA},
+	}})))
+
+	plain, dedup := bytes.Buffer{}, bytes.Buffer{}
+	_, err := fs.WritePak(testKey, &plain, nil)
+	require.NoError(t, err)
+	stats, err := fs.WritePak(testKey, &dedup, &pak.WriterOptions{Dedup: true})
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.Deduplicated)
+	assert.Less(t, dedup.Len(), plain.Len())
+
+	for _, image := range [][]byte{plain.Bytes(), dedup.Bytes()} {
+		out := pak.NewFS(testKey)
+		require.NoError(t, out.AddPakFromBytes(image))
+		for _, name := range []string{"one.dds", "two.dds"} {
+			data, err := out.ReadFile(name)
+			require.NoError(t, err)
+			assert.Equal(t, content, data)
+		}
+	}
+
+	groups, err := pak.FindDuplicates([]*pak.Reader{mustReaderBytes(t, dedup.Bytes())})
+	require.NoError(t, err)
+	require.Len(t, groups, 1)
+	assert.Equal(t, int64(0), groups[0].Wasted)
+}
+
+func TestWritePakMixedKeys(t *testing.T) {
+	paks := map[string]pyxtea.Key{"us": testKey, "kr": pyxtea.KeyKR}
+
+	// With per-pak keys, the filesystem itself has no key.
+	fs := pak.NewFS(pyxtea.Key{})
+	for name, key := range paks {
+		image := paktest.Pak{Key: key, Files: []paktest.File{
+			{Path: "data/" + name + ".txt", Data: []byte(name), EntryType: pak.EntryTypeXTEA},
+		}}
+		r, err := pak.NewReaderFromBytes(key, image.Bytes())
+		require.NoError(t, err)
+		require.NoError(t, fs.AddPak(r))
+	}
+
+	out := bytes.Buffer{}
+	_, err := fs.WritePak(pyxtea.KeyJP, &out, nil)
+	require.NoError(t, err)
+	written := pak.NewFS(pyxtea.KeyJP)
+	require.NoError(t, written.AddPakFromBytes(out.Bytes()))
+	for name := range paks {
+		data, err := written.ReadFile(name + ".txt")
+		require.NoError(t, err)
+		assert.Equal(t, name, string(data))
+	}
+}
+
+func mustReaderBytes(t *testing.T, data []byte) *pak.Reader {
+	t.Helper()
+	r, err := pak.NewReaderFromBytes(testKey, data)
+	require.NoError(t, err)
+	return r
+}
@@ -0,0 +1,319 @@
+package pak
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pangbox/pangfiles/crypto/pyxtea"
+)
+
+// Default options for region detection.
+const (
+	DefaultDetectSamples   = 32
+	DefaultDetectThreshold = 0.9
+)
+
+// DetectOptions configures ScoreKeys.
+type DetectOptions struct {
+	// Samples is the number of XTEA-ciphered entries to test keys against.
+	// Pak files are only opened until enough entries are found. Defaults
+	// to DefaultDetectSamples.
+	Samples int
+
+	// Threshold is the fraction of samples that must decode plausibly for
+	// a key to be accepted. Defaults to DefaultDetectThreshold.
+	Threshold float64
+}
+
+// ErrRegionUndetermined is returned by DetectRegion when the pak files have
+// no XTEA-ciphered entries to test keys against. The key does not affect how
+// such pak files are read.
+var ErrRegionUndetermined = errors.New("region can not be determined")
+
+// KeyScore is the result of testing a key against sampled entries.
+type KeyScore struct {
+	// Key is the key tested.
+	Key pyxtea.Key
+	// Score is the fraction of tested samples that decoded plausibly.
+	// Every sample is tested for accepted keys, so their scores may be
+	// compared.
+	Score float64
+	// Tested is the number of samples tested. Testing stops early once
+	// a key is certain to be rejected.
+	Tested int
+	// Plausible is the number of tested samples that decoded plausibly.
+	Plausible int
+	// Accepted is true if the key passed the threshold.
+	Accepted bool
+	// Undetermined is true if there were no samples to test the key
+	// against. Such keys are neither accepted nor rejected.
+	Undetermined bool
+	// Reason explains why a key was rejected, using the first sample that
+	// failed to decode plausibly, or why it is undetermined.
+	Reason string
+}
+
+// detectsample is an XTEA-ciphered file entry, as stored on-disk.
+type detectsample struct {
+	header  []byte
+	layout  EntryLayout
+	path    []byte
+	paksize int64
+}
+
+// plausible deciphers the sample with key k, returning an error describing
+// why the result is implausible, or nil.
+func (s detectsample) plausible(k pyxtea.Key) error {
+	hdr := append([]byte{}, s.header...)
+	if err := s.layout.decipher(k, hdr); err != nil {
+		return err
+	}
+	entry := s.layout.decode(hdr)
+	path := append([]byte{}, s.path...)
+	if err := pyxtea.Decipher(k, path); err != nil {
+		return err
+	}
+	path = trimPadding(path)
+
+	if len(path) == 0 {
+		return errors.New("empty path")
+	}
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case c >= 0x20 && c < 0x7F:
+		case c >= 0x81 && c <= 0xFE && i+1 < len(path) && path[i+1] >= 0x41 && path[i+1] <= 0xFE:
+			// EUC-KR or CP949 double-byte character.
+			i++
+		default:
+			return fmt.Errorf("unprintable byte 0x%02x in path %q", c, path)
+		}
+	}
+
+	if entry.Type&FileTypeMask == FileTypeDir {
+		return nil
+	}
+	name := string(path)
+	if i := strings.LastIndexAny(name, `/\`); i != -1 {
+		name = name[i+1:]
+	}
+	ext := ""
+	if i := strings.LastIndexByte(name, '.'); i != -1 {
+		ext = name[i+1:]
+	}
+	if len(ext) == 0 || len(ext) > 5 || strings.IndexFunc(ext, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+	}) != -1 {
+		return fmt.Errorf("implausible file extension in path %q", path)
+	}
+
+	if int64(entry.Offset)+int64(entry.PackedFileSize) > s.paksize {
+		return fmt.Errorf("data of %q out of bounds at offset 0x%x", path, entry.Offset)
+	}
+	return nil
+}
+
+// sampleEntries collects up to n XTEA-ciphered entries from the pak files
+// matching patterns, opening only as many files as needed.
+func sampleEntries(patterns []string, n int) ([]detectsample, error) {
+	samples := []detectsample{}
+	for _, pattern := range patterns {
+		paths := []string{pattern}
+		if !isURL(pattern) {
+			var err error
+			paths, err = filepath.Glob(pattern)
+			if err != nil {
+				return nil, err
+			}
+			sort.Strings(paths)
+		}
+		for _, path := range paths {
+			if err := sampleFile(path, n, &samples); err != nil {
+				return nil, err
+			}
+			if len(samples) >= n {
+				return samples, nil
+			}
+		}
+	}
+	return samples, nil
+}
+
+func sampleFile(path string, n int, samples *[]detectsample) error {
+	f, err := OpenFile(path)
+	if err != nil {
+		return fmt.Errorf("loading file %q: %v", path, err)
+	}
+	if closer, ok := f.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	// The key only affects the deciphered fields, which are not needed to
+	// walk the file table.
+	r, err := NewReader(pyxtea.Key{}, f)
+	if err != nil {
+		return fmt.Errorf("loading file %q: %w", path, err)
+	}
+	err = r.ReadRawFileTable(func(raw RawEntry) bool {
+		if raw.Entry.Type&EntryTypeMask == EntryTypeXTEA {
+			*samples = append(*samples, detectsample{raw.Header, r.Format().Entry, raw.RawPath, r.Size()})
+		}
+		return len(*samples) < n
+	})
+	if err != nil && err != ErrStopIteration {
+		return fmt.Errorf("reading file table of %q: %w", path, err)
+	}
+	return nil
+}
+
+// ScoreKeys tests each key against XTEA-ciphered entries sampled from the
+// pak files matching patterns. Deciphered paths must consist of printable
+// ASCII or EUC-KR characters and have a plausible file extension, and file
+// data must lie within the pak file. If opts is nil, default options are
+// used.
+//
+// If no XTEA-ciphered entries are found, every key is undetermined, with no
+// samples tested.
+func ScoreKeys(patterns []string, keys []pyxtea.Key, opts *DetectOptions) ([]KeyScore, error) {
+	samplesWanted, threshold := DefaultDetectSamples, DefaultDetectThreshold
+	if opts != nil {
+		if opts.Samples > 0 {
+			samplesWanted = opts.Samples
+		}
+		if opts.Threshold > 0 {
+			threshold = opts.Threshold
+		}
+	}
+
+	samples, err := sampleEntries(patterns, samplesWanted)
+	if err != nil {
+		return nil, err
+	}
+
+	needed := int(math.Ceil(threshold * float64(len(samples))))
+	scores := make([]KeyScore, len(keys))
+	for i, key := range keys {
+		if len(samples) == 0 {
+			scores[i] = KeyScore{Key: key, Undetermined: true, Reason: "no XTEA-ciphered entries to test"}
+			continue
+		}
+		score := KeyScore{Key: key}
+		failures := 0
+		for _, sample := range samples {
+			score.Tested++
+			if err := sample.plausible(key); err != nil {
+				failures++
+				if score.Reason == "" {
+					score.Reason = err.Error()
+				}
+			} else {
+				score.Plausible++
+			}
+			if len(samples)-failures < needed {
+				break
+			}
+		}
+		score.Score = float64(score.Plausible) / float64(score.Tested)
+		score.Accepted = score.Plausible >= needed
+		if score.Accepted {
+			score.Reason = ""
+		} else {
+			score.Reason = fmt.Sprintf("%d of %d sampled entries implausible, first: %s", failures, score.Tested, score.Reason)
+		}
+		scores[i] = score
+	}
+	return scores, nil
+}
+
+// RegionName returns the region code of a known key, such as "us", or a
+// description of an unknown key.
+func RegionName(k pyxtea.Key) string {
+	switch k {
+	case pyxtea.KeyUS:
+		return "us"
+	case pyxtea.KeyJP:
+		return "jp"
+	case pyxtea.KeyTH:
+		return "th"
+	case pyxtea.KeyEU:
+		return "eu"
+	case pyxtea.KeyID:
+		return "id"
+	case pyxtea.KeyKR:
+		return "kr"
+	}
+	return fmt.Sprintf("key %08x", k[0])
+}
+
+// DetectRegions tests each of the keys from the keys slice in order using
+// ScoreKeys with default options. Keys which are accepted are returned.
+func DetectRegions(patterns []string, keys []pyxtea.Key) ([]pyxtea.Key, error) {
+	scores, err := ScoreKeys(patterns, keys, nil)
+	if err != nil {
+		return []pyxtea.Key{}, err
+	}
+	valid := []pyxtea.Key{}
+	for _, score := range scores {
+		if score.Accepted {
+			valid = append(valid, score.Key)
+		}
+	}
+	return valid, nil
+}
+
+// DetectRegion is like DetectRegions, but only returns one key, and fails if
+// no keys pass validation. When more than one key passes, the key with the
+// highest score is selected. If the pak files contain no XTEA-ciphered
+// entries, an error wrapping ErrRegionUndetermined is returned.
+func DetectRegion(patterns []string, keys []pyxtea.Key) (pyxtea.Key, error) {
+	if len(keys) < 1 {
+		return pyxtea.Key{}, errors.New("no valid regions detected")
+	}
+	scores, err := ScoreKeys(patterns, keys, nil)
+	if err != nil {
+		return pyxtea.Key{}, err
+	}
+
+	var best *KeyScore
+	accepted, ambiguous := 0, false
+	reasons := []string{}
+	for i := range scores {
+		score := &scores[i]
+		if score.Undetermined {
+			return pyxtea.Key{}, fmt.Errorf("%w: %s", ErrRegionUndetermined, score.Reason)
+		}
+		if !score.Accepted {
+			reasons = append(reasons, fmt.Sprintf("%s: %s", RegionName(score.Key), score.Reason))
+			continue
+		}
+		accepted++
+		if best == nil || score.Score > best.Score {
+			best, ambiguous = score, false
+		} else if score.Score == best.Score {
+			ambiguous = true
+		}
+	}
+
+	switch {
+	case accepted == 0:
+		return pyxtea.Key{}, fmt.Errorf("no valid regions detected (%s)", strings.Join(reasons, "; "))
+	case ambiguous:
+		return pyxtea.Key{}, fmt.Errorf("ambiguous region (%d regions validated)", accepted)
+	}
+	return best.Key, nil
+}
+
+// MustDetectRegion is like DetectRegion but crashes on error.
+func MustDetectRegion(patterns []string, keys []pyxtea.Key) pyxtea.Key {
+	region, err := DetectRegion(patterns, keys)
+	if err != nil {
+		log.Fatalln("Error auto-detecting pak region:", err)
+	}
+	return region
+}
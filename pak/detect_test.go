@@ -0,0 +1,104 @@
+package pak_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/pangbox/pangfiles/crypto/pyxtea"
+	"github.com/pangbox/pangfiles/pak"
+	"github.com/pangbox/pangfiles/pak/paktest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var detectKeys = []pyxtea.Key{pyxtea.KeyUS, pyxtea.KeyJP, pyxtea.KeyTH, pyxtea.KeyEU, pyxtea.KeyID, pyxtea.KeyKR}
+
+func writeDetectPak(t *testing.T, path string, key pyxtea.Key, entryType byte, n int) {
+	t.Helper()
+	files := []paktest.File{}
+	for i := 0; i < n; i++ {
+		files = append(files, paktest.File{Path: fmt.Sprintf("data/file%03d.dds", i), Data: []byte("data"), EntryType: entryType})
+	}
+	require.NoError(t, ioutil.WriteFile(path, paktest.Pak{Key: key, Files: files}.Bytes(), 0o644))
+}
+
+func TestScoreKeys(t *testing.T) {
+	dir := t.TempDir()
+	writeDetectPak(t, filepath.Join(dir, "projectg100.pak"), pyxtea.KeyJP, pak.EntryTypeXTEA, 40)
+
+	scores, err := pak.ScoreKeys([]string{filepath.Join(dir, "*.pak")}, detectKeys, nil)
+	require.NoError(t, err)
+	require.Len(t, scores, len(detectKeys))
+	for _, score := range scores {
+		if score.Key == pyxtea.KeyJP {
+			assert.True(t, score.Accepted)
+			assert.Equal(t, 1.0, score.Score)
+			assert.Equal(t, pak.DefaultDetectSamples, score.Tested)
+			assert.Empty(t, score.Reason)
+		} else {
+			assert.False(t, score.Accepted)
+			assert.Less(t, score.Score, 0.5)
+			assert.NotEmpty(t, score.Reason)
+			// Rejection is certain long before every sample is tested.
+			assert.Less(t, score.Tested, pak.DefaultDetectSamples)
+		}
+	}
+
+	key, err := pak.DetectRegion([]string{filepath.Join(dir, "*.pak")}, detectKeys)
+	require.NoError(t, err)
+	assert.Equal(t, pyxtea.KeyJP, key)
+}
+
+func TestScoreKeysStopsEarly(t *testing.T) {
+	dir := t.TempDir()
+	writeDetectPak(t, filepath.Join(dir, "projectg100.pak"), pyxtea.KeyUS, pak.EntryTypeXTEA, 8)
+	// Enough samples are found before this file is opened.
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "projectg101.pak"), []byte("not a pak"), 0o644))
+
+	scores, err := pak.ScoreKeys([]string{filepath.Join(dir, "*.pak")}, detectKeys, &pak.DetectOptions{Samples: 8})
+	require.NoError(t, err)
+	assert.True(t, scores[0].Accepted)
+
+	_, err = pak.ScoreKeys([]string{filepath.Join(dir, "*.pak")}, detectKeys, &pak.DetectOptions{Samples: 9})
+	assert.Error(t, err)
+}
+
+func TestScoreKeysNoXTEA(t *testing.T) {
+	dir := t.TempDir()
+	writeDetectPak(t, filepath.Join(dir, "projectg100.pak"), pyxtea.KeyUS, pak.EntryTypeXOR, 8)
+
+	scores, err := pak.ScoreKeys([]string{filepath.Join(dir, "*.pak")}, detectKeys, nil)
+	require.NoError(t, err)
+	for _, score := range scores {
+		assert.False(t, score.Accepted)
+		assert.True(t, score.Undetermined)
+		assert.NotEmpty(t, score.Reason)
+		assert.Equal(t, 0, score.Tested)
+	}
+
+	_, err = pak.DetectRegion([]string{filepath.Join(dir, "*.pak")}, detectKeys)
+	assert.ErrorIs(t, err, pak.ErrRegionUndetermined)
+
+	// The key does not matter for such pak files, so they can still be
+	// loaded with a detected key.
+	fs := pak.NewFS(pyxtea.Key{})
+	fs.SetKeyRules([]pak.KeyRule{{Pattern: "*", Detect: true}}, detectKeys)
+	key, err := fs.KeyFor(filepath.Join(dir, "projectg100.pak"))
+	assert.ErrorIs(t, err, pak.ErrRegionUndetermined)
+	assert.Equal(t, detectKeys[0], key)
+	require.NoError(t, fs.AddPakFromFile(filepath.Join(dir, "projectg100.pak")))
+	assert.Equal(t, 8, fs.NumFiles())
+}
+
+func TestDetectRegionExplainsFailure(t *testing.T) {
+	dir := t.TempDir()
+	writeDetectPak(t, filepath.Join(dir, "projectg100.pak"), pyxtea.KeyKR, pak.EntryTypeXTEA, 8)
+
+	_, err := pak.DetectRegion([]string{filepath.Join(dir, "*.pak")}, detectKeys[:2])
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "us: ")
+	assert.Contains(t, err.Error(), "jp: ")
+	assert.Contains(t, err.Error(), "implausible")
+}
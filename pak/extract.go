@@ -0,0 +1,476 @@
+package pak
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	// ErrUnsafePath is returned when extraction stops at an unsafe path.
+	ErrUnsafePath = errors.New("unsafe path")
+	// ErrNameCollision is returned when flat extraction stops at files with
+	// the same name.
+	ErrNameCollision = errors.New("name collision")
+)
+
+// UnsafePathError describes a path that is unsafe to extract to, such as one
+// leaving the destination directory.
+type UnsafePathError struct {
+	// Path is the path of the entry in the filesystem.
+	Path string
+	// Reason describes why the path is unsafe.
+	Reason string
+}
+
+// Error implements error.
+func (e *UnsafePathError) Error() string {
+	return fmt.Sprintf("unsafe path %q: %s", e.Path, e.Reason)
+}
+
+// Unwrap returns ErrUnsafePath, so that errors.Is can be used to test for
+// unsafe paths.
+func (e *UnsafePathError) Unwrap() error {
+	return ErrUnsafePath
+}
+
+// ExtractPolicy selects what extraction does with unsafe paths. Paths are
+// unsafe if they are absolute, start with a drive letter, refer to parent
+// directories, or contain NUL bytes, colons or names reserved by Windows,
+// like CON or LPT1.
+type ExtractPolicy int
+
+// Enumeration of extract policies.
+const (
+	// RejectUnsafePaths stops extraction with an *UnsafePathError at the
+	// first unsafe path.
+	RejectUnsafePaths ExtractPolicy = iota
+	// RewriteUnsafePaths extracts files with unsafe paths to safe paths
+	// within the destination directory.
+	RewriteUnsafePaths
+	// SkipUnsafePaths skips files with unsafe paths.
+	SkipUnsafePaths
+)
+
+// FlatCollision selects what flat extraction does with files that have the
+// same name.
+type FlatCollision int
+
+// Enumeration of flat collision strategies. Where files are renamed or kept,
+// files are considered in pak order: files from earlier paks come first,
+// and files from the same pak are in path order.
+const (
+	// CollisionError stops extraction with an error wrapping
+	// ErrNameCollision. Shadowed files, which are only extracted when
+	// ExtractOptions.Shadowed is set, never cause an error; they are
+	// suffixed as with CollisionCounter.
+	CollisionError FlatCollision = iota
+	// CollisionCounter keeps the name of the file the filesystem serves
+	// under it, or of the first file in path order if there are several,
+	// and suffixes the others with a counter, e.g. "item~2.dds".
+	CollisionCounter
+	// CollisionDirHash keeps names as with CollisionCounter, and suffixes
+	// the others with a hash of their directory, e.g. "item~1a2b3c4d.dds".
+	// Unlike counters, the suffixes do not change when other files are
+	// added or removed.
+	CollisionDirHash
+	// CollisionKeepFirst extracts only the first file.
+	CollisionKeepFirst
+	// CollisionKeepLast extracts only the last file, which for files
+	// overridden by a later pak is the override.
+	CollisionKeepLast
+)
+
+// ExtractOptions configures ExtractWithOptions and ExtractFlatWithOptions.
+type ExtractOptions struct {
+	// Policy is applied to unsafe paths. Defaults to RejectUnsafePaths.
+	Policy ExtractPolicy
+
+	// Collisions is applied to files with the same name when extracting
+	// flat. Defaults to CollisionError.
+	Collisions FlatCollision
+
+	// Shadowed also extracts files hidden by a file with the same base
+	// name in a later pak, when extracting flat. Otherwise, only the files
+	// the filesystem serves are extracted.
+	Shadowed bool
+
+	// MappingFile, if set, is the path of a file to write the mapping of
+	// flat names to original paths to, when extracting flat. The mapping
+	// is a JSON array of FlatName, in the form of ExtractReport.Names.
+	MappingFile string
+}
+
+// UnsafePath records an entry with an unsafe path that was rewritten or
+// skipped.
+type UnsafePath struct {
+	// Path is the path of the entry in the filesystem.
+	Path string
+	// Target is the path it was extracted to, slash-separated and relative
+	// to the destination directory. It is empty if the entry was skipped.
+	Target string
+	// Reason describes why the path is unsafe.
+	Reason string
+}
+
+// ExtractReport describes an extraction.
+type ExtractReport struct {
+	// Files is the number of files extracted.
+	Files int
+	// Unsafe lists the entries with unsafe paths, in the order they were
+	// extracted.
+	Unsafe []UnsafePath
+
+	// Names maps the names of files extracted flat to their paths. It is
+	// only set when extracting flat.
+	Names []FlatName
+	// Collisions lists the files that were renamed or not extracted when
+	// extracting flat, because their names collided with another file.
+	// Name is empty for files that were not extracted.
+	Collisions []FlatName
+}
+
+// reservedNames are the device names reserved by Windows, which refer to
+// devices in any directory and with any extension.
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// isReserved returns true if name refers to a Windows device. Windows
+// ignores extensions and trailing dots and spaces in device names.
+func isReserved(name string) bool {
+	name = strings.TrimRight(name, ". ")
+	if i := strings.IndexByte(name, '.'); i != -1 {
+		name = name[:i]
+	}
+	return reservedNames[strings.ToUpper(strings.TrimRight(name, " "))]
+}
+
+// safepath returns a safe relative, slash-separated path to extract the file
+// at p to, along with the reasons p is unsafe, if it is. Both slashes and
+// backslashes are treated as separators. An empty path is never returned.
+func safepath(p string) (string, string) {
+	reasons := []string{}
+	if strings.HasPrefix(p, "/") || strings.HasPrefix(p, `\`) {
+		reasons = append(reasons, "absolute path")
+	}
+	parts := strings.FieldsFunc(p, func(r rune) bool { return r == '/' || r == '\\' })
+	safe := make([]string, 0, len(parts))
+	for i, part := range parts {
+		if i == 0 && len(part) >= 2 && part[1] == ':' && ('A' <= part[0] && part[0] <= 'Z' || 'a' <= part[0] && part[0] <= 'z') {
+			reasons = append(reasons, "drive letter")
+			part = part[2:]
+		}
+		// Windows ignores trailing dots and spaces, so names made of them
+		// are treated like "..".
+		if part == "." || part == "" {
+			continue
+		} else if strings.Trim(part, ". ") == "" {
+			reasons = append(reasons, "parent directory reference")
+			continue
+		}
+		if strings.ContainsRune(part, 0) {
+			reasons = append(reasons, "NUL byte")
+			part = strings.ReplaceAll(part, "\x00", "_")
+		}
+		if strings.ContainsRune(part, ':') {
+			reasons = append(reasons, "colon")
+			part = strings.ReplaceAll(part, ":", "_")
+		}
+		if isReserved(part) {
+			reasons = append(reasons, fmt.Sprintf("reserved name %q", part))
+			part = "_" + part
+		}
+		safe = append(safe, part)
+	}
+	if len(safe) == 0 {
+		reasons = append(reasons, "empty path")
+		safe = append(safe, "_")
+	}
+	return strings.Join(safe, "/"), strings.Join(reasons, ", ")
+}
+
+// target applies the policy of opts to name, the path to extract the entry at
+// p to, returning the target to extract it to, or false if it should be
+// skipped.
+func (opts *ExtractOptions) target(p, name string, report *ExtractReport) (string, bool, error) {
+	target, reason := safepath(name)
+	if reason == "" {
+		return target, true, nil
+	}
+	switch opts.Policy {
+	case RewriteUnsafePaths:
+		report.Unsafe = append(report.Unsafe, UnsafePath{Path: p, Target: target, Reason: reason})
+		return target, true, nil
+	case SkipUnsafePaths:
+		report.Unsafe = append(report.Unsafe, UnsafePath{Path: p, Reason: reason})
+		return "", false, nil
+	default:
+		return "", false, &UnsafePathError{Path: p, Reason: reason}
+	}
+}
+
+// Extract extracts the filesystem onto the host disk, stopping at the first
+// unsafe path. See ExtractWithOptions.
+func (fs *FS) Extract(dest string) error {
+	_, err := fs.ExtractWithOptions(dest, nil)
+	return err
+}
+
+// ExtractWithOptions extracts the filesystem onto the host disk, applying the
+// policy of opts to unsafe paths. If opts is nil, default options are used.
+func (fs *FS) ExtractWithOptions(dest string, opts *ExtractOptions) (*ExtractReport, error) {
+	if opts == nil {
+		opts = &ExtractOptions{}
+	}
+	report := &ExtractReport{}
+	t := fs.current()
+	var buf []byte
+	for i, dir := range t.dirs.paths {
+		if dir == "" {
+			continue
+		}
+		// Directories are created for files as needed, so only explicit
+		// directory entries are reported. Unsafe implied directories are
+		// handled along with the files within them.
+		var target string
+		if t.dirs.readers[i] == noreader {
+			var reason string
+			if target, reason = safepath(dir); reason != "" && opts.Policy != RewriteUnsafePaths {
+				continue
+			}
+		} else {
+			var ok bool
+			var err error
+			if target, ok, err = opts.target(dir, dir, report); err != nil {
+				return report, err
+			} else if !ok {
+				continue
+			}
+		}
+		fulldir := filepath.Join(dest, filepath.FromSlash(target))
+		if err := os.MkdirAll(fulldir, 0755); err != nil {
+			return report, fmt.Errorf("making output directory %q: %v", fulldir, err)
+		}
+	}
+	for i := 0; i < t.files.len(); i++ {
+		file := t.fileat(i)
+		target, ok, err := opts.target(file.path, file.path, report)
+		if err != nil {
+			return report, err
+		} else if !ok {
+			continue
+		}
+		data, err := file.reader.ReadFileInto(file.entry, buf)
+		if err != nil {
+			return report, err
+		}
+		buf = data
+		fullpath := filepath.Join(dest, filepath.FromSlash(target))
+		if err := os.MkdirAll(filepath.Dir(fullpath), 0755); err != nil {
+			return report, fmt.Errorf("making output directory %q: %v", filepath.Dir(fullpath), err)
+		}
+		if err := ioutil.WriteFile(fullpath, data, 0644); err != nil {
+			return report, err
+		}
+		report.Files++
+	}
+	return report, nil
+}
+
+// ExtractFlat extracts the filesystem onto the host disk, into one flat
+// folder, stopping at the first unsafe name. See ExtractFlatWithOptions.
+func (fs *FS) ExtractFlat(dest string) error {
+	_, err := fs.ExtractFlatWithOptions(dest, nil)
+	return err
+}
+
+// suffixed returns name with suffix added before its extension.
+func suffixed(name, suffix string) string {
+	ext := path.Ext(name)
+	return name[:len(name)-len(ext)] + "~" + suffix + ext
+}
+
+// unique returns candidate, or if it is taken, candidate suffixed with the
+// lowest counter that is not.
+func unique(candidate string, taken map[string]bool) string {
+	for n := 2; taken[strings.ToLower(candidate)]; n++ {
+		candidate = suffixed(candidate, fmt.Sprint(n))
+	}
+	return candidate
+}
+
+// flattarget is a file to be extracted by ExtractFlatWithOptions.
+type flattarget struct {
+	file    pendingentry
+	name    string
+	visible bool
+	renamed bool
+	skipped bool
+}
+
+// resolveflat resolves a collision between the targets in group, which are in
+// path order, by renaming or skipping them according to opts.
+func resolveflat(opts *ExtractOptions, targets []flattarget, group []int, taken map[string]bool) error {
+	// Files are kept and suffixed in pak order.
+	ordered := append([]int(nil), group...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return targets[ordered[i]].file.reader < targets[ordered[j]].file.reader
+	})
+	switch opts.Collisions {
+	case CollisionKeepFirst, CollisionKeepLast:
+		keep := ordered[0]
+		if opts.Collisions == CollisionKeepLast {
+			keep = ordered[len(ordered)-1]
+		}
+		for _, i := range group {
+			targets[i].skipped = i != keep
+		}
+		return nil
+	}
+
+	// The file the filesystem serves keeps the name; if there are several,
+	// the first in path order does.
+	visible := []int{}
+	for _, i := range group {
+		if targets[i].visible {
+			visible = append(visible, i)
+		}
+	}
+	keep := ordered[0]
+	if len(visible) > 0 {
+		keep = visible[0]
+	}
+	if opts.Collisions != CollisionCounter && opts.Collisions != CollisionDirHash && len(visible) > 1 {
+		first, second := targets[visible[0]], targets[visible[1]]
+		return fmt.Errorf("%w: %q and %q both extract to %q", ErrNameCollision, first.file.path, second.file.path, second.name)
+	}
+	n := 1
+	for _, i := range ordered {
+		if i == keep {
+			continue
+		}
+		n++
+		target := &targets[i]
+		name := target.name
+		if opts.Collisions == CollisionDirHash {
+			p := target.file.path
+			sum := sha256.Sum256([]byte(p[:strings.LastIndexAny(p, `/\`)+1]))
+			name = suffixed(name, hex.EncodeToString(sum[:4]))
+		} else {
+			name = suffixed(name, fmt.Sprint(n))
+		}
+		target.name = unique(name, taken)
+		target.renamed = true
+		taken[strings.ToLower(target.name)] = true
+	}
+	return nil
+}
+
+// ExtractFlatWithOptions extracts the filesystem onto the host disk, into one
+// flat folder, applying the policies of opts to unsafe and colliding names.
+// Each file is extracted under its base name, and names are compared
+// case-insensitively, as they would be on Windows. Only the files the
+// filesystem serves are extracted, unless opts.Shadowed is set. If opts is
+// nil, default options are used.
+func (fs *FS) ExtractFlatWithOptions(dest string, opts *ExtractOptions) (*ExtractReport, error) {
+	if opts == nil {
+		opts = &ExtractOptions{}
+	}
+	report := &ExtractReport{}
+	t := fs.current()
+
+	var files []pendingentry
+	if opts.Shadowed {
+		files = t.allfiles()
+	} else {
+		files = make([]pendingentry, 0, t.files.len())
+		for i, p := range t.files.paths {
+			files = append(files, pendingentry{p, t.files.entries[i], t.files.readers[i]})
+		}
+	}
+	targets := make([]flattarget, 0, len(files))
+	groups := map[string][]int{}
+	names := []string{}
+	for _, f := range files {
+		p := f.path
+		name := p[strings.LastIndexAny(p, `/\`)+1:]
+		target, ok, err := opts.target(p, name, report)
+		if err != nil {
+			return report, err
+		} else if !ok {
+			continue
+		}
+		lower := strings.ToLower(target)
+		if _, ok := groups[lower]; !ok {
+			names = append(names, lower)
+		}
+		groups[lower] = append(groups[lower], len(targets))
+		targets = append(targets, flattarget{file: f, name: target, visible: !opts.Shadowed || t.visible(f)})
+	}
+
+	// Resolve collisions, in path order. Every original name is taken up
+	// front, so that renamed files never displace another file.
+	taken := make(map[string]bool, len(groups))
+	for name := range groups {
+		taken[name] = true
+	}
+	for _, name := range names {
+		if group := groups[name]; len(group) > 1 {
+			if err := resolveflat(opts, targets, group, taken); err != nil {
+				return report, err
+			}
+		}
+	}
+	resolved := make([]flattarget, 0, len(targets))
+	for _, target := range targets {
+		if target.skipped {
+			report.Collisions = append(report.Collisions, FlatName{Path: target.file.path})
+			continue
+		}
+		if target.renamed {
+			report.Collisions = append(report.Collisions, FlatName{Name: target.name, Path: target.file.path})
+		}
+		resolved = append(resolved, target)
+	}
+
+	var buf []byte
+	for _, target := range resolved {
+		file := target.file
+		log.Printf("Extracting %q", file.path)
+		data, err := t.readers[file.reader].ReadFileInto(file.entry, buf)
+		if err != nil {
+			return report, err
+		}
+		buf = data
+		if err := ioutil.WriteFile(filepath.Join(dest, target.name), data, 0644); err != nil {
+			return report, err
+		}
+		report.Files++
+		report.Names = append(report.Names, FlatName{Name: target.name, Path: file.path})
+	}
+
+	if opts.MappingFile != "" {
+		data, err := json.MarshalIndent(report.Names, "", "\t")
+		if err != nil {
+			return report, err
+		}
+		if err := ioutil.WriteFile(opts.MappingFile, append(data, '\n'), 0644); err != nil {
+			return report, fmt.Errorf("writing mapping file: %w", err)
+		}
+	}
+	return report, nil
+}
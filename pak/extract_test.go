@@ -0,0 +1,239 @@
+package pak_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pangbox/pangfiles/pak"
+	"github.com/pangbox/pangfiles/pak/paktest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// unsafeFS returns a filesystem with one safe file and files with unsafe
+// paths.
+func unsafeFS(t *testing.T) *pak.FS {
+	t.Helper()
+	fs := pak.NewFS(testKey)
+	require.NoError(t, fs.AddPak(mustReader(t, paktest.Pak{Key: testKey, Files: []paktest.File{
+		{Path: "data/safe.txt", Data: []byte("safe"), EntryType: pak.EntryTypeBasic},
+		{Path: "../../escape.txt", Data: []byte("up"), EntryType: pak.EntryTypeBasic},
+		{Path: "/abs/root.txt", Data: []byte("abs"), EntryType: pak.EntryTypeBasic},
+		{Path: `C:\windows\drive.txt`, Data: []byte("drive"), EntryType: pak.EntryTypeBasic},
+		{Path: "data/con.txt", Data: []byte("device"), EntryType: pak.EntryTypeBasic},
+		{Path: "data/nul\x00byte.txt", Data: []byte("nul"), EntryType: pak.EntryTypeBasic},
+	}})))
+	return fs
+}
+
+// listFiles returns the slash-separated paths of the files in dir.
+func listFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files := []string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		files = append(files, filepath.ToSlash(rel))
+		return err
+	})
+	require.NoError(t, err)
+	return files
+}
+
+func TestExtractRejectsUnsafePaths(t *testing.T) {
+	root := t.TempDir()
+	dest := filepath.Join(root, "a", "b")
+	err := unsafeFS(t).Extract(dest)
+	assert.ErrorIs(t, err, pak.ErrUnsafePath)
+	assert.Empty(t, listFiles(t, root))
+}
+
+func TestExtractRewritesUnsafePaths(t *testing.T) {
+	root := t.TempDir()
+	dest := filepath.Join(root, "a", "b")
+	report, err := unsafeFS(t).ExtractWithOptions(dest, &pak.ExtractOptions{Policy: pak.RewriteUnsafePaths})
+	require.NoError(t, err)
+	assert.Equal(t, 6, report.Files)
+
+	targets := map[string]string{}
+	for _, unsafe := range report.Unsafe {
+		assert.NotEmpty(t, unsafe.Reason)
+		targets[unsafe.Path] = unsafe.Target
+	}
+	assert.Equal(t, map[string]string{
+		"../../escape.txt":     "escape.txt",
+		"/abs/root.txt":        "abs/root.txt",
+		`C:\windows\drive.txt`: "windows/drive.txt",
+		"data/con.txt":         "data/_con.txt",
+		"data/nul\x00byte.txt": "data/nul_byte.txt",
+	}, targets)
+	assert.ElementsMatch(t, []string{
+		"a/b/abs/root.txt",
+		"a/b/data/_con.txt",
+		"a/b/data/nul_byte.txt",
+		"a/b/data/safe.txt",
+		"a/b/escape.txt",
+		"a/b/windows/drive.txt",
+	}, listFiles(t, root))
+
+	data, err := ioutil.ReadFile(filepath.Join(dest, "escape.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "up", string(data))
+}
+
+func TestExtractSkipsUnsafePaths(t *testing.T) {
+	root := t.TempDir()
+	dest := filepath.Join(root, "a", "b")
+	report, err := unsafeFS(t).ExtractWithOptions(dest, &pak.ExtractOptions{Policy: pak.SkipUnsafePaths})
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Files)
+	assert.Len(t, report.Unsafe, 5)
+	for _, unsafe := range report.Unsafe {
+		assert.Empty(t, unsafe.Target)
+	}
+	assert.Equal(t, []string{"a/b/data/safe.txt"}, listFiles(t, root))
+}
+
+func TestExtractFlatUnsafeNames(t *testing.T) {
+	fs := unsafeFS(t)
+	dest := t.TempDir()
+	assert.ErrorIs(t, fs.ExtractFlat(dest), pak.ErrUnsafePath)
+
+	report, err := fs.ExtractFlatWithOptions(dest, &pak.ExtractOptions{Policy: pak.RewriteUnsafePaths})
+	require.NoError(t, err)
+	assert.Equal(t, 6, report.Files)
+	assert.Equal(t, []pak.UnsafePath{
+		{Path: "data/con.txt", Target: "_con.txt", Reason: `reserved name "con.txt"`},
+		{Path: "data/nul\x00byte.txt", Target: "nul_byte.txt", Reason: "NUL byte"},
+	}, report.Unsafe)
+	assert.ElementsMatch(t, []string{"_con.txt", "drive.txt", "escape.txt", "nul_byte.txt", "root.txt", "safe.txt"}, listFiles(t, dest))
+}
+
+// collidingFS returns a filesystem with files whose names differ only in
+// case.
+func collidingFS(t *testing.T) *pak.FS {
+	t.Helper()
+	fs := pak.NewFS(testKey)
+	require.NoError(t, fs.AddPak(mustReader(t, paktest.Pak{Key: testKey, Files: []paktest.File{
+		{Path: "c/ITEM.txt", Data: []byte("c/ITEM.txt"), EntryType: pak.EntryTypeXTEA},
+		{Path: "a/Item.txt", Data: []byte("a/Item.txt"), EntryType: pak.EntryTypeXTEA},
+		{Path: "b/item.txt", Data: []byte("b/item.txt"), EntryType: pak.EntryTypeXTEA},
+		{Path: "b/other.txt", Data: []byte("b/other.txt"), EntryType: pak.EntryTypeXTEA},
+	}})))
+	return fs
+}
+
+func TestExtractFlatCollisions(t *testing.T) {
+	tests := []struct {
+		name       string
+		collisions pak.FlatCollision
+		names      []pak.FlatName
+	}{
+		{"Counter", pak.CollisionCounter, []pak.FlatName{
+			{Name: "Item.txt", Path: "a/Item.txt"},
+			{Name: "item~2.txt", Path: "b/item.txt"},
+			{Name: "other.txt", Path: "b/other.txt"},
+			{Name: "ITEM~3.txt", Path: "c/ITEM.txt"},
+		}},
+		{"DirHash", pak.CollisionDirHash, []pak.FlatName{
+			{Name: "Item.txt", Path: "a/Item.txt"},
+			{Name: "item~a9eed1a7.txt", Path: "b/item.txt"},
+			{Name: "other.txt", Path: "b/other.txt"},
+			{Name: "ITEM~46ca9a6f.txt", Path: "c/ITEM.txt"},
+		}},
+		{"KeepFirst", pak.CollisionKeepFirst, []pak.FlatName{
+			{Name: "Item.txt", Path: "a/Item.txt"},
+			{Name: "other.txt", Path: "b/other.txt"},
+		}},
+		{"KeepLast", pak.CollisionKeepLast, []pak.FlatName{
+			{Name: "other.txt", Path: "b/other.txt"},
+			{Name: "ITEM.txt", Path: "c/ITEM.txt"},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dest := t.TempDir()
+			mapping := filepath.Join(t.TempDir(), "map.json")
+			report, err := collidingFS(t).ExtractFlatWithOptions(dest, &pak.ExtractOptions{
+				Collisions:  test.collisions,
+				MappingFile: mapping,
+			})
+			require.NoError(t, err)
+			assert.Equal(t, test.names, report.Names)
+			assert.Len(t, report.Collisions, 2)
+
+			for _, name := range test.names {
+				data, err := ioutil.ReadFile(filepath.Join(dest, name.Name))
+				require.NoError(t, err)
+				assert.Equal(t, name.Path, string(data))
+			}
+
+			data, err := ioutil.ReadFile(mapping)
+			require.NoError(t, err)
+			written := []pak.FlatName{}
+			require.NoError(t, json.Unmarshal(data, &written))
+			assert.Equal(t, test.names, written)
+		})
+	}
+}
+
+func TestExtractFlatCollisionError(t *testing.T) {
+	_, err := collidingFS(t).ExtractFlatWithOptions(t.TempDir(), nil)
+	assert.ErrorIs(t, err, pak.ErrNameCollision)
+	assert.Contains(t, err.Error(), `"a/Item.txt" and "b/item.txt"`)
+}
+
+func TestExtractFlatDuplicateBaseNames(t *testing.T) {
+	// The filesystem merges files by base name, so only the item.txt from
+	// the last pak is served. The others are only extracted on request.
+	fs := pak.NewFS(testKey)
+	require.NoError(t, fs.AddPak(mustReader(t, paktest.Pak{Key: testKey, Files: []paktest.File{
+		{Path: "b/item.txt", Data: []byte("b/item.txt"), EntryType: pak.EntryTypeXTEA},
+		{Path: "a/item.txt", Data: []byte("a/item.txt"), EntryType: pak.EntryTypeXTEA},
+	}})))
+	require.NoError(t, fs.AddPak(mustReader(t, paktest.Pak{Key: testKey, Files: []paktest.File{
+		{Path: "c/item.txt", Data: []byte("c/item.txt"), EntryType: pak.EntryTypeXTEA},
+	}})))
+	require.Equal(t, 1, fs.NumFiles())
+
+	dest := t.TempDir()
+	report, err := fs.ExtractFlatWithOptions(dest, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Files)
+	assert.Empty(t, report.Collisions)
+	data, err := ioutil.ReadFile(filepath.Join(dest, "item.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "c/item.txt", string(data))
+
+	// Shadowed files never collide with the file that is served.
+	dest = t.TempDir()
+	report, err = fs.ExtractFlatWithOptions(dest, &pak.ExtractOptions{Shadowed: true})
+	require.NoError(t, err)
+	names := []pak.FlatName{
+		{Name: "item~2.txt", Path: "a/item.txt"},
+		{Name: "item~3.txt", Path: "b/item.txt"},
+		{Name: "item.txt", Path: "c/item.txt"},
+	}
+	assert.Equal(t, names, report.Names)
+	for _, name := range names {
+		data, err := ioutil.ReadFile(filepath.Join(dest, name.Name))
+		require.NoError(t, err)
+		assert.Equal(t, name.Path, string(data))
+	}
+
+	// First and last are counted in pak order.
+	for collisions, path := range map[pak.FlatCollision]string{
+		pak.CollisionKeepFirst: "a/item.txt",
+		pak.CollisionKeepLast:  "c/item.txt",
+	} {
+		dest := t.TempDir()
+		report, err := fs.ExtractFlatWithOptions(dest, &pak.ExtractOptions{Collisions: collisions, Shadowed: true})
+		require.NoError(t, err)
+		assert.Equal(t, []pak.FlatName{{Name: "item.txt", Path: path}}, report.Names)
+	}
+}
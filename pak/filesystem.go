@@ -2,14 +2,11 @@ package pak
 
 import (
 	"errors"
-	"fmt"
-	"io/ioutil"
-	"log"
-	"os"
-	"path"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/pangbox/pangfiles/crypto/pyxtea"
 	"golang.org/x/exp/mmap"
@@ -18,71 +15,109 @@ import (
 var (
 	// ErrFuseUnsupported is returned by Mount when Fuse is not supported.
 	ErrFuseUnsupported = errors.New("fuse mounting not supported in build")
+	// ErrNotExist is returned when a file or directory does not exist.
+	ErrNotExist = errors.New("no such file")
+	// ErrPakNotLoaded is returned by RemovePak when the pak is not part of
+	// the filesystem.
+	ErrPakNotLoaded = errors.New("pak not loaded")
 )
 
-type fsfile struct {
-	path   string
-	entry  FileEntryData
-	reader *Reader
-	inode  uint64
-	fsize  int64
+// FS is an in-memory filesystem for pak files. It is safe for concurrent
+// use, including adding pak files while it is being read.
+type FS struct {
+	inodes uint64
+	key    pyxtea.Key
+
+	// tree holds the current *fstree. Readers load it once per operation so
+	// that a reload can replace the entire tree atomically.
+	tree atomic.Value
+
+	// mu serializes changes to the tree.
+	mu sync.Mutex
+
+	listenmu  sync.Mutex
+	listeners map[int]func([]fschange)
+	listenid  int
+
+	// cache holds the current *Cache.
+	cache atomic.Value
+
+	// index holds the current *IndexCache.
+	index atomic.Value
+
+	// keys holds the current *keyconfig.
+	keys atomic.Value
 }
 
-func (f *fsfile) size() (int64, error) {
-	if f.fsize == -1 {
-		s, err := f.reader.CalcFileSize(f.entry)
-		if err != nil {
-			return 0, err
-		}
-		f.fsize = s
-	}
-	return f.fsize, nil
+// NewFS returns a new, empty pak filesystem.
+func NewFS(key pyxtea.Key) *FS {
+	fs := &FS{key: key}
+	fs.tree.Store(fs.newtree())
+	fs.cache.Store((*Cache)(nil))
+	fs.index.Store((*IndexCache)(nil))
+	fs.keys.Store(&keyconfig{})
+	return fs
 }
 
-type fsdir struct {
-	path  string
-	inode uint64
+// SetCache sets the cache used for file data read through mounts of the
+// filesystem. A nil cache disables caching.
+func (fs *FS) SetCache(cache *Cache) {
+	fs.cache.Store(cache)
 }
 
-// FS is an in-memory filesystem for pak files.
-type FS struct {
-	filemap map[string]*fsfile
-	filetbl []*fsfile
-	readers []*Reader
-	key     pyxtea.Key
-
-	inodes  uint64
-	dirtbl  []*fsdir
-	rootdir *fsdir
+// Cache returns the cache set with SetCache, if any.
+func (fs *FS) Cache() *Cache {
+	return fs.cache.Load().(*Cache)
 }
 
-// NewFS returns a new, empty pak filesystem.
-func NewFS(key pyxtea.Key) *FS {
-	fs := &FS{
-		filemap: map[string]*fsfile{},
-		key:     key,
+// SetIndexCache sets the index cache used for the file tables of local pak
+// files added to the filesystem. A nil cache disables it.
+func (fs *FS) SetIndexCache(index *IndexCache) {
+	fs.index.Store(index)
+}
+
+// IndexCache returns the index cache set with SetIndexCache, if any.
+func (fs *FS) IndexCache() *IndexCache {
+	return fs.index.Load().(*IndexCache)
+}
+
+// readcached reads the data of a file through the cache, if one is set. The
+// returned data is shared and must not be modified.
+func (fs *FS) readcached(file *fsfile) ([]byte, error) {
+	cache := fs.Cache()
+	if cache == nil {
+		return file.reader.ReadFile(file.entry)
 	}
+	key := cachekey{file.reader, file.entry}
+	if data, ok := cache.get(key); ok {
+		return data, nil
+	}
+	data, err := file.reader.ReadFile(file.entry)
+	if err != nil {
+		return nil, err
+	}
+	cache.add(key, data)
+	return data, nil
+}
 
-	fs.rootdir = fs.adddir("")
+// current returns the current tree of the filesystem.
+func (fs *FS) current() *fstree {
+	return fs.tree.Load().(*fstree)
+}
 
-	return fs
+// publish replaces the current tree with t, which was built independently
+// of the current tree.
+func (fs *FS) publish(t *fstree) []fschange {
+	fs.mu.Lock()
+	changes := fs.replace(t)
+	fs.mu.Unlock()
+	fs.notify(changes)
+	return changes
 }
 
 // LoadPaks loads pak files from a series of patterns or paths.
 func LoadPaks(key pyxtea.Key, patterns []string) (*FS, error) {
-	fs := NewFS(key)
-	for _, pattern := range patterns {
-		err := fs.LoadPaksFromGlob(pattern)
-		if err != nil {
-			return nil, err
-		}
-	}
-	return fs, nil
-}
-
-func (fs *FS) newinode() uint64 {
-	fs.inodes++
-	return fs.inodes
+	return LoadPaksWithOptions(key, patterns, nil)
 }
 
 func basename(path string) string {
@@ -92,101 +127,105 @@ func basename(path string) string {
 	return path
 }
 
-func searchfiles(a []*fsfile, fn string) int {
-	return sort.Search(len(a), func(i int) bool { return a[i].path >= fn })
-}
-
-func searchdirs(a []*fsdir, fn string) int {
-	return sort.Search(len(a), func(i int) bool { return a[i].path >= fn })
+// AddPak adds a new pak on top of the filesystem.
+func (fs *FS) AddPak(reader *Reader) error {
+	return fs.AddPaks([]*Reader{reader})
 }
 
-func (fs *FS) adddir(path string) *fsdir {
-	i := 0
-	if len(fs.dirtbl) > 0 {
-		i = searchdirs(fs.dirtbl, path)
-		if i < len(fs.dirtbl) && fs.dirtbl[i].path == path {
-			return fs.dirtbl[i]
-		}
-		fs.dirtbl = append(fs.dirtbl, nil)
-		copy(fs.dirtbl[i+1:], fs.dirtbl[i:])
-	} else {
-		fs.dirtbl = append(fs.dirtbl, nil)
+// AddPaks adds a set of paks on top of the filesystem, in order. The paks
+// become visible at once, and only if all of them are added successfully.
+func (fs *FS) AddPaks(readers []*Reader) error {
+	fs.mu.Lock()
+	t, err := fs.build(fs.current(), readers)
+	if err != nil {
+		fs.mu.Unlock()
+		return err
 	}
-	fs.dirtbl[i] = &fsdir{path, fs.newinode()}
-	return fs.dirtbl[i]
+	changes := fs.replace(t)
+	fs.mu.Unlock()
+	fs.notify(changes)
+	return nil
 }
 
-func (fs *FS) addfile(path string, entry FileEntryData, reader *Reader) {
-	// Add dirs.
-	for i, c := range path {
-		if c == '/' {
-			fs.adddir(path[:i])
+// RemovePak removes a pak from the filesystem. Files it shadowed are
+// restored from the paks below it, and directories left empty are removed.
+// The reader is not closed, and may be added again later. The file tables
+// of the remaining paks are not read again.
+func (fs *FS) RemovePak(reader *Reader) error {
+	fs.mu.Lock()
+	old := fs.current()
+	readers := []*Reader{}
+	layers := []*layer{}
+	found := false
+	for i, l := range old.layers {
+		r := old.readers[i]
+		if r == reader && !found {
+			found = true
+			continue
 		}
+		readers = append(readers, r)
+		layers = append(layers, l)
 	}
-
-	name := basename(path)
-	if n, ok := fs.filemap[name]; ok {
-		// Just overwrite.
-		n.entry = entry
-		n.reader = reader
-		n.fsize = -1
-	} else {
-		// Add file.
-		n := &fsfile{path, entry, reader, fs.newinode(), -1}
-		if len(fs.filetbl) > 0 {
-			i := searchfiles(fs.filetbl, path)
-			fs.filetbl = append(fs.filetbl, nil)
-			copy(fs.filetbl[i+1:], fs.filetbl[i:])
-			fs.filetbl[i] = n
-		} else {
-			fs.filetbl = append(fs.filetbl, n)
-		}
-		fs.filemap[name] = n
+	if !found {
+		fs.mu.Unlock()
+		return ErrPakNotLoaded
 	}
+	changes := fs.replace(fs.buildlayers(fs.newtree(), readers, layers))
+	fs.mu.Unlock()
+	fs.notify(changes)
+	return nil
 }
 
-// AddPak adds a new pak on top of the filesystem.
-func (fs *FS) AddPak(reader *Reader) error {
-	err := reader.ReadFileTable(func(path string, entry FileEntryData) bool {
-		// Skip directory entries; we manually construct dirents.
-		if entry.Type&FileTypeMask == FileTypeDir {
-			return true
-		}
-		fs.addfile(path, entry, reader)
-		return true
-	})
+// AddPakFromFile adds a new pak on the filesystem from a path.
+func (fs *FS) AddPakFromFile(path string) error {
+	reader, err := fs.openfile(path)
 	if err != nil {
 		return err
 	}
-	fs.readers = append(fs.readers, reader)
-	return nil
+	return fs.AddPak(reader)
 }
 
-// AddPakFromFile adds a new pak on the filesystem from a path.
-func (fs *FS) AddPakFromFile(path string) error {
+// openfile opens a reader for a local pak file.
+func (fs *FS) openfile(path string) (*Reader, error) {
+	key, err := fs.loadkey(path)
+	if err != nil {
+		return nil, err
+	}
+	if index := fs.IndexCache(); index != nil {
+		return index.Open(key, path)
+	}
 	file, err := mmap.Open(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	reader, err := NewReader(fs.key, file)
+	reader, err := NewReader(key, file)
 	if err != nil {
-		return err
+		file.Close()
+		return nil, err
 	}
-	return fs.AddPak(reader)
+	return reader, nil
 }
 
-// LoadPaksFromFiles loads pak files from a list of paths.
+// LoadPaksFromFiles loads pak files from a list of paths. The paks become
+// visible at once, and only if all of them load successfully.
 func (fs *FS) LoadPaksFromFiles(paths []string) error {
+	readers := make([]*Reader, 0, len(paths))
 	for _, path := range paths {
-		if err := fs.AddPakFromFile(path); err != nil {
+		reader, err := fs.openfile(path)
+		if err != nil {
 			return err
 		}
+		readers = append(readers, reader)
 	}
-	return nil
+	return fs.AddPaks(readers)
 }
 
-// LoadPaksFromGlob loads pak files using a glob pattern.
+// LoadPaksFromGlob loads pak files using a glob pattern. HTTP URLs are
+// loaded as a single pak file using range requests.
 func (fs *FS) LoadPaksFromGlob(pattern string) error {
+	if isURL(pattern) {
+		return fs.AddPakFromURL(pattern, nil)
+	}
 	paths, err := filepath.Glob(pattern)
 	if err != nil {
 		return err
@@ -195,95 +234,16 @@ func (fs *FS) LoadPaksFromGlob(pattern string) error {
 	return fs.LoadPaksFromFiles(paths)
 }
 
-// DetectRegions tries to decode the file table using each of the keys from
-// the keys slice in order. Keys which have no errenous filenames are
-// returned.
-func DetectRegions(patterns []string, keys []pyxtea.Key) ([]pyxtea.Key, error) {
-	valid := []pyxtea.Key{}
-	files := []*mmap.ReaderAt{}
-	defer func() {
-		for _, file := range files {
-			file.Close()
-		}
-	}()
-
-	for _, pattern := range patterns {
-		paths, err := filepath.Glob(pattern)
-		if err != nil {
-			return []pyxtea.Key{}, err
-		}
-		for _, path := range paths {
-			f, err := mmap.Open(path)
-			if err != nil {
-				return []pyxtea.Key{}, fmt.Errorf("loading file %q: %v", path, err)
-			}
-			files = append(files, f)
-		}
-	}
-
-KeyIter:
-	for _, key := range keys {
-		for _, file := range files {
-			r, err := NewReader(key, file)
-			if err != nil {
-				return []pyxtea.Key{}, err
-			}
-			err = r.ReadFileTable(func(path string, entry FileEntryData) bool {
-				// Work around the fact that somewhat arbitrarily we seem to see truncated looking filenames.
-				return !strings.ContainsRune(strings.TrimRight(path, "\uFFFD"), rune(0xFFFD))
-			})
-			if err == ErrStopIteration {
-				continue KeyIter
-			} else if err != nil {
-				return []pyxtea.Key{}, err
-			}
-		}
-		valid = append(valid, key)
-	}
-
-	return valid, nil
-}
-
-// DetectRegion is like DetectRegions, but only returns one key, and fails if
-// more than one or no keys pass validation. As a special case, if *all*
-// regions validate, the first key is selected - this helps auto-detect
-// succeed when dealing with pak files that contain no XTEA-ciphered entries.
-func DetectRegion(patterns []string, keys []pyxtea.Key) (pyxtea.Key, error) {
-	if len(keys) < 1 {
-		return pyxtea.Key{}, errors.New("no valid regions detected")
-	}
-	valid, err := DetectRegions(patterns, keys)
-	if err != nil {
-		return pyxtea.Key{}, err
-	} else if len(valid) == len(keys) {
-		return keys[0], nil
-	} else if len(valid) > 1 {
-		return pyxtea.Key{}, fmt.Errorf("ambiguous region (%d regions validated)", len(valid))
-	} else if len(valid) == 0 {
-		return pyxtea.Key{}, errors.New("no valid regions detected")
-	}
-	return valid[0], nil
-}
-
-// MustDetectRegion is like DetectRegion but crashes on error.
-func MustDetectRegion(patterns []string, keys []pyxtea.Key) pyxtea.Key {
-	region, err := DetectRegion(patterns, keys)
-	if err != nil {
-		log.Fatalln("Error auto-detecting pak region:", err)
-	}
-	return region
-}
-
 // NumFiles returns the number of files in the filesystem.
 func (fs *FS) NumFiles() int {
-	return len(fs.filetbl)
+	return fs.current().files.len()
 }
 
 // ReadFile returns a file by name.
 func (fs *FS) ReadFile(filename string) ([]byte, error) {
-	file, ok := fs.filemap[filename]
+	file, ok := fs.current().filebyname(filename)
 	if !ok {
-		return nil, errors.New("no such file")
+		return nil, ErrNotExist
 	}
 	data, err := file.reader.ReadFile(file.entry)
 	if err != nil {
@@ -292,78 +252,60 @@ func (fs *FS) ReadFile(filename string) ([]byte, error) {
 	return data, nil
 }
 
+// ReadFileInto reads a file by name into dst, like Reader.ReadFileInto.
+func (fs *FS) ReadFileInto(filename string, dst []byte) ([]byte, error) {
+	file, ok := fs.current().filebyname(filename)
+	if !ok {
+		return nil, ErrNotExist
+	}
+	return file.reader.ReadFileInto(file.entry, dst)
+}
+
+// ReadFilePooled reads a file by name into a pooled buffer, like
+// Reader.ReadFilePooled.
+func (fs *FS) ReadFilePooled(filename string) (*FileBuffer, error) {
+	file, ok := fs.current().filebyname(filename)
+	if !ok {
+		return nil, ErrNotExist
+	}
+	return file.reader.ReadFilePooled(file.entry)
+}
+
 // FileNameByIndex returns the path for a given file index.
 func (fs *FS) FileNameByIndex(index int) (string, error) {
-	if index < 0 || index >= len(fs.filetbl) {
+	t := fs.current()
+	if index < 0 || index >= t.files.len() {
 		return "", errors.New("invalid index")
 	}
-	return fs.filetbl[index].path, nil
+	return t.files.paths[index], nil
 }
 
 // ReadFileByIndex returns the path and data for a given file index.
 func (fs *FS) ReadFileByIndex(index int) (string, []byte, error) {
-	if index < 0 || index >= len(fs.filetbl) {
+	t := fs.current()
+	if index < 0 || index >= t.files.len() {
 		return "", nil, errors.New("invalid index")
 	}
 
-	data, err := fs.filetbl[index].reader.ReadFile(fs.filetbl[index].entry)
+	file := t.fileat(index)
+	data, err := file.reader.ReadFile(file.entry)
 	if err != nil {
 		return "", nil, err
 	}
 
-	return fs.filetbl[index].path, data, nil
+	return file.path, data, nil
 }
 
 // NumDirectories returns the number of directories in the filesystem.
 func (fs *FS) NumDirectories() int {
-	return len(fs.dirtbl)
+	return fs.current().dirs.len()
 }
 
 // Directory returns the directory at a given index.
 func (fs *FS) Directory(index int) string {
-	if index < 0 || index >= len(fs.dirtbl) {
+	t := fs.current()
+	if index < 0 || index >= t.dirs.len() {
 		return ""
 	}
-	return fs.dirtbl[index].path
-}
-
-// Extract extracts the filesystem onto the host disk.
-func (fs *FS) Extract(dest string) error {
-	for _, dir := range fs.dirtbl {
-		if dir.path == "" {
-			continue
-		}
-		fulldir := filepath.Join(dest, dir.path)
-		if err := os.MkdirAll(fulldir, 0755); err != nil {
-			return fmt.Errorf("making output directory %q: %v", fulldir, err)
-		}
-	}
-	for _, file := range fs.filetbl {
-		data, err := file.reader.ReadFile(file.entry)
-		if err != nil {
-			return err
-		}
-		err = ioutil.WriteFile(filepath.Join(dest, file.path), data, 0644)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-// ExtractFlat extracts the filesystem onto the host disk, into one flat folder.
-func (fs *FS) ExtractFlat(dest string) error {
-	for _, file := range fs.filetbl {
-		flatname := path.Base(file.path)
-		log.Printf("Extracting %q", file.path)
-		data, err := file.reader.ReadFile(file.entry)
-		if err != nil {
-			return err
-		}
-		err = ioutil.WriteFile(filepath.Join(dest, flatname), data, 0644)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+	return t.dirs.paths[index]
 }
@@ -0,0 +1,263 @@
+package pak_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/pangbox/pangfiles/pak"
+	"github.com/pangbox/pangfiles/pak/paktest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemovePak(t *testing.T) {
+	base := mustReader(t, paktest.Pak{Key: testKey, Files: []paktest.File{
+		{Path: "data/a.txt", Data: []byte("base a")},
+		{Path: "data/b.txt", Data: []byte("base b")},
+	}})
+	patch := mustReader(t, paktest.Pak{Key: testKey, Files: []paktest.File{
+		{Path: "patch/a.txt", Data: []byte("patch a")},
+		{Path: "patch/sub/c.txt", Data: []byte("patch c")},
+	}})
+
+	fs := pak.NewFS(testKey)
+	require.NoError(t, fs.AddPak(base))
+	require.NoError(t, fs.AddPak(patch))
+	flat, _, stop := fs.Flatten()
+	defer stop()
+
+	data, err := fs.ReadFile("a.txt")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("patch a"), data)
+	assert.Equal(t, 3, fs.NumFiles())
+	// The flat view also has data/a.txt, which patch/a.txt hides in fs.
+	assert.Equal(t, 4, flat.NumFiles())
+
+	require.NoError(t, fs.RemovePak(patch))
+	data, err = fs.ReadFile("a.txt")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("base a"), data)
+	assert.Equal(t, []string{"data/a.txt", "data/b.txt"}, flatFileNames(fs))
+	_, err = fs.Stat("patch/sub")
+	assert.ErrorIs(t, err, pak.ErrNotExist)
+	_, err = fs.Stat("patch")
+	assert.ErrorIs(t, err, pak.ErrNotExist)
+	assert.Equal(t, 2, flat.NumFiles())
+
+	assert.ErrorIs(t, fs.RemovePak(patch), pak.ErrPakNotLoaded)
+
+	// The pak can be toggled back on.
+	require.NoError(t, fs.AddPak(patch))
+	data, err = fs.ReadFile("a.txt")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("patch a"), data)
+}
+
+// countingReader counts the reads made from a pak image.
+type countingReader struct {
+	*bytes.Reader
+	reads int
+}
+
+func (c *countingReader) ReadAt(p []byte, off int64) (int, error) {
+	c.reads++
+	return c.Reader.ReadAt(p, off)
+}
+
+func TestRemovePakKeepsFileTables(t *testing.T) {
+	paks := []*countingReader{}
+	readers := []*pak.Reader{}
+	for i := 0; i < 3; i++ {
+		data := &countingReader{Reader: paktest.Pak{Key: testKey, Files: []paktest.File{
+			{Path: fmt.Sprintf("data/%d.txt", i), Data: []byte("data"), EntryType: pak.EntryTypeXTEA},
+		}}.Reader()}
+		r, err := pak.NewReader(testKey, data)
+		require.NoError(t, err)
+		paks = append(paks, data)
+		readers = append(readers, r)
+	}
+	fs := pak.NewFS(testKey)
+	require.NoError(t, fs.AddPaks(readers))
+	for _, p := range paks {
+		p.reads = 0
+	}
+
+	require.NoError(t, fs.RemovePak(readers[1]))
+	assert.Equal(t, []string{"data/0.txt", "data/2.txt"}, flatFileNames(fs))
+	for _, p := range paks {
+		assert.Zero(t, p.reads)
+	}
+}
+
+func TestAddPaksOverrides(t *testing.T) {
+	base := mustReader(t, paktest.Pak{Key: testKey, Files: []paktest.File{
+		{Path: "model/a.dds", Data: []byte("base a")},
+		{Path: "model/b.dds", Data: []byte("base b")},
+		{Path: "ui/b.dds", Data: []byte("base ui b")},
+	}})
+	patch := mustReader(t, paktest.Pak{Key: testKey, Files: []paktest.File{
+		{Path: "patch/a.dds", Data: []byte("patch a")},
+		{Path: "patch/c.dds", Data: []byte("patch c")},
+		{Path: "patch2/c.dds", Data: []byte("patch c again")},
+	}})
+
+	// Loading both at once must give the same result as loading them one
+	// at a time.
+	bulk := pak.NewFS(testKey)
+	require.NoError(t, bulk.AddPaks([]*pak.Reader{base, patch}))
+	layered := pak.NewFS(testKey)
+	require.NoError(t, layered.AddPak(base))
+	require.NoError(t, layered.AddPak(patch))
+
+	for _, fs := range []*pak.FS{bulk, layered} {
+		// Files are replaced by name, keeping the path they were first
+		// seen at, but directories are created for every path.
+		assert.Equal(t, []string{"model/a.dds", "model/b.dds", "patch/c.dds"}, flatFileNames(fs))
+		dirs := []string{}
+		for i := 0; i < fs.NumDirectories(); i++ {
+			dirs = append(dirs, fs.Directory(i))
+		}
+		assert.Equal(t, []string{"", "model", "patch", "patch2", "ui"}, dirs)
+
+		for name, want := range map[string]string{"a.dds": "patch a", "b.dds": "base ui b", "c.dds": "patch c again"} {
+			data, err := fs.ReadFile(name)
+			require.NoError(t, err)
+			assert.Equal(t, want, string(data))
+		}
+	}
+}
+
+type tableEntry struct {
+	Path  string
+	Entry pak.FileEntryData
+}
+
+func readTable(t *testing.T, r *pak.Reader) []tableEntry {
+	t.Helper()
+	entries := []tableEntry{}
+	require.NoError(t, r.ReadFileTable(func(path string, entry pak.FileEntryData) bool {
+		entries = append(entries, tableEntry{path, entry})
+		return true
+	}))
+	return entries
+}
+
+func TestDirectoryEntries(t *testing.T) {
+	original := mustReader(t, paktest.Pak{Key: testKey, Files: []paktest.File{
+		{Path: "data", FileType: pak.FileTypeDir, EntryType: pak.EntryTypeXTEA},
+		{Path: "data/a.txt", Data: []byte("a"), EntryType: pak.EntryTypeXTEA},
+		{Path: "data/empty", FileType: pak.FileTypeDir, EntryType: pak.EntryTypeXTEA, Data: []byte("meta")},
+		{Path: "data/sub/b.txt", Data: []byte("b"), EntryType: pak.EntryTypeXTEA},
+	}})
+	fs := pak.NewFS(testKey)
+	require.NoError(t, fs.AddPak(original))
+
+	entries, err := fs.ReadDir("data")
+	require.NoError(t, err)
+	assert.Equal(t, []pak.DirEntry{
+		{Name: "a.txt", Path: "data/a.txt", Size: 1},
+		{Name: "empty", Path: "data/empty", IsDir: true},
+		{Name: "sub", Path: "data/sub", IsDir: true},
+	}, entries)
+
+	entry, ok := fs.Entry("data/empty")
+	require.True(t, ok)
+	assert.Equal(t, byte(pak.FileTypeDir|pak.EntryTypeXTEA), entry.Type)
+	assert.Equal(t, uint32(4), entry.RealFileSize)
+	_, ok = fs.Entry("data/sub")
+	assert.False(t, ok)
+
+	dest := t.TempDir()
+	require.NoError(t, fs.Extract(dest))
+	stat, err := os.Stat(filepath.Join(dest, "data", "empty"))
+	require.NoError(t, err)
+	assert.True(t, stat.IsDir())
+
+	// Writing the filesystem back out reproduces the original table.
+	out := bytes.Buffer{}
+	_, err = fs.WritePak(testKey, &out, &pak.WriterOptions{EntryType: pak.EntryTypeXTEA})
+	require.NoError(t, err)
+	assert.Equal(t, readTable(t, original), readTable(t, mustReaderBytes(t, out.Bytes())))
+}
+
+const benchEntries = 500000
+
+var (
+	benchPakOnce sync.Once
+	benchPak     []byte
+	benchPatch   []byte
+)
+
+// benchPaks returns a synthetic pak of benchEntries files, spread over
+// directories like a full client, and a patch pak that overrides some of
+// them and adds new files.
+func benchPaks() ([]byte, []byte) {
+	benchPakOnce.Do(func() {
+		base := paktest.Pak{Key: testKey}
+		for i := 0; i < benchEntries; i++ {
+			base.Files = append(base.Files, paktest.File{
+				Path:      fmt.Sprintf("data%02d/set%03d/item%06d.dds", i%37, i%997, i),
+				EntryType: pak.EntryTypeXTEA,
+			})
+		}
+		patch := paktest.Pak{Key: testKey}
+		for i := 0; i < benchEntries/50; i++ {
+			patch.Files = append(patch.Files, paktest.File{
+				Path:      fmt.Sprintf("patch/item%06d.dds", i*97),
+				EntryType: pak.EntryTypeXTEA,
+			})
+		}
+		benchPak, benchPatch = base.Bytes(), patch.Bytes()
+	})
+	return benchPak, benchPatch
+}
+
+func BenchmarkAddPak(b *testing.B) {
+	data, _ := benchPaks()
+	r, err := pak.NewReader(testKey, bytes.NewReader(data))
+	require.NoError(b, err)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fs := pak.NewFS(testKey)
+		require.NoError(b, fs.AddPak(r))
+	}
+}
+
+func BenchmarkAddPatch(b *testing.B) {
+	data, patchdata := benchPaks()
+	base, err := pak.NewReader(testKey, bytes.NewReader(data))
+	require.NoError(b, err)
+	patch, err := pak.NewReader(testKey, bytes.NewReader(patchdata))
+	require.NoError(b, err)
+	fs := pak.NewFS(testKey)
+	require.NoError(b, fs.AddPak(base))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		require.NoError(b, fs.AddPak(patch))
+		b.StopTimer()
+		require.NoError(b, fs.RemovePak(patch))
+		b.StartTimer()
+	}
+}
+
+func BenchmarkLookup(b *testing.B) {
+	data, _ := benchPaks()
+	r, err := pak.NewReader(testKey, bytes.NewReader(data))
+	require.NoError(b, err)
+	fs := pak.NewFS(testKey)
+	require.NoError(b, fs.AddPak(r))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := fs.Stat(fmt.Sprintf("data%02d/set%03d/item%06d.dds", i%37, i%997, i%benchEntries))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package pak
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// FlatName records a file that was given a different name in a flat view to
+// avoid colliding with another file.
+type FlatName struct {
+	// Name is the name of the file in the flat view.
+	Name string `json:"name"`
+	// Path is the path of the file in the original filesystem.
+	Path string `json:"path"`
+}
+
+// Flatten returns a filesystem presenting every file in the paks of fs in
+// its root directory under its base name. This includes files that fs
+// hides behind a later file with the same base name, so that no file is
+// lost in the flat view. Names are compared case-insensitively, as
+// they are by the client. When names collide, the file fs serves under the
+// name keeps it, or if several are served, the first in path order. The
+// others are suffixed with as much of their source directory as needed to
+// be unique, e.g. "a/b/item.dds" becomes "item~b.dds" or "item~a_b.dds". The
+// renamed files are returned.
+//
+// The flat view is rebuilt whenever fs is reloaded, until stop is called.
+func (fs *FS) Flatten() (flat *FS, renamed []FlatName, stop func()) {
+	flat = NewFS(fs.key)
+	t, renamed := flat.flatten(fs.current())
+	flat.publish(t)
+	stop = fs.subscribe(func([]fschange) {
+		// The tree of fs is read under flat.mu, so that a rebuild for an
+		// earlier reload never replaces one for a later reload.
+		flat.mu.Lock()
+		t, _ := flat.flatten(fs.current())
+		changes := flat.replace(t)
+		flat.mu.Unlock()
+		flat.notify(changes)
+	})
+	return flat, renamed, stop
+}
+
+// flatten builds a flat tree containing every file in the paks of src.
+func (fs *FS) flatten(src *fstree) (*fstree, []FlatName) {
+	taken := map[string]bool{}
+	renamed := []FlatName{}
+	all := src.allfiles()
+	names := make([]string, len(all))
+
+	// Files served by src claim their names first, so that the flat view
+	// serves the same data under a name as src does.
+	for i, f := range all {
+		name := basename(f.path)
+		if src.visible(f) && !taken[strings.ToLower(name)] {
+			names[i] = name
+			taken[strings.ToLower(name)] = true
+		}
+	}
+	files := make([]pendingentry, 0, len(all))
+	for i, f := range all {
+		name := names[i]
+		if name == "" {
+			name = basename(f.path)
+			if taken[strings.ToLower(name)] {
+				name = flatname(f.path, taken)
+				renamed = append(renamed, FlatName{Name: name, Path: f.path})
+			}
+			taken[strings.ToLower(name)] = true
+		}
+		files = append(files, pendingentry{name, f.entry, f.reader})
+	}
+
+	return fs.buildentries(fs.newtree(), src.readers, files, nil), renamed
+}
+
+// flatname returns a unique name for a colliding file, using the shortest
+// suffix of its directory that is not already taken.
+func flatname(fullpath string, taken map[string]bool) string {
+	name := basename(fullpath)
+	ext := path.Ext(name)
+	stem := name[:len(name)-len(ext)]
+	dirs := strings.Split(path.Dir(fullpath), "/")
+	if dirs[0] == "." {
+		dirs = nil
+	}
+
+	candidate := ""
+	for i := len(dirs) - 1; i >= 0; i-- {
+		candidate = stem + "~" + strings.Join(dirs[i:], "_") + ext
+		if !taken[strings.ToLower(candidate)] {
+			return candidate
+		}
+	}
+
+	if candidate == "" {
+		candidate = stem + ext
+	}
+	candidateStem := candidate[:len(candidate)-len(ext)]
+	for n := 2; ; n++ {
+		candidate = fmt.Sprintf("%s~%d%s", candidateStem, n, ext)
+		if !taken[strings.ToLower(candidate)] {
+			return candidate
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package pak_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pangbox/pangfiles/pak"
+	"github.com/pangbox/pangfiles/pak/paktest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func flatFileNames(fs *pak.FS) []string {
+	names := []string{}
+	for i := 0; i < fs.NumFiles(); i++ {
+		name, _ := fs.FileNameByIndex(i)
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestFlatten(t *testing.T) {
+	fs := pak.NewFS(testKey)
+	require.NoError(t, fs.AddPak(mustReader(t, paktest.Pak{Key: testKey, Files: []paktest.File{
+		{Path: "model/item.dds", Data: []byte("model item")},
+		{Path: "ui/a/Item.dds", Data: []byte("ui item")},
+		{Path: "ui/b/ITEM.dds", Data: []byte("other ui item")},
+		{Path: "item~a.dds", Data: []byte("decoy")},
+		{Path: "readme", Data: []byte("readme")},
+	}})))
+
+	flat, renamed, stop := fs.Flatten()
+	defer stop()
+	assert.Equal(t, []string{"ITEM~b.dds", "Item~ui_a.dds", "item.dds", "item~a.dds", "readme"}, flatFileNames(flat))
+	assert.Equal(t, 1, flat.NumDirectories())
+	// "Item~a.dds" is taken by the decoy, so more of the directory is used.
+	assert.Equal(t, []pak.FlatName{
+		{Name: "Item~ui_a.dds", Path: "ui/a/Item.dds"},
+		{Name: "ITEM~b.dds", Path: "ui/b/ITEM.dds"},
+	}, renamed)
+
+	data, err := flat.ReadFile("Item~ui_a.dds")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("ui item"), data)
+}
+
+func TestFlattenDuplicateBaseNames(t *testing.T) {
+	fs := pak.NewFS(testKey)
+	require.NoError(t, fs.AddPak(mustReader(t, paktest.Pak{Key: testKey, Files: []paktest.File{
+		{Path: "b/item.txt", Data: []byte("B")},
+		{Path: "a/item.txt", Data: []byte("A")},
+		{Path: "c/item.txt", Data: []byte("old C")},
+	}})))
+	require.NoError(t, fs.AddPak(mustReader(t, paktest.Pak{Key: testKey, Files: []paktest.File{
+		{Path: "c/item.txt", Data: []byte("C")},
+	}})))
+	assert.Equal(t, 1, fs.NumFiles())
+
+	flat, renamed, stop := fs.Flatten()
+	defer stop()
+	assert.Equal(t, []string{"item.txt", "item~a.txt", "item~b.txt"}, flatFileNames(flat))
+	assert.Equal(t, []pak.FlatName{
+		{Name: "item~a.txt", Path: "a/item.txt"},
+		{Name: "item~b.txt", Path: "b/item.txt"},
+	}, renamed)
+
+	// The bare name serves the same file as the layered filesystem.
+	want, err := fs.ReadFile("item.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "C", string(want))
+	for name, want := range map[string]string{"item.txt": "C", "item~a.txt": "A", "item~b.txt": "B"} {
+		data, err := flat.ReadFile(name)
+		require.NoError(t, err)
+		assert.Equal(t, want, string(data), name)
+	}
+}
+
+func TestFlattenFollowsReload(t *testing.T) {
+	dir := t.TempDir()
+	writeTestPak(t, filepath.Join(dir, "projectg100.pak"), time.Now().Add(-time.Hour),
+		paktest.File{Path: "data/a.txt", Data: []byte("a")})
+
+	fs := pak.NewFS(testKey)
+	w := pak.NewWatcher(fs, []string{filepath.Join(dir, "projectg*.pak")})
+	_, err := w.Update()
+	require.NoError(t, err)
+
+	flat, _, stop := fs.Flatten()
+	defer stop()
+	assert.Equal(t, []string{"a.txt"}, flatFileNames(flat))
+
+	writeTestPak(t, filepath.Join(dir, "projectg101.pak"), time.Now().Add(-time.Hour),
+		paktest.File{Path: "more/b.txt", Data: []byte("b")})
+	_, err = w.Update()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a.txt", "b.txt"}, flatFileNames(flat))
+
+	// Once stopped, the flat view is no longer rebuilt.
+	stop()
+	writeTestPak(t, filepath.Join(dir, "projectg102.pak"), time.Now().Add(-time.Hour),
+		paktest.File{Path: "more/c.txt", Data: []byte("c")})
+	_, err = w.Update()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a.txt", "b.txt"}, flatFileNames(flat))
+}
@@ -1,6 +1,12 @@
 package pak
 
-// TrailerLen is the number of bytes the trailer takes up on-disk.
+import (
+	"encoding/binary"
+
+	"github.com/pangbox/pangfiles/crypto/pyxtea"
+)
+
+// TrailerLen is the number of bytes the standard trailer takes up on-disk.
 const TrailerLen = 9
 
 // TrailerData is the data structure at the end of a Pak file.
@@ -36,6 +42,10 @@ const (
 	EntryTypeMask = 0xF0
 )
 
+// FileEntryLen is the number of bytes a standard file entry header takes up
+// on-disk, not including the path that follows it.
+const FileEntryLen = 14
+
 // FileEntryData is the data structure of each file entry in a Pak file.
 type FileEntryData struct {
 	PathLength     byte
@@ -44,3 +54,84 @@ type FileEntryData struct {
 	PackedFileSize uint32
 	RealFileSize   uint32
 }
+
+// TrailerLayout describes where the fields of TrailerData are stored in the
+// trailer. Offsets are in bytes from the start of the trailer, and
+// FileListOffset and FileCount are stored as little-endian uint32s.
+type TrailerLayout struct {
+	Len            int
+	FileListOffset int
+	FileCount      int
+	Signature      int
+}
+
+// StandardTrailer is the layout of the trailer used by all known clients.
+var StandardTrailer = TrailerLayout{Len: TrailerLen, FileListOffset: 0, FileCount: 4, Signature: 8}
+
+// valid returns true if every field lies within the trailer.
+func (l TrailerLayout) valid() bool {
+	return l.Len > 0 && fits(l.FileListOffset, 4, l.Len) && fits(l.FileCount, 4, l.Len) && fits(l.Signature, 1, l.Len)
+}
+
+// decode decodes a trailer of length l.Len.
+func (l TrailerLayout) decode(b []byte) TrailerData {
+	return TrailerData{
+		FileListOffset: binary.LittleEndian.Uint32(b[l.FileListOffset:]),
+		FileCount:      binary.LittleEndian.Uint32(b[l.FileCount:]),
+		Signature:      b[l.Signature],
+	}
+}
+
+// EntryLayout describes where the fields of FileEntryData are stored in a
+// file entry header. Offsets are in bytes from the start of the header, and
+// Offset, PackedFileSize and RealFileSize are stored as little-endian
+// uint32s. XTEA-ciphered entries cipher Offset and RealFileSize together as
+// one block.
+type EntryLayout struct {
+	Len            int
+	PathLength     int
+	Type           int
+	Offset         int
+	PackedFileSize int
+	RealFileSize   int
+}
+
+// StandardEntry is the layout of the file entry header used by all known
+// clients.
+var StandardEntry = EntryLayout{Len: FileEntryLen, PathLength: 0, Type: 1, Offset: 2, PackedFileSize: 6, RealFileSize: 10}
+
+// valid returns true if every field lies within the header.
+func (l EntryLayout) valid() bool {
+	return l.Len > 0 && fits(l.PathLength, 1, l.Len) && fits(l.Type, 1, l.Len) &&
+		fits(l.Offset, 4, l.Len) && fits(l.PackedFileSize, 4, l.Len) && fits(l.RealFileSize, 4, l.Len)
+}
+
+// decipher deciphers the XTEA-ciphered fields of hdr in place.
+func (l EntryLayout) decipher(k pyxtea.Key, hdr []byte) error {
+	tmp := [8]byte{}
+	copy(tmp[0:4], hdr[l.Offset:l.Offset+4])
+	copy(tmp[4:8], hdr[l.RealFileSize:l.RealFileSize+4])
+	if err := pyxtea.Decipher(k, tmp[:]); err != nil {
+		return err
+	}
+	copy(hdr[l.Offset:l.Offset+4], tmp[0:4])
+	copy(hdr[l.RealFileSize:l.RealFileSize+4], tmp[4:8])
+	return nil
+}
+
+// decode decodes a deciphered header of length l.Len. This is done by hand
+// rather than with restruct, as it is the hot path when loading large paks.
+func (l EntryLayout) decode(hdr []byte) FileEntryData {
+	return FileEntryData{
+		PathLength:     hdr[l.PathLength],
+		Type:           hdr[l.Type],
+		Offset:         binary.LittleEndian.Uint32(hdr[l.Offset:]),
+		PackedFileSize: binary.LittleEndian.Uint32(hdr[l.PackedFileSize:]),
+		RealFileSize:   binary.LittleEndian.Uint32(hdr[l.RealFileSize:]),
+	}
+}
+
+// fits returns true if a field of n bytes at offset lies within size bytes.
+func fits(offset, n, size int) bool {
+	return offset >= 0 && offset+n <= size
+}
@@ -0,0 +1,193 @@
+package pak
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/pangbox/pangfiles/crypto/pyxtea"
+)
+
+var (
+	// ErrInvalidLayout is returned when a Format has fields outside of its
+	// trailer or entry header.
+	ErrInvalidLayout = errors.New("invalid format layout")
+	// ErrNonStandardLayout is returned when rewriting a pak file that does
+	// not have the standard layout, as pak files are only written in the
+	// standard layout.
+	ErrNonStandardLayout = errors.New("pak file does not have the standard layout")
+)
+
+// probeEntries is the number of file entries decoded when describing a file
+// in an unknown format.
+const probeEntries = 16
+
+// Format describes a variant of the pak file format.
+type Format struct {
+	// Name is a short, human readable name for the format.
+	Name string
+	// Signature is the signature byte in the trailer.
+	Signature byte
+	// Trailer is the layout of the trailer. If zero, StandardTrailer is
+	// used.
+	Trailer TrailerLayout
+	// Entry is the layout of file entry headers. If zero, StandardEntry is
+	// used.
+	Entry EntryLayout
+}
+
+// StandardFormat is the format used by all known clients: a 9 byte trailer
+// ending in signature 0x12, preceded by 14 byte file entry headers.
+var StandardFormat = Format{Name: "standard", Signature: 0x12, Trailer: StandardTrailer, Entry: StandardEntry}
+
+// withDefaults returns f with zero layouts replaced by the standard ones.
+func (f Format) withDefaults() Format {
+	if f.Trailer == (TrailerLayout{}) {
+		f.Trailer = StandardTrailer
+	}
+	if f.Entry == (EntryLayout{}) {
+		f.Entry = StandardEntry
+	}
+	return f
+}
+
+// standard returns true if f has the standard trailer and entry layouts,
+// which are the only ones pak files can be written in.
+func (f Format) standard() bool {
+	f = f.withDefaults()
+	return f.Trailer == StandardTrailer && f.Entry == StandardEntry
+}
+
+// knownFormats is the list of formats recognized by ProbeFormat. The layouts
+// of other variants have not been documented yet, so only the standard format
+// is recognized; other variants are reported by a FormatError, and may be
+// read by describing them with a Format.
+var knownFormats = []Format{StandardFormat}
+
+// FormatError is returned when a file is not in a known pak format. It
+// describes what was found where the trailer is expected, as interpreted by
+// the standard layout.
+type FormatError struct {
+	// Size is the size of the file.
+	Size int64
+	// Trailer holds the raw bytes at the end of the file.
+	Trailer []byte
+	// TrailerData is the trailer decoded using the standard layout. It is
+	// zero if the file is too small to contain a trailer.
+	TrailerData TrailerData
+	// TableInBounds is true if the file table offset lies within the file.
+	TableInBounds bool
+	// EntriesChecked is the number of file entries that were decoded.
+	EntriesChecked int
+	// EntriesValid is the number of decoded file entries that had known
+	// types and pointed to data within the file.
+	EntriesValid int
+}
+
+// Error implements error.
+func (e *FormatError) Error() string {
+	if len(e.Trailer) < TrailerLen {
+		return fmt.Sprintf("unknown pak format: file too small for trailer (%d bytes)", e.Size)
+	}
+	return fmt.Sprintf(
+		"unknown pak format: signature 0x%02x, trailer [% 02x], file table at 0x%x (in bounds: %t) with %d entries, %d/%d checked entries valid in standard layout",
+		e.TrailerData.Signature, e.Trailer, e.TrailerData.FileListOffset, e.TableInBounds, e.TrailerData.FileCount, e.EntriesValid, e.EntriesChecked)
+}
+
+// Unwrap returns ErrInvalidSignature, so that errors.Is can be used to test
+// for unrecognized files.
+func (e *FormatError) Unwrap() error {
+	return ErrInvalidSignature
+}
+
+// Plausible returns true if the file looks like a pak file with the standard
+// layout but an unknown signature. Such files may be readable by passing a
+// Format with their signature to NewReaderWithFormat.
+func (e *FormatError) Plausible() bool {
+	return e.TableInBounds && e.EntriesChecked > 0 && e.EntriesValid == e.EntriesChecked
+}
+
+// readTrailer reads and decodes the trailer at the end of r. If r is too
+// small to hold a trailer, the entire file is returned as the raw trailer.
+func readTrailer(r ReaderAtLen, l TrailerLayout) ([]byte, TrailerData, error) {
+	if r.Len() < l.Len {
+		buf := make([]byte, r.Len())
+		if _, err := r.ReadAt(buf, 0); err != nil {
+			return nil, TrailerData{}, fmt.Errorf("reading trailer: %w", err)
+		}
+		return buf, TrailerData{}, nil
+	}
+	buf := make([]byte, l.Len)
+	if _, err := r.ReadAt(buf, int64(r.Len()-l.Len)); err != nil {
+		return nil, TrailerData{}, fmt.Errorf("reading trailer: %w", err)
+	}
+	return buf, l.decode(buf), nil
+}
+
+// ProbeFormat identifies the format of a pak file. Currently, only
+// StandardFormat is recognized. If the format is not known, a *FormatError
+// describing the file is returned. The key is used to decode file entries
+// when describing an unknown file.
+func ProbeFormat(k pyxtea.Key, r ReaderAtLen) (Format, error) {
+	return ProbeFormats(k, r, knownFormats)
+}
+
+// ProbeFormats is like ProbeFormat, but recognizes the given formats
+// rather than the known ones. Formats are tried in order, and the first
+// with a matching signature is returned.
+func ProbeFormats(k pyxtea.Key, r ReaderAtLen, formats []Format) (Format, error) {
+	for _, format := range formats {
+		format = format.withDefaults()
+		if !format.Trailer.valid() || !format.Entry.valid() {
+			return Format{}, fmt.Errorf("format %q: %w", format.Name, ErrInvalidLayout)
+		}
+		raw, t, err := readTrailer(r, format.Trailer)
+		if err != nil {
+			return Format{}, err
+		}
+		if len(raw) == format.Trailer.Len && t.Signature == format.Signature {
+			return format, nil
+		}
+	}
+
+	raw, t, err := readTrailer(r, StandardTrailer)
+	if err != nil {
+		return Format{}, err
+	}
+	ferr := &FormatError{
+		Size:        int64(r.Len()),
+		Trailer:     raw,
+		TrailerData: t,
+	}
+	if len(raw) < TrailerLen {
+		return Format{}, ferr
+	}
+	ferr.TableInBounds = int64(t.FileListOffset) < int64(r.Len()-TrailerLen)
+	if ferr.TableInBounds {
+		probe := Reader{k: k, r: r, t: t, f: StandardFormat}
+		_ = probe.ReadFileTable(func(path string, entry FileEntryData) bool {
+			ferr.EntriesChecked++
+			if validEntry(entry, t.FileListOffset) {
+				ferr.EntriesValid++
+			}
+			return ferr.EntriesChecked < probeEntries
+		})
+	}
+	return Format{}, ferr
+}
+
+// validEntry returns true if an entry has known types and its data lies
+// before the file table.
+func validEntry(entry FileEntryData, tableOffset uint32) bool {
+	switch entry.Type & EntryTypeMask {
+	case EntryTypeXOR, EntryTypeXTEA, EntryTypeBasic:
+	default:
+		return false
+	}
+	if entry.Type&FileTypeMask > FileTypeLz2 {
+		return false
+	}
+	if entry.Type&FileTypeMask == FileTypeDir {
+		return true
+	}
+	return uint64(entry.Offset)+uint64(entry.PackedFileSize) <= uint64(tableOffset)
+}
@@ -0,0 +1,117 @@
+package pak_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/pangbox/pangfiles/pak"
+	"github.com/pangbox/pangfiles/pak/paktest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbeFormatStandard(t *testing.T) {
+	image := paktest.Pak{Key: testKey, Files: testFiles(pak.EntryTypeXTEA)}
+	format, err := pak.ProbeFormat(testKey, image.Reader())
+	require.NoError(t, err)
+	assert.Equal(t, pak.StandardFormat, format)
+
+	r := mustReader(t, image)
+	assert.Equal(t, pak.StandardFormat, r.Format())
+}
+
+func TestProbeFormatUnknownSignature(t *testing.T) {
+	image := paktest.Pak{Key: testKey, Files: testFiles(pak.EntryTypeXTEA), Corruptions: []paktest.Corruption{paktest.BadSignature}}
+	data := image.Bytes()
+
+	_, err := pak.NewReaderFromBytes(testKey, data)
+	assert.ErrorIs(t, err, pak.ErrInvalidSignature)
+
+	var ferr *pak.FormatError
+	require.True(t, errors.As(err, &ferr))
+	assert.Equal(t, int64(len(data)), ferr.Size)
+	assert.Equal(t, data[len(data)-pak.TrailerLen:], ferr.Trailer)
+	assert.Equal(t, ^byte(paktest.Signature), ferr.TrailerData.Signature)
+	assert.True(t, ferr.TableInBounds)
+	assert.Equal(t, len(testFiles(pak.EntryTypeXTEA)), ferr.EntriesChecked)
+	assert.True(t, ferr.Plausible())
+
+	// A variant with the standard layout can be read by naming its format.
+	variant := pak.Format{Name: "variant", Signature: ^byte(paktest.Signature)}
+	r, err := pak.NewReaderWithFormat(testKey, image.Reader(), variant)
+	require.NoError(t, err)
+	assert.Equal(t, pak.Format{
+		Name:      "variant",
+		Signature: ^byte(paktest.Signature),
+		Trailer:   pak.StandardTrailer,
+		Entry:     pak.StandardEntry,
+	}, r.Format())
+	n := 0
+	require.NoError(t, r.ReadFileTable(func(string, pak.FileEntryData) bool { n++; return true }))
+	assert.Equal(t, len(testFiles(pak.EntryTypeXTEA)), n)
+}
+
+func TestNonStandardLayout(t *testing.T) {
+	// A variant with a longer trailer and entry headers with the fields in
+	// another order, and reserved bytes.
+	variant := pak.Format{
+		Name:      "variant",
+		Signature: 0x34,
+		Trailer:   pak.TrailerLayout{Len: 13, FileCount: 0, FileListOffset: 4, Signature: 12},
+		Entry:     pak.EntryLayout{Len: 18, Type: 0, PathLength: 1, RealFileSize: 4, PackedFileSize: 8, Offset: 14},
+	}
+	for _, entryType := range testEntryTypes {
+		files := testFiles(entryType)
+		image := paktest.Pak{Key: testKey, Files: files, Format: variant}
+
+		_, err := pak.NewReader(testKey, image.Reader())
+		assert.ErrorIs(t, err, pak.ErrInvalidSignature)
+		format, err := pak.ProbeFormats(testKey, image.Reader(), []pak.Format{pak.StandardFormat, variant})
+		require.NoError(t, err)
+		assert.Equal(t, variant, format)
+
+		r, err := pak.NewReaderWithFormat(testKey, image.Reader(), format)
+		require.NoError(t, err)
+		i := 0
+		require.NoError(t, r.ReadFileTable(func(path string, entry pak.FileEntryData) bool {
+			expected := files[i]
+			i++
+			assert.Equal(t, expected.Path, path)
+			if expected.FileType != pak.FileTypeDir {
+				data, err := r.ReadFile(entry)
+				assert.NoError(t, err)
+				assert.Equal(t, expected.Data, data)
+			}
+			return true
+		}))
+		assert.Equal(t, len(files), i)
+
+		layout, err := r.Layout()
+		require.NoError(t, err)
+		assert.Equal(t, int64(13), layout.Trailer.Len())
+		assert.Len(t, layout.Entries[0].Header, 18)
+		assert.Empty(t, layout.Gaps)
+
+		assert.ErrorIs(t, pak.Rekey(ioutil.Discard, r, testKey, nil), pak.ErrNonStandardLayout)
+	}
+}
+
+func TestInvalidLayout(t *testing.T) {
+	image := paktest.Pak{Key: testKey, Files: testFiles(pak.EntryTypeXTEA)}
+	_, err := pak.NewReaderWithFormat(testKey, image.Reader(), pak.Format{Signature: paktest.Signature, Trailer: pak.TrailerLayout{Len: 9, Signature: 9}})
+	assert.ErrorIs(t, err, pak.ErrInvalidLayout)
+}
+
+func TestProbeFormatGarbage(t *testing.T) {
+	for _, data := range [][]byte{
+		[]byte("tiny"),
+		[]byte("this is definitely not a pak file"),
+	} {
+		_, err := pak.NewReaderFromBytes(testKey, data)
+		var ferr *pak.FormatError
+		require.True(t, errors.As(err, &ferr), "%q", data)
+		assert.False(t, ferr.Plausible())
+		assert.NotEmpty(t, ferr.Error())
+	}
+}
@@ -0,0 +1,229 @@
+package pak
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrRangeUnsupported is returned when an HTTP server does not support
+	// range requests.
+	ErrRangeUnsupported = errors.New("server does not support range requests")
+	// ErrRemoteChanged is returned when a file on an HTTP server changes
+	// while it is being read.
+	ErrRemoteChanged = errors.New("remote file changed")
+)
+
+// Default options for HTTPReaderAt.
+const (
+	DefaultHTTPBlockSize = 64 << 10
+	DefaultHTTPCacheSize = 16 << 20
+)
+
+// HTTPOptions configures an HTTPReaderAt.
+type HTTPOptions struct {
+	// Client is the HTTP client to use. Defaults to http.DefaultClient.
+	Client *http.Client
+
+	// BlockSize is the size of each range request. Defaults to
+	// DefaultHTTPBlockSize.
+	BlockSize int
+
+	// CacheSize is the number of bytes of blocks to keep cached. Defaults
+	// to DefaultHTTPCacheSize.
+	CacheSize int64
+}
+
+type httpblock struct {
+	index int64
+	data  []byte
+}
+
+// HTTPReaderAt is an io.ReaderAt for a file on an HTTP server. Data is
+// requested in fixed-size blocks using range requests, and recently used
+// blocks are cached. It is safe for concurrent use.
+//
+// Blocks are requested with If-Range, using the ETag or Last-Modified time
+// of the first response, so that blocks of different versions of the file
+// are never mixed. Once the file changes, reads of blocks that are not
+// cached fail with ErrRemoteChanged.
+type HTTPReaderAt struct {
+	client    *http.Client
+	url       string
+	size      int64
+	validator string
+	blockSize int64
+	maxBlocks int
+
+	mu     sync.Mutex
+	lru    *list.List
+	blocks map[int64]*list.Element
+}
+
+// NewHTTPReaderAt returns a reader for the file at url. The server must
+// support range requests. If opts is nil, default options are used.
+func NewHTTPReaderAt(url string, opts *HTTPOptions) (*HTTPReaderAt, error) {
+	r := &HTTPReaderAt{
+		client:    http.DefaultClient,
+		url:       url,
+		blockSize: DefaultHTTPBlockSize,
+		lru:       list.New(),
+		blocks:    map[int64]*list.Element{},
+	}
+	cacheSize := int64(DefaultHTTPCacheSize)
+	if opts != nil {
+		if opts.Client != nil {
+			r.client = opts.Client
+		}
+		if opts.BlockSize > 0 {
+			r.blockSize = int64(opts.BlockSize)
+		}
+		if opts.CacheSize > 0 {
+			cacheSize = opts.CacheSize
+		}
+	}
+	r.maxBlocks = int(cacheSize / r.blockSize)
+	if r.maxBlocks < 1 {
+		r.maxBlocks = 1
+	}
+
+	// Request the first byte to learn the size and version of the file,
+	// and to make sure the server honors range requests.
+	_, size, version, err := r.fetch(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	r.size, r.validator = size, version
+	return r, nil
+}
+
+// Size returns the size of the remote file.
+func (r *HTTPReaderAt) Size() int64 {
+	return r.size
+}
+
+// validator returns the value to send in If-Range for a response: its ETag,
+// if it is a strong one, or else its Last-Modified time.
+func validator(h http.Header) string {
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return h.Get("Last-Modified")
+}
+
+// fetch requests the inclusive byte range [first, last], returning the data,
+// the total size of the file and its validator. Once the validator of the
+// file is known, the range is only returned for the same version.
+func (r *HTTPReaderAt) fetch(first, last int64) ([]byte, int64, string, error) {
+	req, err := http.NewRequest(http.MethodGet, r.url, nil)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", first, last))
+	if r.validator != "" {
+		req.Header.Set("If-Range", r.validator)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// With If-Range, the whole file is sent if it has changed.
+		if r.validator != "" {
+			return nil, 0, "", fmt.Errorf("requesting %s: %w", r.url, ErrRemoteChanged)
+		}
+		return nil, 0, "", ErrRangeUnsupported
+	default:
+		return nil, 0, "", fmt.Errorf("requesting %s: %s", r.url, resp.Status)
+	}
+
+	// Content-Range: bytes first-last/size
+	contentRange := resp.Header.Get("Content-Range")
+	slash := strings.LastIndex(contentRange, "/")
+	if !strings.HasPrefix(contentRange, "bytes ") || slash == -1 {
+		return nil, 0, "", fmt.Errorf("requesting %s: invalid Content-Range %q", r.url, contentRange)
+	}
+	size, err := strconv.ParseInt(contentRange[slash+1:], 10, 64)
+	if err != nil {
+		return nil, 0, "", fmt.Errorf("requesting %s: invalid Content-Range %q", r.url, contentRange)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, last-first+1))
+	if err != nil {
+		return nil, 0, "", err
+	}
+	return data, size, validator(resp.Header), nil
+}
+
+// block returns the data of the block at index, fetching it if needed.
+func (r *HTTPReaderAt) block(index int64) ([]byte, error) {
+	r.mu.Lock()
+	if e, ok := r.blocks[index]; ok {
+		r.lru.MoveToFront(e)
+		r.mu.Unlock()
+		return e.Value.(*httpblock).data, nil
+	}
+	r.mu.Unlock()
+
+	first := index * r.blockSize
+	last := first + r.blockSize - 1
+	if last >= r.size {
+		last = r.size - 1
+	}
+	data, size, version, err := r.fetch(first, last)
+	if err != nil {
+		return nil, err
+	}
+	// Servers that ignore If-Range are caught by the changed validator, or
+	// at least by a changed size.
+	if size != r.size || version != r.validator {
+		return nil, fmt.Errorf("requesting %s: %w", r.url, ErrRemoteChanged)
+	}
+	if int64(len(data)) != last-first+1 {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.blocks[index]; !ok {
+		r.blocks[index] = r.lru.PushFront(&httpblock{index, data})
+		for r.lru.Len() > r.maxBlocks {
+			e := r.lru.Back()
+			r.lru.Remove(e)
+			delete(r.blocks, e.Value.(*httpblock).index)
+		}
+	}
+	return data, nil
+}
+
+// ReadAt implements io.ReaderAt.
+func (r *HTTPReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= r.size {
+			return n, io.EOF
+		}
+		data, err := r.block(pos / r.blockSize)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], data[pos%r.blockSize:])
+	}
+	return n, nil
+}
@@ -0,0 +1,146 @@
+package pak_test
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pangbox/pangfiles/pak"
+	"github.com/pangbox/pangfiles/pak/paktest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// largeTestPak returns a pak with a small file followed by a large one.
+func largeTestPak() []byte {
+	return paktest.Pak{Key: testKey, Files: []paktest.File{
+		{Path: "data/small.txt", Data: []byte("small"), EntryType: pak.EntryTypeXTEA},
+		{Path: "data/large.bin", Data: bytes.Repeat([]byte{0xAA}, 1<<20), EntryType: pak.EntryTypeXTEA},
+	}}.Bytes()
+}
+
+func servePak(t *testing.T, data []byte) (*httptest.Server, *int64, *int64) {
+	requests, transferred := new(int64), new(int64)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(requests, 1)
+		http.ServeContent(countingWriter{w, transferred}, r, "test.pak", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+	return server, requests, transferred
+}
+
+type countingWriter struct {
+	http.ResponseWriter
+	n *int64
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	atomic.AddInt64(w.n, int64(len(p)))
+	return w.ResponseWriter.Write(p)
+}
+
+func TestAddPakFromURL(t *testing.T) {
+	data := largeTestPak()
+	server, requests, transferred := servePak(t, data)
+
+	fs := pak.NewFS(testKey)
+	require.NoError(t, fs.AddPakFromURL(server.URL+"/test.pak", &pak.HTTPOptions{BlockSize: 4096}))
+	assert.Equal(t, 2, fs.NumFiles())
+
+	small, err := fs.ReadFile("small.txt")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("small"), small)
+
+	// Only the blocks needed for the table and the small file are fetched.
+	assert.Less(t, atomic.LoadInt64(transferred), int64(len(data)/16))
+
+	// Cached blocks are not requested again.
+	n := atomic.LoadInt64(requests)
+	_, err = fs.ReadFile("small.txt")
+	require.NoError(t, err)
+	assert.Equal(t, n, atomic.LoadInt64(requests))
+
+	large, err := fs.ReadFile("large.bin")
+	require.NoError(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{0xAA}, 1<<20), large)
+}
+
+func TestLoadPaksURL(t *testing.T) {
+	server, _, _ := servePak(t, largeTestPak())
+	fs, err := pak.LoadPaks(testKey, []string{server.URL + "/test.pak"})
+	require.NoError(t, err)
+	assert.Equal(t, 2, fs.NumFiles())
+}
+
+func TestHTTPReaderAtRangeUnsupported(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(largeTestPak())
+	}))
+	defer server.Close()
+
+	_, err := pak.NewHTTPReaderAt(server.URL, nil)
+	assert.ErrorIs(t, err, pak.ErrRangeUnsupported)
+}
+
+func TestHTTPReaderAtEOF(t *testing.T) {
+	server, _, _ := servePak(t, []byte("0123456789"))
+	r, err := pak.NewHTTPReaderAt(server.URL, &pak.HTTPOptions{BlockSize: 4})
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), r.Size())
+
+	buf := make([]byte, 8)
+	n, err := r.ReadAt(buf, 6)
+	assert.Equal(t, 4, n)
+	assert.Equal(t, []byte("6789"), buf[:n])
+	assert.Error(t, err)
+}
+
+func TestHTTPReaderAtRemoteChanged(t *testing.T) {
+	for _, ignoreIfRange := range []bool{false, true} {
+		versions := [][]byte{bytes.Repeat([]byte("a"), 16), bytes.Repeat([]byte("b"), 16)}
+		version := int32(0)
+		ifRange := ""
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			v := atomic.LoadInt32(&version)
+			if r.Header.Get("Range") != "bytes=0-0" {
+				ifRange = r.Header.Get("If-Range")
+			}
+			if ignoreIfRange {
+				r.Header.Del("If-Range")
+			}
+			w.Header().Set("ETag", fmt.Sprintf(`"v%d"`, v))
+			http.ServeContent(w, r, "test.pak", time.Time{}, bytes.NewReader(versions[v]))
+		}))
+		defer server.Close()
+
+		r, err := pak.NewHTTPReaderAt(server.URL, &pak.HTTPOptions{BlockSize: 4})
+		require.NoError(t, err)
+		buf := make([]byte, 4)
+		_, err = r.ReadAt(buf, 0)
+		require.NoError(t, err)
+		assert.Equal(t, `"v0"`, ifRange)
+
+		atomic.StoreInt32(&version, 1)
+		_, err = r.ReadAt(buf, 0)
+		require.NoError(t, err, "cached blocks are still readable")
+		assert.Equal(t, []byte("aaaa"), buf)
+		_, err = r.ReadAt(buf, 8)
+		assert.ErrorIs(t, err, pak.ErrRemoteChanged, "ignoreIfRange=%v", ignoreIfRange)
+	}
+}
+
+func TestAddPakFromBytes(t *testing.T) {
+	data := paktest.Pak{Key: testKey, Files: testFiles(pak.EntryTypeXTEA)}.Bytes()
+
+	fs := pak.NewFS(testKey)
+	require.NoError(t, fs.AddPakFromBytes(data))
+	assert.Equal(t, 4, fs.NumFiles())
+
+	fs = pak.NewFS(testKey)
+	require.NoError(t, fs.AddPakFromReaderAt(bytes.NewReader(data), int64(len(data))))
+	assert.Equal(t, 4, fs.NumFiles())
+}
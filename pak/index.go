@@ -0,0 +1,349 @@
+package pak
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/pangbox/pangfiles/crypto/pyxtea"
+)
+
+// indexVersion is the version of the index cache file format. Files of other
+// versions are ignored.
+const indexVersion = 1
+
+// indexentry is a decoded file table entry, as stored in the index cache.
+type indexentry struct {
+	Path  string
+	Entry FileEntryData
+}
+
+// indexheader identifies the pak file an index was made from. It is stored
+// before the entries, so that it can be checked without decoding them.
+type indexheader struct {
+	Version int
+	Path    string
+	Size    int64
+	ModTime int64
+	Trailer [TrailerLen]byte
+	Format  Format
+	Key     pyxtea.Key
+	// Detected is true if Key was found by region detection, rather than
+	// given by the user. Only detected keys are reused by DetectRegion.
+	// Indexes written before it was added decode it as false.
+	Detected bool
+}
+
+// IndexCache is an on-disk cache of decoded pak file tables. Each pak file is
+// identified by its path, size, modification time and trailer; if any of
+// these change, its index is discarded and rebuilt. Indexes also record the
+// key used to decode them, which lets region detection be skipped if that key
+// was itself detected.
+type IndexCache struct {
+	dir string
+
+	// detected holds the keys found by DetectRegion for pak files, by
+	// absolute path.
+	mu       sync.Mutex
+	detected map[string]pyxtea.Key
+}
+
+// NewIndexCache returns an index cache storing its files in dir, which is
+// created if needed.
+func NewIndexCache(dir string) (*IndexCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &IndexCache{dir: dir, detected: map[string]pyxtea.Key{}}, nil
+}
+
+// DefaultIndexCacheDir returns the default directory for the index cache,
+// within the user's cache directory.
+func DefaultIndexCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "pangfiles", "index"), nil
+}
+
+// file returns the path of the index file for a pak file.
+func (c *IndexCache) file(path string) string {
+	sum := sha256.Sum256([]byte(path))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:16])+".idx")
+}
+
+// identify returns the header identifying the current state of a pak file.
+// The format and key are left unset.
+func identify(path string) (indexheader, error) {
+	h := indexheader{Version: indexVersion}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return h, err
+	}
+	h.Path = abs
+
+	f, err := os.Open(path)
+	if err != nil {
+		return h, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return h, err
+	}
+	h.Size, h.ModTime = stat.Size(), stat.ModTime().UnixNano()
+	if h.Size >= TrailerLen {
+		if _, err := f.ReadAt(h.Trailer[:], h.Size-TrailerLen); err != nil {
+			return h, err
+		}
+	}
+	return h, nil
+}
+
+// current returns true if the cached header describes the same file as h.
+func (h indexheader) current(cached indexheader) bool {
+	return cached.Version == h.Version &&
+		cached.Path == h.Path &&
+		cached.Size == h.Size &&
+		cached.ModTime == h.ModTime &&
+		cached.Trailer == h.Trailer
+}
+
+// header reads the cached header for the pak file described by h, returning
+// false if there is none or it is out of date. The decoder is positioned at
+// the entries.
+func (c *IndexCache) header(h indexheader) (indexheader, *gob.Decoder, io.Closer, bool) {
+	f, err := os.Open(c.file(h.Path))
+	if err != nil {
+		return indexheader{}, nil, nil, false
+	}
+	dec := gob.NewDecoder(f)
+	cached := indexheader{}
+	if err := dec.Decode(&cached); err != nil || !h.current(cached) {
+		f.Close()
+		return indexheader{}, nil, nil, false
+	}
+	return cached, dec, f, true
+}
+
+// load returns the cached entries of a pak file for key k, if they are
+// current. If k has since been detected for a file whose index has a key
+// given by the user, the index is rewritten to record that.
+func (c *IndexCache) load(h indexheader, k pyxtea.Key) (Format, []indexentry, bool) {
+	cached, dec, f, ok := c.header(h)
+	if !ok {
+		return Format{}, nil, false
+	}
+	defer f.Close()
+	if cached.Key != k {
+		return Format{}, nil, false
+	}
+	entries := []indexentry{}
+	if err := dec.Decode(&entries); err != nil {
+		return Format{}, nil, false
+	}
+	if !cached.Detected && c.wasdetected(h.Path, k) {
+		cached.Detected = true
+		// The index is still valid if this fails.
+		_ = c.store(cached, entries)
+	}
+	return cached.Format, entries, true
+}
+
+// wasdetected returns true if k was detected for the pak file at the
+// absolute path.
+func (c *IndexCache) wasdetected(path string, k pyxtea.Key) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key, ok := c.detected[path]
+	return ok && key == k
+}
+
+// markdetected records that k was detected for the pak files matching
+// patterns.
+func (c *IndexCache) markdetected(patterns []string, k pyxtea.Key) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, pattern := range patterns {
+		if isURL(pattern) {
+			continue
+		}
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			continue
+		}
+		for _, path := range paths {
+			if abs, err := filepath.Abs(path); err == nil {
+				c.detected[abs] = k
+			}
+		}
+	}
+}
+
+// store writes the entries of a pak file to the cache. The file is replaced
+// atomically, so concurrent readers see either the old or the new index.
+func (c *IndexCache) store(h indexheader, entries []indexentry) error {
+	tmp, err := ioutil.TempFile(c.dir, "tmp-*.idx")
+	if err != nil {
+		return err
+	}
+	enc := gob.NewEncoder(tmp)
+	if err := enc.Encode(h); err == nil {
+		err = enc.Encode(entries)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), c.file(h.Path))
+}
+
+// Attach gives r the file table of the pak file at path, from the cache if
+// it is current, or by reading and caching it otherwise. Afterwards,
+// r.ReadFileTable returns the attached entries without reading the file. It
+// must be called before r is used by other goroutines.
+func (c *IndexCache) Attach(path string, r *Reader) error {
+	h, err := identify(path)
+	if err != nil {
+		return err
+	}
+	if _, entries, ok := c.load(h, r.k); ok {
+		r.index = entries
+		return nil
+	}
+
+	entries := []indexentry{}
+	err = r.ReadFileTable(func(path string, entry FileEntryData) bool {
+		entries = append(entries, indexentry{path, entry})
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	h.Format, h.Key = r.f, r.k
+	h.Detected = c.wasdetected(h.Path, r.k)
+	if err := c.store(h, entries); err != nil {
+		return fmt.Errorf("storing index of %q: %w", path, err)
+	}
+	r.index = entries
+	return nil
+}
+
+// Open opens a local pak file for reading with key k. If the cache has a
+// current index of the file, its format and file table are taken from the
+// index rather than read from the file.
+func (c *IndexCache) Open(k pyxtea.Key, path string) (*Reader, error) {
+	f, err := OpenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	closeOnError := func(err error) (*Reader, error) {
+		if closer, ok := f.(io.Closer); ok {
+			closer.Close()
+		}
+		return nil, err
+	}
+
+	h, err := identify(path)
+	if err != nil {
+		return closeOnError(err)
+	}
+	if format, entries, ok := c.load(h, k); ok {
+		r, err := NewReaderWithFormat(k, f, format)
+		if err != nil {
+			return closeOnError(err)
+		}
+		r.index = entries
+		return r, nil
+	}
+
+	r, err := NewReader(k, f)
+	if err != nil {
+		return closeOnError(err)
+	}
+	if err := c.Attach(path, r); err != nil {
+		return closeOnError(err)
+	}
+	return r, nil
+}
+
+// DetectRegion is like the DetectRegion function, but uses the key recorded
+// in the cache when every pak file matching patterns has a current index, and
+// all of them were decoded with the same detected key from keys. Keys that
+// were given by the user, such as with a -region flag, are not reused, as
+// they may be wrong. Otherwise, it falls back to DetectRegion, and indexes
+// written for the detected key afterwards record it as detected.
+func (c *IndexCache) DetectRegion(patterns []string, keys []pyxtea.Key) (pyxtea.Key, error) {
+	if key, ok := c.cachedKey(patterns); ok {
+		for _, k := range keys {
+			if k == key {
+				return key, nil
+			}
+		}
+	}
+	key, err := DetectRegion(patterns, keys)
+	if err != nil {
+		return pyxtea.Key{}, err
+	}
+	c.markdetected(patterns, key)
+	return key, nil
+}
+
+// cachedKey returns the detected key recorded for all pak files matching
+// patterns.
+func (c *IndexCache) cachedKey(patterns []string) (pyxtea.Key, bool) {
+	var key pyxtea.Key
+	found := false
+	for _, pattern := range patterns {
+		if isURL(pattern) {
+			return pyxtea.Key{}, false
+		}
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			return pyxtea.Key{}, false
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			h, err := identify(path)
+			if err != nil {
+				return pyxtea.Key{}, false
+			}
+			cached, _, f, ok := c.header(h)
+			if !ok {
+				return pyxtea.Key{}, false
+			}
+			f.Close()
+			if !cached.Detected || (found && cached.Key != key) {
+				return pyxtea.Key{}, false
+			}
+			key, found = cached.Key, true
+		}
+	}
+	return key, found
+}
+
+// Purge removes every index from the cache.
+func (c *IndexCache) Purge() error {
+	paths, err := filepath.Glob(filepath.Join(c.dir, "*.idx"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
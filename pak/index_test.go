@@ -0,0 +1,160 @@
+package pak_test
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pangbox/pangfiles/crypto/pyxtea"
+	"github.com/pangbox/pangfiles/pak"
+	"github.com/pangbox/pangfiles/pak/paktest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func loadIndexed(t *testing.T, index *pak.IndexCache, paths ...string) (*pak.FS, error) {
+	t.Helper()
+	fs := pak.NewFS(testKey)
+	fs.SetIndexCache(index)
+	return fs, fs.LoadPaksFromFiles(paths)
+}
+
+// scrambleTable overwrites the file table of a pak file without changing its
+// size, trailer or modification time.
+func scrambleTable(t *testing.T, path string, mtime time.Time) {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	trailer := data[len(data)-pak.TrailerLen:]
+	for i := int(binary.LittleEndian.Uint32(trailer[0:4])); i < len(data)-pak.TrailerLen; i++ {
+		data[i] = 0xFF
+	}
+	require.NoError(t, ioutil.WriteFile(path, data, 0o644))
+	require.NoError(t, os.Chtimes(path, mtime, mtime))
+}
+
+func TestIndexCache(t *testing.T) {
+	dir := t.TempDir()
+	index, err := pak.NewIndexCache(filepath.Join(dir, "index"))
+	require.NoError(t, err)
+
+	mtime := time.Now().Add(-time.Hour)
+	path := filepath.Join(dir, "projectg100.pak")
+	files := []paktest.File{
+		{Path: "data/a.txt", Data: []byte("a"), EntryType: pak.EntryTypeXTEA},
+		{Path: "data/b.txt", Data: []byte("b"), EntryType: pak.EntryTypeXTEA},
+	}
+	writeTestPak(t, path, mtime, files...)
+	patterns := []string{filepath.Join(dir, "*.pak")}
+	keys := []pyxtea.Key{pyxtea.KeyKR, pyxtea.KeyJP, testKey}
+
+	// A cold start detects the region, reads the file table and stores it.
+	key, err := index.DetectRegion(patterns, keys)
+	require.NoError(t, err)
+	assert.Equal(t, testKey, key)
+	fs, err := loadIndexed(t, index, path)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"data/a.txt", "data/b.txt"}, flatFileNames(fs))
+	idx, err := filepath.Glob(filepath.Join(dir, "index", "*.idx"))
+	require.NoError(t, err)
+	assert.Len(t, idx, 1)
+
+	// A warm start does not read the file table at all, nor does region
+	// detection.
+	scrambleTable(t, path, mtime)
+	fs, err = loadIndexed(t, index, path)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"data/a.txt", "data/b.txt"}, flatFileNames(fs))
+	data, err := fs.ReadFile("b.txt")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("b"), data)
+	// With no XTEA entries left to sample, detection could not determine
+	// the key.
+	key, err = index.DetectRegion(patterns, keys)
+	require.NoError(t, err)
+	assert.Equal(t, testKey, key)
+	_, err = pak.DetectRegion(patterns, keys)
+	assert.ErrorIs(t, err, pak.ErrRegionUndetermined)
+
+	// Changing the file invalidates its index.
+	files[0].Path, files[1].Path = "data/x.txt", "data/y.txt"
+	writeTestPak(t, path, mtime.Add(time.Minute), files...)
+	fs, err = loadIndexed(t, index, path)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"data/x.txt", "data/y.txt"}, flatFileNames(fs))
+
+	// Indexes are only used with the key they were decoded with.
+	other := pak.NewFS(pyxtea.KeyKR)
+	other.SetIndexCache(index)
+	require.NoError(t, other.LoadPaksFromFiles([]string{path}))
+	assert.NotEqual(t, []string{"data/x.txt", "data/y.txt"}, flatFileNames(other))
+
+	require.NoError(t, index.Purge())
+	idx, err = filepath.Glob(filepath.Join(dir, "index", "*.idx"))
+	require.NoError(t, err)
+	assert.Empty(t, idx)
+}
+
+func TestIndexCacheWatcher(t *testing.T) {
+	dir := t.TempDir()
+	index, err := pak.NewIndexCache(filepath.Join(dir, "index"))
+	require.NoError(t, err)
+	mtime := time.Now().Add(-time.Hour)
+	path := filepath.Join(dir, "projectg100.pak")
+	writeTestPak(t, path, mtime, paktest.File{Path: "data/a.txt", Data: []byte("a"), EntryType: pak.EntryTypeXTEA})
+
+	_, err = loadIndexed(t, index, path)
+	require.NoError(t, err)
+	scrambleTable(t, path, mtime)
+
+	fs := pak.NewFS(testKey)
+	fs.SetIndexCache(index)
+	w := pak.NewWatcher(fs, []string{filepath.Join(dir, "*.pak")})
+	_, err = w.Update()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"data/a.txt"}, flatFileNames(fs))
+}
+
+func TestIndexCacheForcedKey(t *testing.T) {
+	dir := t.TempDir()
+	index, err := pak.NewIndexCache(filepath.Join(dir, "index"))
+	require.NoError(t, err)
+	mtime := time.Now().Add(-time.Hour)
+	path := filepath.Join(dir, "projectg100.pak")
+	writeTestPak(t, path, mtime, paktest.File{Path: "data/a.txt", Data: []byte("a"), EntryType: pak.EntryTypeXTEA})
+	patterns := []string{filepath.Join(dir, "*.pak")}
+	keys := []pyxtea.Key{pyxtea.KeyKR, pyxtea.KeyJP, testKey}
+
+	// An index made with a key given by the user is not trusted for
+	// detection, even if the key is wrong.
+	wrong := pak.NewFS(pyxtea.KeyKR)
+	wrong.SetIndexCache(index)
+	require.NoError(t, wrong.LoadPaksFromFiles([]string{path}))
+	key, err := index.DetectRegion(patterns, keys)
+	require.NoError(t, err)
+	assert.Equal(t, testKey, key)
+
+	// A key given by the user that turns out to be the detected one is
+	// recorded as detected, even for an index that is already current.
+	index, err = pak.NewIndexCache(filepath.Join(dir, "index"))
+	require.NoError(t, err)
+	_, err = loadIndexed(t, index, path)
+	require.NoError(t, err)
+	key, err = index.DetectRegion(patterns, keys)
+	require.NoError(t, err)
+	assert.Equal(t, testKey, key)
+	_, err = loadIndexed(t, index, path)
+	require.NoError(t, err)
+
+	// With no XTEA entries left to sample, detection would pick the first
+	// key.
+	scrambleTable(t, path, mtime)
+	index, err = pak.NewIndexCache(filepath.Join(dir, "index"))
+	require.NoError(t, err)
+	key, err = index.DetectRegion(patterns, keys)
+	require.NoError(t, err)
+	assert.Equal(t, testKey, key)
+}
@@ -0,0 +1,132 @@
+package pak
+
+import (
+	"sort"
+)
+
+// RawEntry is a file table entry as stored on-disk, along with its decoded
+// form. It is intended for inspecting the structure of pak files.
+type RawEntry struct {
+	// Index is the position of the entry in the file table.
+	Index int
+	// TableOffset is the offset of the entry header in the pak file.
+	TableOffset int64
+	// Header is the entry header as stored on-disk.
+	Header []byte
+	// Deciphered is the entry header after XTEA deciphering. For entries
+	// that are not XTEA-ciphered, it is identical to Header.
+	Deciphered []byte
+	// Entry is the decoded entry header.
+	Entry FileEntryData
+	// RawPath is the path as stored on-disk, including any padding or
+	// terminator.
+	RawPath []byte
+	// PathBytes is the deobfuscated EUC-KR path, without padding.
+	PathBytes []byte
+	// Err is set by Layout if the entry could not be read or decoded.
+	// Whatever could be read of the entry is still set.
+	Err error
+}
+
+// Len returns the number of bytes the entry takes up in the file table.
+func (e RawEntry) Len() int64 {
+	return int64(len(e.Header)) + int64(len(e.RawPath))
+}
+
+// Data returns the region holding the data of the entry. Directory entries
+// have no data, and return an empty region.
+func (e RawEntry) Data() Region {
+	if e.Entry.Type&FileTypeMask == FileTypeDir {
+		return Region{Start: int64(e.Entry.Offset), End: int64(e.Entry.Offset)}
+	}
+	return Region{Start: int64(e.Entry.Offset), End: int64(e.Entry.Offset) + int64(e.Entry.PackedFileSize)}
+}
+
+// Region is a range of bytes in a pak file, from Start up to but not
+// including End.
+type Region struct {
+	Start int64
+	End   int64
+}
+
+// Len returns the number of bytes in the region.
+func (r Region) Len() int64 {
+	return r.End - r.Start
+}
+
+// Layout describes how the bytes of a pak file are used.
+type Layout struct {
+	// Size is the size of the pak file.
+	Size int64
+	// Entries contains each entry of the file table, in order.
+	Entries []RawEntry
+	// Table is the region holding the file table.
+	Table Region
+	// Trailer is the region holding the trailer.
+	Trailer Region
+	// RawTrailer is the trailer as stored on-disk.
+	RawTrailer []byte
+	// Gaps are the regions not referenced by any file entry, the file table
+	// or the trailer, in order.
+	Gaps []Region
+}
+
+// Size returns the size of the pak file.
+func (r *Reader) Size() int64 {
+	return int64(r.r.Len())
+}
+
+// Layout reads the file table and maps out the regions of the pak file. An
+// entry that can not be decoded does not end the file table; its error is
+// recorded in its Err, and the entries after it are still read, unless the
+// table can not be read any further.
+func (r *Reader) Layout() (*Layout, error) {
+	l := &Layout{Size: r.Size()}
+	l.Trailer = Region{Start: l.Size - int64(r.f.Trailer.Len), End: l.Size}
+	l.Table = Region{Start: int64(r.t.FileListOffset), End: int64(r.t.FileListOffset)}
+	raw, _, err := readTrailer(r.r, r.f.Trailer)
+	if err != nil {
+		return nil, err
+	}
+	l.RawTrailer = raw
+
+	err = r.readRawFileTable(func(raw RawEntry) bool {
+		l.Entries = append(l.Entries, raw)
+		l.Table.End = raw.TableOffset + raw.Len()
+		return true
+	}, true)
+	if err != nil {
+		return nil, err
+	}
+
+	used := []Region{l.Table, l.Trailer}
+	for _, entry := range l.Entries {
+		if data := entry.Data(); data.Len() > 0 {
+			used = append(used, data)
+		}
+	}
+	l.Gaps = gaps(used, l.Size)
+	return l, nil
+}
+
+// gaps returns the regions between 0 and size not covered by used.
+func gaps(used []Region, size int64) []Region {
+	sort.Slice(used, func(i, j int) bool { return used[i].Start < used[j].Start })
+	result := []Region{}
+	pos := int64(0)
+	for _, region := range used {
+		if region.Start > size {
+			break
+		}
+		if region.Start > pos {
+			result = append(result, Region{Start: pos, End: region.Start})
+		}
+		if region.End > pos {
+			pos = region.End
+		}
+	}
+	if pos < size {
+		result = append(result, Region{Start: pos, End: size})
+	}
+	return result
+}
@@ -0,0 +1,125 @@
+package pak_test
+
+import (
+	"testing"
+
+	"github.com/pangbox/pangfiles/pak"
+	"github.com/pangbox/pangfiles/pak/paktest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadRawFileTable(t *testing.T) {
+	for _, entryType := range testEntryTypes {
+		image := paktest.Pak{Key: testKey, Files: testFiles(entryType)}
+		data := image.Bytes()
+		r := mustReader(t, image)
+
+		offset := int64(r.Trailer().FileListOffset)
+		paths := []string{}
+		err := r.ReadRawFileTable(func(raw pak.RawEntry) bool {
+			assert.Equal(t, offset, raw.TableOffset)
+			assert.Equal(t, data[offset:offset+pak.FileEntryLen], raw.Header[:])
+			assert.Equal(t, data[offset+pak.FileEntryLen:offset+raw.Len()], raw.RawPath)
+			if entryType == pak.EntryTypeXTEA {
+				assert.NotEqual(t, raw.Header, raw.Deciphered)
+			} else {
+				assert.Equal(t, raw.Header, raw.Deciphered)
+			}
+			paths = append(paths, string(raw.PathBytes))
+			offset += raw.Len()
+			return true
+		})
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(data)-pak.TrailerLen), offset)
+
+		expected := []string{}
+		err = r.ReadFileTable(func(path string, entry pak.FileEntryData) bool {
+			expected = append(expected, path)
+			return true
+		})
+		require.NoError(t, err)
+		assert.Equal(t, len(expected), len(paths))
+	}
+}
+
+func TestLayoutGaps(t *testing.T) {
+	image := paktest.Pak{Key: testKey, Files: []paktest.File{
+		{Path: "a.txt", Data: []byte("aaaa"), EntryType: pak.EntryTypeXTEA},
+		{Path: "b.txt", Data: []byte("bbbb"), EntryType: pak.EntryTypeXTEA},
+		{Path: "c.txt", Data: []byte("cccc"), EntryType: pak.EntryTypeXTEA},
+	}}
+	data := image.Bytes()
+
+	// Orphan the data of b.txt by pointing it at a.txt.
+	image.Files[1].Header = func(entry *pak.FileEntryData) { entry.Offset = 0 }
+	r, err := pak.NewReaderFromBytes(testKey, image.Bytes())
+	require.NoError(t, err)
+
+	layout, err := r.Layout()
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), layout.Size)
+	assert.Len(t, layout.Entries, 3)
+	assert.Equal(t, []pak.Region{{Start: 4, End: 8}}, layout.Gaps)
+	assert.Equal(t, data[len(data)-pak.TrailerLen:], layout.RawTrailer)
+	assert.Equal(t, pak.Region{Start: 12, End: int64(len(data) - pak.TrailerLen)}, layout.Table)
+}
+
+func TestLayoutDamagedEntry(t *testing.T) {
+	image := paktest.Pak{Key: testKey, Files: []paktest.File{
+		{Path: "a.txt", Data: []byte("aaaa"), EntryType: pak.EntryTypeXTEA},
+		{Path: "data/b.txt", Data: []byte("bbbb"), EntryType: pak.EntryTypeXTEA},
+		{Path: "c.txt", Data: []byte("cccc"), EntryType: pak.EntryTypeXTEA},
+	}}
+	data := image.Bytes()
+	r := mustReader(t, image)
+	var second pak.RawEntry
+	require.NoError(t, r.ReadRawFileTable(func(raw pak.RawEntry) bool {
+		if raw.Index == 1 {
+			second = raw
+		}
+		return true
+	}))
+	require.Len(t, second.RawPath, 16)
+
+	// Claim a path length that is not a multiple of the XTEA block size for
+	// b.txt, and drop the rest of its path so the entries after it line up.
+	start := second.TableOffset + pak.FileEntryLen
+	data[second.TableOffset+int64(pak.StandardEntry.PathLength)] = 12
+	data = append(data[:start+12:start+12], data[start+16:]...)
+	r, err := pak.NewReaderFromBytes(testKey, data)
+	require.NoError(t, err)
+
+	assert.ErrorIs(t, r.ReadFileTable(func(string, pak.FileEntryData) bool { return true }), pak.ErrInvalidPathLength)
+
+	layout, err := r.Layout()
+	require.NoError(t, err)
+	require.Len(t, layout.Entries, 3)
+	assert.NoError(t, layout.Entries[0].Err)
+	assert.ErrorIs(t, layout.Entries[1].Err, pak.ErrInvalidPathLength)
+	assert.Len(t, layout.Entries[1].RawPath, 12)
+	assert.Nil(t, layout.Entries[1].PathBytes)
+	assert.NoError(t, layout.Entries[2].Err)
+	assert.Equal(t, "c.txt", string(layout.Entries[2].PathBytes))
+	assert.Equal(t, layout.Trailer.Start, layout.Table.End)
+
+	// Damaged paks can not be unpacked faithfully.
+	_, err = pak.Unpack(r, t.TempDir())
+	assert.ErrorIs(t, err, pak.ErrInvalidPathLength)
+}
+
+func TestLayoutTruncatedTable(t *testing.T) {
+	files := testFiles(pak.EntryTypeXTEA)
+	image := paktest.Pak{Key: testKey, Files: files, Corruptions: []paktest.Corruption{paktest.ExtraFileCount}}
+	r := mustReader(t, image)
+
+	layout, err := r.Layout()
+	require.NoError(t, err)
+	require.Len(t, layout.Entries, len(files)+1)
+	for _, entry := range layout.Entries[:len(files)] {
+		assert.NoError(t, entry.Err)
+	}
+	last := layout.Entries[len(files)]
+	assert.Error(t, last.Err)
+	assert.Len(t, last.Header, pak.TrailerLen)
+}
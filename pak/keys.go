@@ -0,0 +1,127 @@
+package pak
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/pangbox/pangfiles/crypto/pyxtea"
+)
+
+// KeyRule selects the key used for pak files matching a pattern, allowing
+// paks encrypted with different keys to be layered in one filesystem.
+type KeyRule struct {
+	// Pattern is a glob in the syntax of filepath.Match. Patterns containing
+	// a path separator are matched against the full path of a pak file;
+	// others are matched against its base name.
+	Pattern string
+
+	// Key is the key used for matching pak files.
+	Key pyxtea.Key
+
+	// Detect, if true, ignores Key and detects the key of each matching pak
+	// file separately, using DetectRegion with the candidate keys.
+	Detect bool
+}
+
+// Match returns true if the rule applies to the pak file at path.
+func (r KeyRule) Match(path string) bool {
+	name := path
+	if !strings.ContainsAny(r.Pattern, `/\`) {
+		name = filepath.Base(path)
+		if isURL(path) {
+			name = path[strings.LastIndexByte(path, '/')+1:]
+		}
+	}
+	ok, _ := filepath.Match(r.Pattern, name)
+	return ok
+}
+
+// keyconfig holds the key rules of an FS.
+type keyconfig struct {
+	rules      []KeyRule
+	candidates []pyxtea.Key
+}
+
+// SetKeyRules sets the rules used to select keys for pak files added to the
+// filesystem by path or URL. The first matching rule applies; pak files that
+// match no rule use the key of the filesystem. candidates are the keys tried
+// for rules with Detect set.
+func (fs *FS) SetKeyRules(rules []KeyRule, candidates []pyxtea.Key) {
+	fs.keys.Store(&keyconfig{
+		rules:      append([]KeyRule{}, rules...),
+		candidates: append([]pyxtea.Key{}, candidates...),
+	})
+}
+
+// KeyFor returns the key used for the pak file at path. If its key is to be
+// detected, but the pak file has no XTEA-ciphered entries to detect it from,
+// the first candidate key is returned along with an error wrapping
+// ErrRegionUndetermined. The key does not affect how such pak files are read.
+func (fs *FS) KeyFor(path string) (pyxtea.Key, error) {
+	config := fs.keys.Load().(*keyconfig)
+	for _, rule := range config.rules {
+		if _, err := filepath.Match(rule.Pattern, ""); err != nil {
+			return pyxtea.Key{}, fmt.Errorf("invalid key rule pattern %q: %w", rule.Pattern, err)
+		}
+		if !rule.Match(path) {
+			continue
+		}
+		if !rule.Detect {
+			return rule.Key, nil
+		}
+		detect := DetectRegion
+		if index := fs.IndexCache(); index != nil && !isURL(path) {
+			detect = index.DetectRegion
+		}
+		key, err := detect([]string{path}, config.candidates)
+		if errors.Is(err, ErrRegionUndetermined) && len(config.candidates) > 0 {
+			return config.candidates[0], fmt.Errorf("detecting key of %q: %w", path, err)
+		} else if err != nil {
+			return pyxtea.Key{}, fmt.Errorf("detecting key of %q: %w", path, err)
+		}
+		return key, nil
+	}
+	return fs.key, nil
+}
+
+// loadkey is like KeyFor, but opens pak files whose key can not be detected
+// with the key KeyFor returns for them.
+func (fs *FS) loadkey(path string) (pyxtea.Key, error) {
+	key, err := fs.KeyFor(path)
+	if errors.Is(err, ErrRegionUndetermined) {
+		return key, nil
+	}
+	return key, err
+}
+
+// LoadOptions configures LoadPaksWithOptions.
+type LoadOptions struct {
+	// KeyRules select keys for individual pak files. See FS.SetKeyRules.
+	KeyRules []KeyRule
+
+	// DetectKeys are the candidate keys for key rules with Detect set.
+	DetectKeys []pyxtea.Key
+
+	// Index is the index cache to use, if any.
+	Index *IndexCache
+}
+
+// LoadPaksWithOptions is like LoadPaks, but allows pak files to use
+// different keys, and an index cache to be used. If opts is nil, it is the
+// same as LoadPaks.
+func LoadPaksWithOptions(key pyxtea.Key, patterns []string, opts *LoadOptions) (*FS, error) {
+	fs := NewFS(key)
+	if opts != nil {
+		fs.SetKeyRules(opts.KeyRules, opts.DetectKeys)
+		fs.SetIndexCache(opts.Index)
+	}
+	for _, pattern := range patterns {
+		err := fs.LoadPaksFromGlob(pattern)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fs, nil
+}
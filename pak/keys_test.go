@@ -0,0 +1,89 @@
+package pak_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/pangbox/pangfiles/crypto/pyxtea"
+	"github.com/pangbox/pangfiles/pak"
+	"github.com/pangbox/pangfiles/pak/paktest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeKeyedPak writes a pak of XTEA-ciphered files, encrypted with key.
+func writeKeyedPak(t *testing.T, path string, key pyxtea.Key, prefix string, n int) {
+	t.Helper()
+	files := []paktest.File{}
+	for i := 0; i < n; i++ {
+		files = append(files, paktest.File{Path: fmt.Sprintf("%s/file%03d.dds", prefix, i), Data: []byte(prefix), EntryType: pak.EntryTypeXTEA})
+	}
+	require.NoError(t, ioutil.WriteFile(path, paktest.Pak{Key: key, Files: files}.Bytes(), 0o644))
+}
+
+func TestKeyRule(t *testing.T) {
+	rule := pak.KeyRule{Pattern: "overlay*.pak"}
+	assert.True(t, rule.Match(filepath.Join("client", "overlay_en.pak")))
+	assert.True(t, rule.Match("https://example.com/paks/overlay1.pak"))
+	assert.False(t, rule.Match(filepath.Join("overlay", "projectg100.pak")))
+
+	rule = pak.KeyRule{Pattern: filepath.Join("client", "*.pak")}
+	assert.True(t, rule.Match(filepath.Join("client", "projectg100.pak")))
+	assert.False(t, rule.Match(filepath.Join("other", "projectg100.pak")))
+}
+
+func TestLoadPaksWithKeyRules(t *testing.T) {
+	dir := t.TempDir()
+	writeKeyedPak(t, filepath.Join(dir, "projectg100.pak"), pyxtea.KeyKR, "base", 40)
+	writeKeyedPak(t, filepath.Join(dir, "overlay_en.pak"), pyxtea.KeyUS, "overlay", 40)
+	patterns := []string{filepath.Join(dir, "projectg*.pak"), filepath.Join(dir, "overlay*.pak")}
+
+	check := func(fs *pak.FS) {
+		t.Helper()
+		_, err := fs.Stat("base/file039.dds")
+		assert.NoError(t, err)
+		data, err := fs.ReadFile("file039.dds")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("overlay"), data)
+		_, err = fs.Stat("overlay")
+		assert.NoError(t, err)
+	}
+
+	fs, err := pak.LoadPaksWithOptions(pyxtea.KeyKR, patterns, &pak.LoadOptions{
+		KeyRules: []pak.KeyRule{{Pattern: "overlay*.pak", Key: pyxtea.KeyUS}},
+	})
+	require.NoError(t, err)
+	check(fs)
+
+	fs, err = pak.LoadPaksWithOptions(pyxtea.Key{}, patterns, &pak.LoadOptions{
+		KeyRules:   []pak.KeyRule{{Pattern: "*", Detect: true}},
+		DetectKeys: detectKeys,
+	})
+	require.NoError(t, err)
+	check(fs)
+	key, err := fs.KeyFor(filepath.Join(dir, "overlay_en.pak"))
+	require.NoError(t, err)
+	assert.Equal(t, pyxtea.KeyUS, key)
+
+	// Watched paks use the rules as well.
+	fs = pak.NewFS(pyxtea.KeyKR)
+	fs.SetKeyRules([]pak.KeyRule{{Pattern: "overlay*.pak", Key: pyxtea.KeyUS}}, nil)
+	w := pak.NewWatcher(fs, patterns)
+	_, err = w.Update()
+	require.NoError(t, err)
+	check(fs)
+
+	// A single key can not read both.
+	fs, err = pak.LoadPaks(pyxtea.KeyKR, patterns)
+	if err == nil {
+		_, err = fs.Stat("overlay")
+	}
+	assert.Error(t, err)
+
+	_, err = pak.LoadPaksWithOptions(pyxtea.KeyKR, patterns, &pak.LoadOptions{
+		KeyRules: []pak.KeyRule{{Pattern: "[", Key: pyxtea.KeyUS}},
+	})
+	assert.Error(t, err)
+}
@@ -0,0 +1,49 @@
+package pak
+
+import (
+	"bytes"
+)
+
+// magic describes how to recognize a file type by its leading bytes.
+type magic struct {
+	ext    string
+	prefix []byte
+	match  func(data []byte) bool
+}
+
+// magics is the list of file types recognized by DetectFileType. Prefixes
+// are at most 8 bytes, so that they are stored as literals at the start of
+// LZ compressed data.
+var magics = []magic{
+	{ext: ".dds", prefix: []byte("DDS |")},
+	{ext: ".png", prefix: []byte("\x89PNG\r\n\x1a\n")},
+	{ext: ".jpg", prefix: []byte("\xFF\xD8\xFF")},
+	{ext: ".gif", prefix: []byte("GIF8")},
+	{ext: ".bmp", prefix: []byte("BM"), match: func(data []byte) bool {
+		// The reserved fields must be zero.
+		return len(data) >= 10 && bytes.Equal(data[6:10], []byte{0, 0, 0, 0})
+	}},
+	{ext: ".wav", prefix: []byte("RIFF"), match: func(data []byte) bool {
+		return len(data) >= 12 && string(data[8:12]) == "WAVE"
+	}},
+	{ext: ".ogg", prefix: []byte("OggS")},
+	{ext: ".mp3", prefix: []byte("ID3")},
+	{ext: ".zip", prefix: []byte("PK\x03\x04")},
+	{ext: ".xml", prefix: []byte("<?xml")},
+	{ext: ".dll", prefix: []byte("MZ"), match: func(data []byte) bool {
+		// Require a plausible offset to the PE header.
+		return len(data) >= 0x40 && data[0x3C]&3 == 0 && data[0x3E] == 0 && data[0x3F] == 0
+	}},
+}
+
+// DetectFileType returns the extension of a file type recognized by the
+// magic bytes at the start of data, such as ".dds", or an empty string if it
+// is not recognized.
+func DetectFileType(data []byte) string {
+	for _, m := range magics {
+		if bytes.HasPrefix(data, m.prefix) && (m.match == nil || m.match(data)) {
+			return m.ext
+		}
+	}
+	return ""
+}
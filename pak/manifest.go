@@ -0,0 +1,509 @@
+package pak
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pangbox/pangfiles/crypto/pyxtea"
+	"golang.org/x/text/encoding/korean"
+)
+
+// ManifestName is the name of the manifest in a directory written by Unpack.
+const ManifestName = "manifest.json"
+
+// manifestVersion is the version of the manifest format.
+const manifestVersion = 1
+
+// ErrManifestVersion is returned when reading a manifest of an unknown
+// version.
+var ErrManifestVersion = errors.New("unsupported manifest version")
+
+// Manifest describes a pak file unpacked by Unpack, with everything Pack
+// needs to rebuild it byte for byte. Paths of files in the manifest are
+// slash-separated and relative to the directory of the manifest.
+type Manifest struct {
+	Version        int        `json:"version"`
+	Key            pyxtea.Key `json:"key"`
+	Signature      byte       `json:"signature"`
+	FileListOffset uint32     `json:"fileListOffset"`
+
+	// Entries are the entries of the file table, in order.
+	Entries []ManifestEntry `json:"entries"`
+
+	// Gaps are the regions of the pak file not referenced by any entry,
+	// the file table or the trailer.
+	Gaps []ManifestGap `json:"gaps,omitempty"`
+}
+
+// ManifestEntry is an entry of the file table of an unpacked pak file.
+type ManifestEntry struct {
+	Path string `json:"path"`
+
+	// RawPath holds the hex-encoded EUC-KR bytes of the path, if they are
+	// not what Path encodes to.
+	RawPath string `json:"rawPath,omitempty"`
+
+	// EntryType is the entry type as stored on-disk; zero for legacy XOR
+	// entries.
+	EntryType byte `json:"entryType"`
+	FileType  byte `json:"fileType"`
+
+	// Padding holds the hex-encoded bytes stored after the path, after
+	// deobfuscation, if they differ from what Writer would store: the
+	// padding of XTEA paths, or the terminator of other paths.
+	Padding string `json:"padding,omitempty"`
+
+	Offset     uint32 `json:"offset"`
+	PackedSize uint32 `json:"packedSize"`
+	RealSize   uint32 `json:"realSize"`
+
+	// File is the file holding the decompressed contents, and SHA256 is
+	// its hex-encoded hash when unpacked. They are empty for directories
+	// and files whose data could not be decompressed.
+	File   string `json:"file,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+
+	// Packed is the file holding the original packed data, if it is kept.
+	// It is kept when compressing the contents again would not reproduce
+	// it, or when it could not be decompressed.
+	Packed string `json:"packed,omitempty"`
+}
+
+// ManifestGap is a region of an unpacked pak file not referenced by the file
+// table.
+type ManifestGap struct {
+	Offset int64  `json:"offset"`
+	File   string `json:"file"`
+}
+
+// ReadManifest reads the manifest in dir.
+func ReadManifest(dir string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, ManifestName))
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("reading manifest: %w", err)
+	}
+	if m.Version != manifestVersion {
+		return nil, fmt.Errorf("%w %d", ErrManifestVersion, m.Version)
+	}
+	return m, nil
+}
+
+// defaultPadding returns the padding Writer stores after a path of n bytes.
+func defaultPadding(entryType byte, n int) []byte {
+	if entryType&EntryTypeMask != EntryTypeXTEA {
+		return []byte{0}
+	}
+	if pad := n % pyxtea.BlockSize; pad != 0 || n == 0 {
+		return make([]byte, pyxtea.BlockSize-pad)
+	}
+	return []byte{}
+}
+
+// rawPadding returns the deobfuscated bytes stored after the path of raw.
+func rawPadding(k pyxtea.Key, raw RawEntry) []byte {
+	padding := append([]byte{}, raw.RawPath...)
+	switch raw.Entry.Type & EntryTypeMask {
+	case EntryTypeXTEA:
+		pyxtea.Decipher(k, padding)
+	case EntryTypeXOR:
+		for i := range padding {
+			padding[i] ^= 0x71
+		}
+	}
+	return padding[len(raw.PathBytes):]
+}
+
+// unpacknames assigns the files that contents are unpacked to. Paths that
+// can not be used as they are, such as those leaving the directory or
+// conflicting with an earlier file, are stored by entry index instead.
+// Conflicts are found ignoring case, so the files can be used on
+// case-insensitive filesystems.
+type unpacknames struct {
+	files map[string]bool
+	dirs  map[string]bool
+}
+
+func (u *unpacknames) name(index int, p string) string {
+	name := strings.ReplaceAll(p, `\`, "/")
+	if !u.usable(name) {
+		return fmt.Sprintf("unnamed/%d", index)
+	}
+	lower := strings.ToLower(name)
+	u.files[lower] = true
+	for dir := path.Dir(lower); dir != "."; dir = path.Dir(dir) {
+		u.dirs[dir] = true
+	}
+	return "files/" + name
+}
+
+func (u *unpacknames) usable(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." || part == ".." || strings.ContainsAny(part, ":\x00") {
+			return false
+		}
+	}
+	lower := strings.ToLower(name)
+	if u.files[lower] || u.dirs[lower] {
+		return false
+	}
+	for dir := path.Dir(lower); dir != "."; dir = path.Dir(dir) {
+		if u.files[dir] {
+			return false
+		}
+	}
+	return true
+}
+
+// writeUnpacked writes data to the file name in dir.
+func writeUnpacked(dir, name string, data []byte) error {
+	full := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(full, data, 0644)
+}
+
+// Unpack writes the contents of the pak file read by r to dir, along with a
+// manifest that lets Pack rebuild the pak file. The contents of each file are
+// written decompressed, under files/ and their path; directories are created
+// as needed.
+func Unpack(r *Reader, dir string) (*Manifest, error) {
+	if !r.f.standard() {
+		return nil, fmt.Errorf("unpacking %s format: %w", r.f.Name, ErrNonStandardLayout)
+	}
+	layout, err := r.Layout()
+	if err != nil {
+		return nil, err
+	}
+	for _, raw := range layout.Entries {
+		if raw.Err != nil {
+			return nil, raw.Err
+		}
+	}
+	m := &Manifest{
+		Version:        manifestVersion,
+		Key:            r.k,
+		Signature:      r.f.Signature,
+		FileListOffset: r.t.FileListOffset,
+		Entries:        make([]ManifestEntry, 0, len(layout.Entries)),
+	}
+	names := unpacknames{files: map[string]bool{}, dirs: map[string]bool{}}
+	decoder := korean.EUCKR.NewDecoder()
+	encoder := korean.EUCKR.NewEncoder()
+	var buf []byte
+
+	for _, raw := range layout.Entries {
+		entry := raw.Entry
+		me := ManifestEntry{
+			EntryType:  raw.Header[r.f.Entry.Type] & EntryTypeMask,
+			FileType:   entry.Type & FileTypeMask,
+			Offset:     entry.Offset,
+			PackedSize: entry.PackedFileSize,
+			RealSize:   entry.RealFileSize,
+		}
+		decoded, err := decoder.Bytes(raw.PathBytes)
+		if err != nil {
+			return nil, fmt.Errorf("decoding path of file entry %d: %w", raw.Index, err)
+		}
+		me.Path = string(decoded)
+		if encoded, err := encoder.Bytes(decoded); err != nil || !bytes.Equal(encoded, raw.PathBytes) {
+			me.RawPath = hex.EncodeToString(raw.PathBytes)
+		}
+		padding := rawPadding(r.k, raw)
+		if !bytes.Equal(padding, defaultPadding(entry.Type, len(raw.PathBytes))) {
+			me.Padding = hex.EncodeToString(padding)
+		}
+
+		if me.FileType != FileTypeDir {
+			packed, err := r.ReadPacked(entry)
+			if err != nil {
+				return nil, fmt.Errorf("reading %q: %w", me.Path, err)
+			}
+			keep := true
+			if data, err := r.ReadFileInto(entry, buf); err == nil {
+				buf = data
+				me.File = names.name(raw.Index, me.Path)
+				sum := sha256.Sum256(data)
+				me.SHA256 = hex.EncodeToString(sum[:])
+				if err := writeUnpacked(dir, me.File, data); err != nil {
+					return nil, err
+				}
+				keep = !bytes.Equal(pack(data, me.FileType), packed)
+			}
+			if keep {
+				me.Packed = fmt.Sprintf("packed/%d", raw.Index)
+				if err := writeUnpacked(dir, me.Packed, packed); err != nil {
+					return nil, err
+				}
+			}
+		}
+		m.Entries = append(m.Entries, me)
+	}
+
+	for i, gap := range layout.Gaps {
+		name := fmt.Sprintf("gaps/%d", i)
+		data := make([]byte, gap.Len())
+		if _, err := r.r.ReadAt(data, gap.Start); err != nil {
+			return nil, fmt.Errorf("reading gap at %d: %w", gap.Start, err)
+		}
+		if err := writeUnpacked(dir, name, data); err != nil {
+			return nil, err
+		}
+		m.Gaps = append(m.Gaps, ManifestGap{Offset: gap.Start, File: name})
+	}
+
+	data, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeUnpacked(dir, ManifestName, append(data, '\n')); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// pack returns data packed as a file of the given type.
+func pack(data []byte, fileType byte) []byte {
+	if fileType&FileTypeMask == FileTypeBasic {
+		return data
+	}
+	return Compress(data, fileType)
+}
+
+// PackStats describes a pak file written by Pack.
+type PackStats struct {
+	// Entries is the number of file table entries.
+	Entries int
+	// Modified lists the paths of files whose contents differ from the
+	// manifest, in file table order.
+	Modified []string
+}
+
+// hashfile returns the hex-encoded SHA-256 hash of the file at name.
+func hashfile(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// readpacked returns the data of an entry as it is stored in the pak file.
+// Entries with packed data kept by Unpack are not packed again.
+func readpacked(dir string, me ManifestEntry) ([]byte, error) {
+	if me.Packed != "" {
+		return ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(me.Packed)))
+	}
+	var data []byte
+	if me.File != "" {
+		var err error
+		data, err = ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(me.File)))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pack(data, me.FileType), nil
+}
+
+// writepacked returns a function writing the data of an entry, which must
+// be PackedSize bytes long.
+func writepacked(dir string, me ManifestEntry) func(w io.Writer) error {
+	return func(w io.Writer) error {
+		packed, err := readpacked(dir, me)
+		if err != nil {
+			return err
+		}
+		if len(packed) != int(me.PackedSize) {
+			return fmt.Errorf("packed data of %q is %d bytes, want %d", me.Path, len(packed), me.PackedSize)
+		}
+		_, err = w.Write(packed)
+		return err
+	}
+}
+
+// packpiece is a region of a pak file being written by Pack.
+type packpiece struct {
+	offset int64
+	size   int64
+	write  func(w io.Writer) error
+}
+
+// skipwriter discards the first skip bytes written to it.
+type skipwriter struct {
+	w    io.Writer
+	skip int64
+}
+
+func (s *skipwriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if s.skip >= int64(n) {
+		s.skip -= int64(n)
+		return n, nil
+	}
+	p, s.skip = p[s.skip:], 0
+	_, err := s.w.Write(p)
+	return n, err
+}
+
+// Pack rebuilds the pak file unpacked to dir by Unpack, writing it to w. If no
+// files were modified, the result is identical to the original pak file.
+//
+// The data of modified files is stored after the original data, so the data
+// and file entries of other files are unchanged. Data no longer referenced by
+// any entry is zeroed.
+func Pack(w io.Writer, dir string) (*PackStats, error) {
+	m, err := ReadManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	stats := &PackStats{Entries: len(m.Entries)}
+	encoder := korean.EUCKR.NewEncoder()
+	pieces := []packpiece{}
+	dataEnd := int64(m.FileListOffset)
+	relocated := []int{}
+	table := bytes.Buffer{}
+
+	for i, me := range m.Entries {
+		entry := FileEntryData{
+			Type:           me.EntryType&EntryTypeMask | me.FileType&FileTypeMask,
+			Offset:         me.Offset,
+			PackedFileSize: me.PackedSize,
+			RealFileSize:   me.RealSize,
+		}
+
+		// File contents are only hashed here. They are read again, and
+		// packed if needed, when the data of the entry is written, so that
+		// only one file is held in memory at a time.
+		modified := false
+		if me.File != "" && me.FileType != FileTypeDir {
+			sum, err := hashfile(filepath.Join(dir, filepath.FromSlash(me.File)))
+			if err != nil {
+				return nil, err
+			}
+			modified = sum != me.SHA256
+		}
+		switch {
+		case me.FileType == FileTypeDir:
+		case modified:
+			// The packed size of a modified file is needed to lay out the
+			// pak file, so it is packed once here and again when written.
+			stats.Modified = append(stats.Modified, me.Path)
+			data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(me.File)))
+			if err != nil {
+				return nil, err
+			}
+			packed := pack(data, me.FileType)
+			entry.Offset = uint32(dataEnd)
+			entry.PackedFileSize = uint32(len(packed))
+			entry.RealFileSize = uint32(len(data))
+			repacked := ManifestEntry{Path: me.Path, File: me.File, FileType: me.FileType, PackedSize: entry.PackedFileSize}
+			pieces = append(pieces, packpiece{dataEnd, int64(len(packed)), writepacked(dir, repacked)})
+			dataEnd += int64(len(packed))
+			if dataEnd > math.MaxUint32 {
+				return nil, ErrPakTooLarge
+			}
+		default:
+			pieces = append(pieces, packpiece{int64(me.Offset), int64(me.PackedSize), writepacked(dir, me)})
+			if int64(me.Offset)+int64(me.PackedSize) > int64(m.FileListOffset) {
+				relocated = append(relocated, i)
+			}
+		}
+
+		pathBytes, err := hex.DecodeString(me.RawPath)
+		if err != nil {
+			return nil, fmt.Errorf("raw path of %q: %w", me.Path, err)
+		}
+		if me.RawPath == "" {
+			if pathBytes, err = encoder.Bytes([]byte(me.Path)); err != nil {
+				return nil, fmt.Errorf("encoding path %q: %w", me.Path, err)
+			}
+		}
+		var padding []byte
+		if me.Padding != "" {
+			if padding, err = hex.DecodeString(me.Padding); err != nil {
+				return nil, fmt.Errorf("padding of %q: %w", me.Path, err)
+			}
+		}
+		table.Write(encodePaddedEntry(m.Key, entry, pathBytes, padding))
+	}
+
+	// Data after the file table can not stay in place if the table moves.
+	shift := dataEnd - int64(m.FileListOffset)
+	if shift != 0 && len(relocated) > 0 {
+		return nil, fmt.Errorf("%q: data after the file table can not be kept in place", m.Entries[relocated[0]].Path)
+	}
+	for _, gap := range m.Gaps {
+		gap := gap
+		name := filepath.Join(dir, filepath.FromSlash(gap.File))
+		stat, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		if gap.Offset >= int64(m.FileListOffset) {
+			gap.Offset += shift
+		}
+		pieces = append(pieces, packpiece{gap.Offset, stat.Size(), func(w io.Writer) error {
+			f, err := os.Open(name)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(w, f)
+			return err
+		}})
+	}
+	pieces = append(pieces, packpiece{dataEnd, int64(table.Len()), func(w io.Writer) error {
+		_, err := w.Write(table.Bytes())
+		return err
+	}})
+	sort.SliceStable(pieces, func(i, j int) bool { return pieces[i].offset < pieces[j].offset })
+
+	bw := bufio.NewWriter(w)
+	pos := int64(0)
+	for _, piece := range pieces {
+		if piece.offset > pos {
+			if _, err := bw.Write(make([]byte, piece.offset-pos)); err != nil {
+				return nil, err
+			}
+			pos = piece.offset
+		}
+		if end := piece.offset + piece.size; end > pos {
+			if err := piece.write(&skipwriter{bw, pos - piece.offset}); err != nil {
+				return nil, err
+			}
+			pos = end
+		}
+	}
+
+	trailer := [TrailerLen]byte{}
+	binary.LittleEndian.PutUint32(trailer[0:4], uint32(dataEnd))
+	binary.LittleEndian.PutUint32(trailer[4:8], uint32(len(m.Entries)))
+	trailer[8] = m.Signature
+	if _, err := bw.Write(trailer[:]); err != nil {
+		return nil, err
+	}
+	return stats, bw.Flush()
+}
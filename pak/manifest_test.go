@@ -0,0 +1,114 @@
+package pak_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/pangbox/pangfiles/crypto/pyxtea"
+	"github.com/pangbox/pangfiles/pak"
+	"github.com/pangbox/pangfiles/pak/paktest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// repack unpacks data into a new directory and packs it again.
+func repack(t *testing.T, data []byte) (string, []byte) {
+	t.Helper()
+	dir := t.TempDir()
+	_, err := pak.Unpack(mustReaderBytes(t, data), dir)
+	require.NoError(t, err)
+	buf := bytes.Buffer{}
+	stats, err := pak.Pack(&buf, dir)
+	require.NoError(t, err)
+	assert.Empty(t, stats.Modified)
+	return dir, buf.Bytes()
+}
+
+func TestUnpackPack(t *testing.T) {
+	for _, entryType := range testEntryTypes {
+		data := paktest.Pak{Key: testKey, Files: testFiles(entryType)}.Bytes()
+		dir, packed := repack(t, data)
+		assert.Equal(t, data, packed)
+
+		contents, err := ioutil.ReadFile(filepath.Join(dir, "files", "data", "plain.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, "plain file contents", string(contents))
+	}
+}
+
+func TestUnpackPackKeepsOddities(t *testing.T) {
+	image := paktest.Pak{Key: testKey, Files: []paktest.File{
+		{Path: "a.txt", Data: []byte("aaaa"), EntryType: pak.EntryTypeXTEA},
+		{Path: "b.txt", Data: []byte("bbbb"), EntryType: pak.EntryTypeXTEA},
+		// Packed data the compressor would not produce.
+		{Path: "c.bin", Data: []byte("abab"), Packed: []byte{0x00, 'a', 'b', 'a', 'b'}, FileType: pak.FileTypeLz, EntryType: pak.EntryTypeXTEA},
+		{Path: "../escape.txt", Data: []byte("up"), EntryType: pak.EntryTypeBasic},
+		{Path: "A.TXT", Data: []byte("case"), EntryType: pak.EntryTypeXOR},
+	}}
+	// Orphan the data of b.txt by pointing it at a.txt.
+	image.Files[1].Header = func(entry *pak.FileEntryData) { entry.Offset = 0 }
+	data := image.Bytes()
+
+	// Pad the path of a.txt with 0xCD rather than zeroes.
+	r := mustReaderBytes(t, data)
+	err := r.ReadRawFileTable(func(raw pak.RawEntry) bool {
+		path := data[raw.TableOffset+pak.FileEntryLen : raw.TableOffset+raw.Len()]
+		pyxtea.DecryptBlock(testKey, path)
+		for i := len(raw.PathBytes); i < len(path); i++ {
+			path[i] = 0xCD
+		}
+		pyxtea.EncryptBlock(testKey, path)
+		return false
+	})
+	require.ErrorIs(t, err, pak.ErrStopIteration)
+
+	dir, packed := repack(t, data)
+	assert.Equal(t, data, packed)
+
+	m, err := pak.ReadManifest(dir)
+	require.NoError(t, err)
+	assert.Equal(t, "cdcdcd", m.Entries[0].Padding)
+	assert.Len(t, m.Gaps, 1)
+	assert.Equal(t, "", m.Entries[0].Packed)
+	assert.NotEqual(t, "", m.Entries[2].Packed)
+	assert.Equal(t, "unnamed/3", m.Entries[3].File)
+	assert.Equal(t, "unnamed/4", m.Entries[4].File)
+}
+
+func TestPackModified(t *testing.T) {
+	data := paktest.Pak{Key: testKey, Files: testFiles(pak.EntryTypeXTEA)}.Bytes()
+	dir := t.TempDir()
+	_, err := pak.Unpack(mustReaderBytes(t, data), dir)
+	require.NoError(t, err)
+
+	changed := bytes.Repeat([]byte("changed "), 16)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "files", "data", "lz.bin"), changed, 0644))
+
+	buf := bytes.Buffer{}
+	stats, err := pak.Pack(&buf, dir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"data/lz.bin"}, stats.Modified)
+
+	before, after := mustReaderBytes(t, data), mustReaderBytes(t, buf.Bytes())
+	want := map[string][]byte{}
+	err = before.ReadFileTable(func(path string, entry pak.FileEntryData) bool {
+		want[path], _ = before.ReadPacked(entry)
+		return true
+	})
+	require.NoError(t, err)
+	err = after.ReadFileTable(func(path string, entry pak.FileEntryData) bool {
+		got, err := after.ReadFile(entry)
+		require.NoError(t, err)
+		if path == "data/lz.bin" {
+			assert.Equal(t, changed, got)
+		} else {
+			packed, err := after.ReadPacked(entry)
+			require.NoError(t, err)
+			assert.Equal(t, want[path], packed, path)
+		}
+		return true
+	})
+	require.NoError(t, err)
+}
@@ -0,0 +1,103 @@
+package pak
+
+import (
+	"context"
+	"sync"
+)
+
+// MountHandle is a handle to a filesystem mounted with StartMount.
+type MountHandle struct {
+	mountpoint string
+	unmount    func() error
+
+	ready chan struct{}
+	done  chan struct{}
+	once  sync.Once
+	err   error
+}
+
+func newMountHandle(mountpoint string) *MountHandle {
+	return &MountHandle{
+		mountpoint: mountpoint,
+		ready:      make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+// setReady marks the mount as live.
+func (h *MountHandle) setReady() {
+	select {
+	case <-h.ready:
+	default:
+		close(h.ready)
+	}
+}
+
+// finish marks the mount as stopped, recording the error serving stopped
+// with.
+func (h *MountHandle) finish(err error) {
+	h.once.Do(func() {
+		h.err = err
+		close(h.done)
+	})
+}
+
+// waitReady blocks until the mount is live or has failed.
+func (h *MountHandle) waitReady() error {
+	select {
+	case <-h.ready:
+		return nil
+	case <-h.done:
+		return h.err
+	}
+}
+
+// Mountpoint returns the path the filesystem is mounted on.
+func (h *MountHandle) Mountpoint() string {
+	return h.mountpoint
+}
+
+// Ready returns a channel that is closed once the filesystem is mounted.
+func (h *MountHandle) Ready() <-chan struct{} {
+	return h.ready
+}
+
+// Done returns a channel that is closed once the filesystem is unmounted.
+func (h *MountHandle) Done() <-chan struct{} {
+	return h.done
+}
+
+// Wait blocks until the filesystem is unmounted, returning the error that
+// stopped it, if any.
+func (h *MountHandle) Wait() error {
+	<-h.done
+	return h.err
+}
+
+// Unmount unmounts the filesystem and waits for it to stop serving. If ctx
+// is done first, its error is returned and the mount may still be live.
+func (h *MountHandle) Unmount(ctx context.Context) error {
+	select {
+	case <-h.done:
+		return nil
+	default:
+	}
+	if err := h.unmount(); err != nil {
+		return err
+	}
+	select {
+	case <-h.done:
+		return h.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Mount mounts a pak filesystem via FUSE, blocking until it is unmounted.
+func (fs *FS) Mount(mountpoint string) error {
+	h, err := fs.StartMount(mountpoint)
+	if err != nil {
+		return err
+	}
+	return h.Wait()
+}
@@ -10,7 +10,7 @@ const (
 	FuseImplementation = "nofuse"
 )
 
-// Mount mounts a pak filesystem via FUSE.
-func (fs *FS) Mount(mountpoint string) error {
-	return ErrFuseUnsupported
+// StartMount mounts a pak filesystem via FUSE.
+func (fs *FS) StartMount(mountpoint string) (*MountHandle, error) {
+	return nil, ErrFuseUnsupported
 }
@@ -0,0 +1,226 @@
+// Package paktest builds synthetic pak files for use in tests.
+//
+// Pak images are generated entirely in memory from a declarative list of
+// files, so tests can exercise every entry type, compression scheme and
+// region key without shipping real game data. Deliberately broken images can
+// be produced using Corruption values or per-file overrides.
+package paktest
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/pangbox/pangfiles/crypto/pyxtea"
+	"github.com/pangbox/pangfiles/pak"
+	"golang.org/x/text/encoding/korean"
+)
+
+// Signature is the trailer signature written to generated pak files in the
+// standard format.
+const Signature = 0x12
+
+// File describes a single entry in the file table of a synthetic pak.
+type File struct {
+	// Path is the path of the entry. It is encoded as EUC-KR on-disk.
+	Path string
+
+	// Data is the uncompressed contents of the file. No data is written for
+	// directory entries, but its length is still used as their real file
+	// size.
+	Data []byte
+
+	// FileType is the type of file; one of pak.FileTypeBasic,
+	// pak.FileTypeLz, pak.FileTypeLz2 or pak.FileTypeDir.
+	FileType byte
+
+	// EntryType is the obfuscation used for the entry; one of
+	// pak.EntryTypeXOR, pak.EntryTypeXTEA or pak.EntryTypeBasic. A value
+	// of zero produces a legacy XOR entry with no entry type on-disk.
+	EntryType byte
+
+	// Packed, if non-nil, is written as the file data instead of the
+	// compressed form of Data.
+	Packed []byte
+
+	// Header, if non-nil, is called with the decoded file entry before it
+	// is encoded, allowing arbitrary fields to be overridden.
+	Header func(entry *pak.FileEntryData)
+}
+
+// Corruption is a kind of damage that can be applied to a generated pak.
+type Corruption int
+
+// Enumeration of corruptions that can be applied to a generated pak.
+const (
+	// BadSignature replaces the trailer signature with an invalid one.
+	BadSignature Corruption = iota
+	// TruncatedTrailer removes the last byte of the trailer.
+	TruncatedTrailer
+	// ExtraFileCount claims one more file table entry than is present.
+	ExtraFileCount
+	// TableOutOfBounds points the file table past the end of the file.
+	TableOutOfBounds
+	// TruncatedTable cuts the last byte off the file table.
+	TruncatedTable
+)
+
+// Pak is a declarative description of a pak file.
+type Pak struct {
+	// Key is the XTEA key used for pak.EntryTypeXTEA entries.
+	Key pyxtea.Key
+
+	// Files is the ordered list of entries in the file table.
+	Files []File
+
+	// Corruptions are applied to the image after it is built.
+	Corruptions []Corruption
+
+	// Format is the format to write the image in. Zero layouts are
+	// replaced by the standard ones. If Format is zero, the image is
+	// written in pak.StandardFormat.
+	Format pak.Format
+}
+
+// format returns the format to write the image in.
+func (p Pak) format() pak.Format {
+	f := p.Format
+	if f == (pak.Format{}) {
+		f = pak.StandardFormat
+	}
+	if f.Trailer == (pak.TrailerLayout{}) {
+		f.Trailer = pak.StandardTrailer
+	}
+	if f.Entry == (pak.EntryLayout{}) {
+		f.Entry = pak.StandardEntry
+	}
+	return f
+}
+
+// Bytes generates the pak image. Data regions are laid out in file order,
+// followed by the file table and the trailer.
+func (p Pak) Bytes() []byte {
+	format := p.format()
+	out := bytes.Buffer{}
+	entries := make([]pak.FileEntryData, len(p.Files))
+
+	for i, file := range p.Files {
+		packed := file.Packed
+		if packed == nil {
+			switch file.FileType & pak.FileTypeMask {
+			case pak.FileTypeLz, pak.FileTypeLz2:
+				packed = Compress(file.Data, file.FileType)
+			case pak.FileTypeBasic:
+				packed = file.Data
+			}
+		}
+		entries[i] = pak.FileEntryData{
+			Type:           file.FileType | file.EntryType,
+			Offset:         uint32(out.Len()),
+			PackedFileSize: uint32(len(packed)),
+			RealFileSize:   uint32(len(file.Data)),
+		}
+		out.Write(packed)
+	}
+
+	tableOffset := out.Len()
+	for i, file := range p.Files {
+		path, err := korean.EUCKR.NewEncoder().Bytes([]byte(file.Path))
+		if err != nil {
+			panic(err)
+		}
+		out.Write(encodeEntry(p.Key, format.Entry, file, entries[i], path))
+	}
+	tableEnd := out.Len()
+
+	l := format.Trailer
+	trailer := make([]byte, l.Len)
+	binary.LittleEndian.PutUint32(trailer[l.FileListOffset:], uint32(tableOffset))
+	binary.LittleEndian.PutUint32(trailer[l.FileCount:], uint32(len(p.Files)))
+	trailer[l.Signature] = format.Signature
+	out.Write(trailer)
+
+	image := out.Bytes()
+	for _, corruption := range p.Corruptions {
+		image = corrupt(image, l, corruption, tableEnd)
+	}
+	return image
+}
+
+// Reader returns the generated pak image as a pak.ReaderAtLen.
+func (p Pak) Reader() *bytes.Reader {
+	return bytes.NewReader(p.Bytes())
+}
+
+func encodeEntry(key pyxtea.Key, l pak.EntryLayout, file File, entry pak.FileEntryData, path []byte) []byte {
+	switch file.EntryType {
+	case pak.EntryTypeXTEA:
+		if pad := len(path) % pyxtea.BlockSize; pad != 0 || len(path) == 0 {
+			path = append(path, make([]byte, pyxtea.BlockSize-pad)...)
+		}
+		entry.PathLength = byte(len(path))
+	default:
+		entry.PathLength = byte(len(path))
+		path = append(path, 0)
+	}
+
+	if file.Header != nil {
+		file.Header(&entry)
+	}
+
+	if file.EntryType != pak.EntryTypeXTEA && file.EntryType != pak.EntryTypeBasic {
+		entry.RealFileSize ^= 0x71
+	}
+
+	hdr := make([]byte, l.Len)
+	hdr[l.PathLength] = entry.PathLength
+	hdr[l.Type] = entry.Type
+	binary.LittleEndian.PutUint32(hdr[l.Offset:], entry.Offset)
+	binary.LittleEndian.PutUint32(hdr[l.PackedFileSize:], entry.PackedFileSize)
+	binary.LittleEndian.PutUint32(hdr[l.RealFileSize:], entry.RealFileSize)
+
+	switch file.EntryType {
+	case pak.EntryTypeXTEA:
+		tmp := [8]byte{}
+		copy(tmp[0:4], hdr[l.Offset:l.Offset+4])
+		copy(tmp[4:8], hdr[l.RealFileSize:l.RealFileSize+4])
+		pyxtea.EncryptBlock(key, tmp[:])
+		copy(hdr[l.Offset:l.Offset+4], tmp[0:4])
+		copy(hdr[l.RealFileSize:l.RealFileSize+4], tmp[4:8])
+		for j := 0; j+pyxtea.BlockSize <= len(path); j += pyxtea.BlockSize {
+			pyxtea.EncryptBlock(key, path[j:j+pyxtea.BlockSize])
+		}
+	case pak.EntryTypeBasic:
+	default:
+		for j := range path {
+			path[j] ^= 0x71
+		}
+	}
+
+	return append(hdr, path...)
+}
+
+func corrupt(image []byte, l pak.TrailerLayout, corruption Corruption, tableEnd int) []byte {
+	trailer := image[len(image)-l.Len:]
+	switch corruption {
+	case BadSignature:
+		trailer[l.Signature] = ^trailer[l.Signature]
+	case TruncatedTrailer:
+		image = image[:len(image)-1]
+	case ExtraFileCount:
+		count := trailer[l.FileCount:]
+		binary.LittleEndian.PutUint32(count, binary.LittleEndian.Uint32(count)+1)
+	case TableOutOfBounds:
+		binary.LittleEndian.PutUint32(trailer[l.FileListOffset:], uint32(len(image)))
+	case TruncatedTable:
+		if tableEnd > 0 {
+			image = append(image[:tableEnd-1], image[tableEnd:]...)
+		}
+	}
+	return image
+}
+
+// Compress compresses data with the LZ77 scheme used by pak files. The
+// fileType must be pak.FileTypeLz or pak.FileTypeLz2.
+func Compress(data []byte, fileType byte) []byte {
+	return pak.Compress(data, fileType)
+}
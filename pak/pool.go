@@ -0,0 +1,50 @@
+package pak
+
+import "sync"
+
+// maxPooledSize is the capacity of the largest buffer kept in a pool. Larger
+// buffers are left to the garbage collector, so that reading one large file
+// does not keep its memory in use.
+const maxPooledSize = 16 << 20
+
+// scratchPool holds buffers for compressed data read by ReadFileInto.
+var scratchPool = sync.Pool{New: func() interface{} { return new([]byte) }}
+
+func putScratch(b *[]byte) {
+	if cap(*b) <= maxPooledSize {
+		scratchPool.Put(b)
+	}
+}
+
+// filePool holds the buffers returned by ReadFilePooled.
+var filePool = sync.Pool{New: func() interface{} { return &FileBuffer{} }}
+
+// FileBuffer holds the data of a file read by ReadFilePooled.
+type FileBuffer struct {
+	// Data is the data of the file. It must not be used after the buffer
+	// is released.
+	Data []byte
+}
+
+// Release returns the buffer to the pool, to be reused by later reads.
+func (b *FileBuffer) Release() {
+	if cap(b.Data) > maxPooledSize {
+		return
+	}
+	b.Data = b.Data[:0]
+	filePool.Put(b)
+}
+
+// ReadFilePooled reads an entire file into a buffer taken from a pool shared
+// by all readers. Once the data is no longer needed, the buffer should be
+// released, so that reading many files makes few allocations.
+func (r *Reader) ReadFilePooled(entry FileEntryData) (*FileBuffer, error) {
+	b := filePool.Get().(*FileBuffer)
+	data, err := r.ReadFileInto(entry, b.Data)
+	if err != nil {
+		b.Release()
+		return nil, err
+	}
+	b.Data = data
+	return b, nil
+}
@@ -1,13 +1,10 @@
 package pak
 
 import (
-	"bytes"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 
-	"github.com/go-restruct/restruct"
 	"github.com/pangbox/pangfiles/crypto/pyxtea"
 	"golang.org/x/text/encoding/korean"
 )
@@ -20,6 +17,12 @@ var (
 	// ErrStopIteration is returned if iteration ends early because the
 	// callback returned false.
 	ErrStopIteration = errors.New("iteration stopped")
+	// ErrInvalidPathLength is returned when a file entry has a path length
+	// that can not be decoded.
+	ErrInvalidPathLength = errors.New("invalid path length")
+	// ErrEntryOutOfBounds is returned when a file entry points to data
+	// outside of the pak file.
+	ErrEntryOutOfBounds = errors.New("file entry out of bounds")
 )
 
 // ReaderAtLen is an io.ReaderAt that supports returning length.
@@ -33,105 +36,224 @@ type Reader struct {
 	k pyxtea.Key
 	r ReaderAtLen
 	t TrailerData
+	f Format
+
+	// index holds the decoded file table, if it was loaded from an
+	// IndexCache.
+	index []indexentry
 }
 
-// NewReader returns a new reader.
+// NewReader returns a new reader. The format of the file is detected using
+// ProbeFormat.
 func NewReader(k pyxtea.Key, r ReaderAtLen) (*Reader, error) {
-	n := Reader{k: k, r: r}
-	buf := [TrailerLen]byte{}
-	// Read trailer
-	if _, err := r.ReadAt(buf[:], int64(r.Len()-TrailerLen)); err != nil {
-		return nil, fmt.Errorf("reading trailer: %w", err)
+	f, err := ProbeFormat(k, r)
+	if err != nil {
+		return nil, err
 	}
-	if err := restruct.Unpack(buf[:], binary.LittleEndian, &n.t); err != nil {
+	return NewReaderWithFormat(k, r, f)
+}
+
+// NewReaderWithFormat returns a new reader for a file in the given format,
+// bypassing format detection. This can be used to read variants with a
+// signature or layout that is not yet known.
+func NewReaderWithFormat(k pyxtea.Key, r ReaderAtLen, f Format) (*Reader, error) {
+	f = f.withDefaults()
+	if !f.Trailer.valid() || !f.Entry.valid() {
+		return nil, fmt.Errorf("format %q: %w", f.Name, ErrInvalidLayout)
+	}
+	n := Reader{k: k, r: r, f: f}
+	raw, t, err := readTrailer(r, f.Trailer)
+	if err != nil {
 		return nil, err
 	}
-	if n.t.Signature != 0x12 {
+	if len(raw) < f.Trailer.Len || t.Signature != f.Signature {
 		return nil, ErrInvalidSignature
 	}
-
+	n.t = t
 	return &n, nil
 }
 
+// Key returns the key used to read the pak file.
+func (r *Reader) Key() pyxtea.Key {
+	return r.k
+}
+
+// Format returns the format of the pak file. Layouts that were left zero
+// are filled in with the standard ones.
+func (r *Reader) Format() Format {
+	return r.f
+}
+
+// Trailer returns the trailer data of the pak file.
+func (r *Reader) Trailer() TrailerData {
+	return r.t
+}
+
+// trimPadding removes the padding following XTEA-ciphered paths. This is done
+// bytewise, as bytes.Trim would treat EUC-KR bytes as invalid runes.
+func trimPadding(b []byte) []byte {
+	for len(b) > 0 && (b[len(b)-1] == 0x00 || b[len(b)-1] == 0xCD) {
+		b = b[:len(b)-1]
+	}
+	return b
+}
+
 // ReadFileTable reads the file table entirely. The iteration is stopped if
 // callback returns false.
 func (r *Reader) ReadFileTable(callback func(path string, entry FileEntryData) bool) error {
-	var err error
-	n := 0
-	buf := [256]byte{}
-	tmp := [8]byte{}
+	if r.index != nil {
+		for _, e := range r.index {
+			if !callback(e.Path, e.Entry) {
+				return ErrStopIteration
+			}
+		}
+		return nil
+	}
 
 	decoder := korean.EUCKR.NewDecoder()
+	var derr error
+	err := r.ReadRawFileTable(func(raw RawEntry) bool {
+		// EUC-KR is a superset of ASCII, which most paths are.
+		if isASCII(raw.PathBytes) {
+			return callback(string(raw.PathBytes), raw.Entry)
+		}
+		path, err := decoder.Bytes(raw.PathBytes)
+		if err != nil {
+			derr = fmt.Errorf("decoding path for file entry %d: %w", raw.Index, err)
+			return false
+		}
+		return callback(string(path), raw.Entry)
+	})
+	if derr != nil {
+		return derr
+	}
+	return err
+}
+
+// ReadRawFileTable reads the file table entirely, providing each entry as
+// stored on-disk along with its decoded form. Paths are not decoded from
+// EUC-KR. The iteration is stopped if callback returns false.
+func (r *Reader) ReadRawFileTable(callback func(raw RawEntry) bool) error {
+	return r.readRawFileTable(callback, false)
+}
+
+// readRawFileTable implements ReadRawFileTable. If tolerant is true, an
+// entry that can not be decoded is passed to callback with its Err set,
+// rather than ending the iteration with an error. The iteration still ends
+// at an entry that can not be read.
+func (r *Reader) readRawFileTable(callback func(raw RawEntry) bool, tolerant bool) error {
+	l := r.f.Entry
+	header := make([]byte, l.Len)
 
 	foffset := int64(r.t.FileListOffset)
 	for i := uint32(0); i < r.t.FileCount; i++ {
+		raw := RawEntry{Index: int(i), TableOffset: foffset}
+
 		// Read file entry.
-		entry := FileEntryData{}
-		if n, err = r.r.ReadAt(buf[:14], foffset); err != nil {
-			return fmt.Errorf("reading file entry %d: %w", i, err)
+		n, err := r.r.ReadAt(header, foffset)
+		if err != nil {
+			err = fmt.Errorf("reading file entry %d: %w", i, err)
+			if !tolerant {
+				return err
+			}
+			raw.Header, raw.Err = append([]byte{}, header[:n]...), err
+			if !callback(raw) {
+				return ErrStopIteration
+			}
+			return nil
 		}
 		foffset += int64(n)
 
+		// The path length is needed to size the rest of the entry, so the
+		// type and length are checked before deciphering.
+		pathLen := int(header[l.PathLength])
+		rawLen := 0
+		switch header[l.Type] & EntryTypeMask {
+		case 0, EntryTypeXOR, EntryTypeBasic:
+			rawLen = pathLen + 1
+		case EntryTypeXTEA:
+			if pathLen == 0 || pathLen%pyxtea.BlockSize != 0 {
+				raw.Err = fmt.Errorf("xtea path for file entry %d: %w", i, ErrInvalidPathLength)
+				if !tolerant {
+					return raw.Err
+				}
+			}
+			rawLen = pathLen
+		}
+
+		// The raw and decoded header and path of each entry share a single
+		// allocation.
+		slab := make([]byte, 2*l.Len+2*rawLen)
+		raw.Header = slab[:l.Len:l.Len]
+		raw.Deciphered = slab[l.Len : 2*l.Len : 2*l.Len]
+		raw.RawPath = slab[2*l.Len : 2*l.Len+rawLen : 2*l.Len+rawLen]
+		path := slab[2*l.Len+rawLen:]
+		copy(raw.Header, header)
+		copy(raw.Deciphered, header)
+
 		// Handle xtea encryption for the metadata.
-		useXTEA := buf[1]&0xF0 == 0x20
+		useXTEA := header[l.Type]&EntryTypeMask == EntryTypeXTEA
 		if useXTEA {
-			copy(tmp[0:4], buf[2:6])
-			copy(tmp[4:8], buf[10:14])
-			if err := pyxtea.Decipher(r.k, tmp[0:8]); err != nil {
+			if err := l.decipher(r.k, raw.Deciphered); err != nil {
 				return fmt.Errorf("decrypting xtea metadata for file entry %d: %w", i, err)
 			}
-			copy(buf[2:6], tmp[0:4])
-			copy(buf[10:14], tmp[4:8])
 		}
 
-		// Deserialize metadata.
-		if err := restruct.Unpack(buf[:14], binary.LittleEndian, &entry); err != nil {
-			return fmt.Errorf("unpacking file entry %d: %w", i, err)
-		}
+		entry := &raw.Entry
+		*entry = l.decode(raw.Deciphered)
 
 		// Default to XOR type for legacy entries.
 		if entry.Type&EntryTypeMask == 0 {
 			entry.Type |= EntryTypeXOR
 		}
 
-		path := []byte{}
+		kind := "legacy"
+		if useXTEA {
+			kind = "xtea"
+		}
+		n, err = r.r.ReadAt(raw.RawPath, foffset)
+		if err != nil {
+			err = fmt.Errorf("reading %s path for file entry %d: %w", kind, i, err)
+			if !tolerant {
+				return err
+			}
+			raw.RawPath, raw.Err = raw.RawPath[:n], err
+			if !callback(raw) {
+				return ErrStopIteration
+			}
+			return nil
+		}
+		foffset += int64(n)
+
+		// An entry with an invalid path length is passed on without a path,
+		// as the entries after it can still be read.
+		if raw.Err != nil {
+			if !callback(raw) {
+				return ErrStopIteration
+			}
+			continue
+		}
+		copy(path, raw.RawPath)
 
 		switch entry.Type & EntryTypeMask {
 		case EntryTypeXOR:
-			if n, err = r.r.ReadAt(buf[:int(entry.PathLength)+1], foffset); err != nil {
-				return fmt.Errorf("reading legacy path for file entry %d: %w", i, err)
-			}
-			foffset += int64(n)
 			entry.RealFileSize ^= 0x71
-			for j := byte(0); j < entry.PathLength; j++ {
-				buf[j] ^= 0x71
+			for j := 0; j < pathLen; j++ {
+				path[j] ^= 0x71
 			}
-			path = append(path, buf[:int(entry.PathLength)]...)
+			raw.PathBytes = path[:pathLen:pathLen]
 
 		case EntryTypeXTEA:
-			if n, err = r.r.ReadAt(buf[:int(entry.PathLength)], foffset); err != nil {
-				return fmt.Errorf("reading xtea path for file entry %d: %w", i, err)
-			}
-			foffset += int64(n)
-			if err := pyxtea.Decipher(r.k, buf[:int(entry.PathLength)]); err != nil {
+			if err := pyxtea.Decipher(r.k, path); err != nil {
 				return fmt.Errorf("decrypting xtea path for file entry %d: %w", i, err)
 			}
-			path = append(path, bytes.Trim(buf[:int(entry.PathLength)], "\xCD\x00")...)
+			raw.PathBytes = trimPadding(path)
 
 		case EntryTypeBasic:
-			if n, err = r.r.ReadAt(buf[:int(entry.PathLength)+1], foffset); err != nil {
-				return fmt.Errorf("reading legacy path for file entry %d: %w", i, err)
-			}
-			foffset += int64(n)
-			path = append(path, buf[:int(entry.PathLength)]...)
-		}
-
-		path, err = decoder.Bytes(path)
-		if err != nil {
-			panic(err)
+			raw.PathBytes = path[:pathLen:pathLen]
 		}
 
-		if !callback(string(path), entry) {
+		if !callback(raw) {
 			return ErrStopIteration
 		}
 	}
@@ -141,6 +263,9 @@ func (r *Reader) ReadFileTable(callback func(path string, entry FileEntryData) b
 
 // ReadFile reads an entire file.
 func (r *Reader) ReadFile(entry FileEntryData) ([]byte, error) {
+	if uint64(entry.Offset)+uint64(entry.PackedFileSize) > uint64(r.r.Len()) {
+		return nil, ErrEntryOutOfBounds
+	}
 	uncompressed, err := decompress(entry, r.r)
 	if err != nil {
 		return nil, err
@@ -148,6 +273,47 @@ func (r *Reader) ReadFile(entry FileEntryData) ([]byte, error) {
 	return uncompressed, nil
 }
 
+// ReadFileInto reads an entire file, appending it to dst[:0]. If dst has
+// enough capacity for the RealFileSize of the file, no allocations are made,
+// so a single buffer can be reused to read many files.
+func (r *Reader) ReadFileInto(entry FileEntryData, dst []byte) ([]byte, error) {
+	if uint64(entry.Offset)+uint64(entry.PackedFileSize) > uint64(r.r.Len()) {
+		return nil, ErrEntryOutOfBounds
+	}
+	scratch := scratchPool.Get().(*[]byte)
+	defer putScratch(scratch)
+	data, err := decompressInto(dst[:0], scratch, entry, r.r)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// isASCII reports whether b contains only ASCII characters.
+func isASCII(b []byte) bool {
+	for _, c := range b {
+		if c >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// ReadPacked reads the data of a file as stored, without decompressing it.
+func (r *Reader) ReadPacked(entry FileEntryData) ([]byte, error) {
+	if uint64(entry.Offset)+uint64(entry.PackedFileSize) > uint64(r.r.Len()) {
+		return nil, ErrEntryOutOfBounds
+	}
+	data := make([]byte, entry.PackedFileSize)
+	if len(data) == 0 {
+		return data, nil
+	}
+	if _, err := r.r.ReadAt(data, int64(entry.Offset)); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
 // CalcFileSize calculates the actual filesize of a compressed file.
 func (r *Reader) CalcFileSize(entry FileEntryData) (int64, error) {
 	return int64(entry.RealFileSize), nil
@@ -0,0 +1,325 @@
+package pak_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"runtime"
+	"testing"
+
+	"github.com/pangbox/pangfiles/crypto/pyxtea"
+	"github.com/pangbox/pangfiles/pak"
+	"github.com/pangbox/pangfiles/pak/paktest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testKey = pyxtea.KeyUS
+
+// allocBytes returns the number of bytes allocated while running fn.
+func allocBytes(fn func()) uint64 {
+	before := runtime.MemStats{}
+	after := runtime.MemStats{}
+	runtime.ReadMemStats(&before)
+	fn()
+	runtime.ReadMemStats(&after)
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+// checkAllocBound fails the test if parsing n bytes of input allocated an
+// amount of memory out of proportion with the input.
+func checkAllocBound(t *testing.T, allocated uint64, n int) {
+	t.Helper()
+	if limit := uint64(64*n + 1<<20); allocated > limit {
+		t.Fatalf("allocated %d bytes parsing %d bytes of input (limit %d)", allocated, n, limit)
+	}
+}
+
+var testEntryTypes = []byte{0, pak.EntryTypeXOR, pak.EntryTypeXTEA, pak.EntryTypeBasic}
+
+func testFiles(entryType byte) []paktest.File {
+	return []paktest.File{
+		{Path: "data", FileType: pak.FileTypeDir, EntryType: entryType},
+		{Path: "data/plain.txt", Data: []byte("plain file contents"), FileType: pak.FileTypeBasic, EntryType: entryType},
+		{Path: "data/lz.bin", Data: bytes.Repeat([]byte("lz compressed "), 32), FileType: pak.FileTypeLz, EntryType: entryType},
+		{Path: "data/lz2.bin", Data: bytes.Repeat([]byte("lz2 compressed "), 32), FileType: pak.FileTypeLz2, EntryType: entryType},
+		{Path: "한글.txt", Data: []byte("euc-kr path"), FileType: pak.FileTypeBasic, EntryType: entryType},
+	}
+}
+
+func TestReadFileTable(t *testing.T) {
+	for _, entryType := range testEntryTypes {
+		files := testFiles(entryType)
+		r, err := pak.NewReader(testKey, paktest.Pak{Key: testKey, Files: files}.Reader())
+		assert.NoError(t, err)
+
+		expectedType := entryType
+		if expectedType == 0 {
+			expectedType = pak.EntryTypeXOR
+		}
+
+		i := 0
+		err = r.ReadFileTable(func(path string, entry pak.FileEntryData) bool {
+			expected := files[i]
+			i++
+			assert.Equal(t, expected.Path, path)
+			assert.Equal(t, expected.FileType|expectedType, entry.Type)
+			if expected.FileType == pak.FileTypeDir {
+				return true
+			}
+			assert.Equal(t, uint32(len(expected.Data)), entry.RealFileSize)
+			data, err := r.ReadFile(entry)
+			assert.NoError(t, err)
+			assert.Equal(t, expected.Data, data)
+			return true
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, len(files), i)
+	}
+}
+
+func TestReadFileTableCorrupt(t *testing.T) {
+	tests := []struct {
+		corruption paktest.Corruption
+		newErr     error
+		tableErr   bool
+	}{
+		{paktest.BadSignature, pak.ErrInvalidSignature, false},
+		{paktest.TruncatedTrailer, pak.ErrInvalidSignature, false},
+		{paktest.ExtraFileCount, nil, true},
+		{paktest.TableOutOfBounds, nil, true},
+		// Only the path padding of the last entry is lost, which runs into
+		// the trailer rather than failing.
+		{paktest.TruncatedTable, nil, false},
+	}
+
+	for _, test := range tests {
+		image := paktest.Pak{Key: testKey, Files: testFiles(pak.EntryTypeXTEA), Corruptions: []paktest.Corruption{test.corruption}}
+		r, err := pak.NewReader(testKey, image.Reader())
+		if test.newErr != nil {
+			assert.ErrorIs(t, err, test.newErr)
+			continue
+		}
+		assert.NoError(t, err)
+		err = r.ReadFileTable(func(string, pak.FileEntryData) bool { return true })
+		if test.tableErr {
+			assert.Error(t, err)
+		} else {
+			assert.NoError(t, err)
+		}
+	}
+}
+
+func TestReadFileTableInvalidPathLength(t *testing.T) {
+	image := paktest.Pak{Key: testKey, Files: []paktest.File{{
+		Path:      "file.txt",
+		FileType:  pak.FileTypeBasic,
+		EntryType: pak.EntryTypeXTEA,
+		Header:    func(entry *pak.FileEntryData) { entry.PathLength = 3 },
+	}}}
+	r, err := pak.NewReader(testKey, image.Reader())
+	assert.NoError(t, err)
+	err = r.ReadFileTable(func(string, pak.FileEntryData) bool { return true })
+	assert.ErrorIs(t, err, pak.ErrInvalidPathLength)
+}
+
+func TestReadFileOutOfBounds(t *testing.T) {
+	r, err := pak.NewReader(testKey, paktest.Pak{}.Reader())
+	assert.NoError(t, err)
+	_, err = r.ReadFile(pak.FileEntryData{Type: pak.FileTypeBasic, Offset: 1, PackedFileSize: 0xFFFFFFFF})
+	assert.ErrorIs(t, err, pak.ErrEntryOutOfBounds)
+}
+
+func FuzzNewReader(f *testing.F) {
+	f.Add(paktest.Pak{}.Bytes())
+	f.Add(paktest.Pak{Key: testKey, Files: testFiles(pak.EntryTypeXTEA)}.Bytes())
+	f.Add([]byte{})
+	f.Add([]byte{0x12})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var r *pak.Reader
+		var err error
+		allocated := allocBytes(func() {
+			r, err = pak.NewReader(testKey, bytes.NewReader(data))
+		})
+		checkAllocBound(t, allocated, len(data))
+		if err != nil {
+			return
+		}
+		if len(data) < pak.TrailerLen {
+			t.Fatalf("accepted %d byte file without room for trailer", len(data))
+		}
+		trailer := data[len(data)-pak.TrailerLen:]
+		assert.Equal(t, pak.TrailerData{
+			FileListOffset: binary.LittleEndian.Uint32(trailer[0:4]),
+			FileCount:      binary.LittleEndian.Uint32(trailer[4:8]),
+			Signature:      paktest.Signature,
+		}, r.Trailer())
+	})
+}
+
+func FuzzReadFileTable(f *testing.F) {
+	for _, entryType := range testEntryTypes {
+		f.Add(paktest.Pak{Key: testKey, Files: testFiles(entryType)}.Bytes())
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r, err := pak.NewReader(testKey, bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+
+		allocated := allocBytes(func() {
+			_ = r.ReadFileTable(func(path string, entry pak.FileEntryData) bool {
+				if entry.Type&pak.FileTypeMask == pak.FileTypeDir {
+					return true
+				}
+				out, err := r.ReadFile(entry)
+				if err != nil {
+					return true
+				}
+				if entry.Type&pak.FileTypeMask == pak.FileTypeBasic && len(out) != int(entry.PackedFileSize) {
+					t.Fatalf("read %d bytes for %d byte entry", len(out), entry.PackedFileSize)
+				}
+				if len(out) > maxExpansion*int(entry.PackedFileSize) {
+					t.Fatalf("decompressed %d bytes into %d bytes", entry.PackedFileSize, len(out))
+				}
+				return true
+			})
+		})
+
+		// Each entry may read up to the entire file, so scale the bound by the
+		// maximum number of entries that fit in the input.
+		checkAllocBound(t, allocated, len(data)*(len(data)/15+1))
+	})
+}
+
+func mustReader(t *testing.T, p paktest.Pak) *pak.Reader {
+	t.Helper()
+	r, err := pak.NewReader(testKey, p.Reader())
+	if err != nil {
+		t.Fatalf("opening synthetic pak: %v", err)
+	}
+	return r
+}
+
+func TestReadFileInto(t *testing.T) {
+	for _, entryType := range testEntryTypes {
+		r := mustReader(t, paktest.Pak{Key: testKey, Files: testFiles(entryType)})
+		buf := make([]byte, 0, 4096)
+		err := r.ReadFileTable(func(path string, entry pak.FileEntryData) bool {
+			if entry.Type&pak.FileTypeMask == pak.FileTypeDir {
+				return true
+			}
+			want, err := r.ReadFile(entry)
+			require.NoError(t, err)
+
+			// Stale data in the buffer must not leak into the result.
+			for i := range buf[:cap(buf)] {
+				buf[:cap(buf)][i] = 0xFF
+			}
+			got, err := r.ReadFileInto(entry, buf[:10])
+			require.NoError(t, err)
+			assert.Equal(t, want, got, path)
+			assert.Equal(t, &buf[:1][0], &got[:1][0], "buffer not reused for %s", path)
+
+			if !raceEnabled {
+				allocs := testing.AllocsPerRun(10, func() {
+					_, err = r.ReadFileInto(entry, buf)
+				})
+				require.NoError(t, err)
+				assert.Zero(t, allocs, path)
+			}
+
+			pooled, err := r.ReadFilePooled(entry)
+			require.NoError(t, err)
+			assert.Equal(t, want, pooled.Data, path)
+			pooled.Release()
+
+			grown, err := r.ReadFileInto(entry, nil)
+			require.NoError(t, err)
+			assert.Equal(t, want, grown, path)
+			return true
+		})
+		require.NoError(t, err)
+	}
+}
+
+func TestFSReadFileInto(t *testing.T) {
+	fs := pak.NewFS(testKey)
+	require.NoError(t, fs.AddPak(mustReader(t, paktest.Pak{Key: testKey, Files: testFiles(pak.EntryTypeXTEA)})))
+
+	data, err := fs.ReadFileInto("lz.bin", make([]byte, 0, 1024))
+	require.NoError(t, err)
+	assert.Equal(t, bytes.Repeat([]byte("lz compressed "), 32), data)
+
+	pooled, err := fs.ReadFilePooled("lz2.bin")
+	require.NoError(t, err)
+	assert.Equal(t, bytes.Repeat([]byte("lz2 compressed "), 32), pooled.Data)
+	pooled.Release()
+
+	_, err = fs.ReadFileInto("missing.bin", nil)
+	assert.ErrorIs(t, err, pak.ErrNotExist)
+	_, err = fs.ReadFilePooled("missing.bin")
+	assert.ErrorIs(t, err, pak.ErrNotExist)
+}
+
+// benchReader returns a reader for a pak of small compressed files, like the
+// bulk of a client.
+func benchReader(b *testing.B) (*pak.Reader, []pak.FileEntryData) {
+	p := paktest.Pak{Key: testKey}
+	for i := 0; i < 1000; i++ {
+		p.Files = append(p.Files, paktest.File{
+			Path:      fmt.Sprintf("data/item%04d.dat", i),
+			Data:      bytes.Repeat([]byte(fmt.Sprintf("item %d ", i)), 32+i%64),
+			FileType:  pak.FileTypeLz,
+			EntryType: pak.EntryTypeXTEA,
+		})
+	}
+	r, err := pak.NewReader(testKey, p.Reader())
+	require.NoError(b, err)
+	entries := []pak.FileEntryData{}
+	require.NoError(b, r.ReadFileTable(func(path string, entry pak.FileEntryData) bool {
+		entries = append(entries, entry)
+		return true
+	}))
+	return r, entries
+}
+
+func BenchmarkReadFile(b *testing.B) {
+	r, entries := benchReader(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := r.ReadFile(entries[i%len(entries)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadFileInto(b *testing.B) {
+	r, entries := benchReader(b)
+	var buf []byte
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		data, err := r.ReadFileInto(entries[i%len(entries)], buf)
+		if err != nil {
+			b.Fatal(err)
+		}
+		buf = data
+	}
+}
+
+func BenchmarkReadFilePooled(b *testing.B) {
+	r, entries := benchReader(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		data, err := r.ReadFilePooled(entries[i%len(entries)])
+		if err != nil {
+			b.Fatal(err)
+		}
+		data.Release()
+	}
+}
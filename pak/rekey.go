@@ -0,0 +1,127 @@
+package pak
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/pangbox/pangfiles/crypto/pyxtea"
+)
+
+// RekeyOptions configures Rekey.
+type RekeyOptions struct {
+	// EntryType, if set, converts every file entry to this obfuscation;
+	// one of EntryTypeXOR, EntryTypeXTEA or EntryTypeBasic. By default,
+	// entries keep their obfuscation.
+	EntryType byte
+}
+
+// Rekey writes a copy of the pak file read by src to dst, with its file
+// table encoded using key k. File data is copied unchanged, so file offsets
+// stay the same. If opts is nil, default options are used.
+//
+// Use VerifyRekey to check the result.
+func Rekey(dst io.Writer, src *Reader, k pyxtea.Key, opts *RekeyOptions) error {
+	if !src.f.standard() {
+		return fmt.Errorf("rekeying %s format: %w", src.f.Name, ErrNonStandardLayout)
+	}
+	entryType := byte(0)
+	if opts != nil {
+		entryType = opts.EntryType & EntryTypeMask
+		switch entryType {
+		case 0, EntryTypeXOR, EntryTypeXTEA, EntryTypeBasic:
+		default:
+			return fmt.Errorf("invalid entry type 0x%02x", opts.EntryType)
+		}
+	}
+
+	w := bufio.NewWriter(dst)
+	data := io.NewSectionReader(src.r, 0, int64(src.t.FileListOffset))
+	if _, err := io.Copy(w, data); err != nil {
+		return fmt.Errorf("copying file data: %w", err)
+	}
+
+	var entryErr error
+	err := src.ReadRawFileTable(func(raw RawEntry) bool {
+		entry := raw.Entry
+		if entryType != 0 {
+			entry.Type = entry.Type&FileTypeMask | entryType
+		} else {
+			// Keep legacy entries with no entry type as they are.
+			entry.Type = raw.Header[src.f.Entry.Type]
+		}
+		max := math.MaxUint8
+		if entry.Type&EntryTypeMask == EntryTypeXTEA {
+			max -= max % pyxtea.BlockSize
+		}
+		if len(raw.PathBytes) > max {
+			entryErr = fmt.Errorf("file entry %d: %w", raw.Index, ErrPathTooLong)
+			return false
+		}
+		_, entryErr = w.Write(encodeEntry(k, entry, raw.PathBytes))
+		return entryErr == nil
+	})
+	if entryErr != nil {
+		return entryErr
+	}
+	if err != nil {
+		return fmt.Errorf("reading file table: %w", err)
+	}
+
+	trailer := [TrailerLen]byte{}
+	binary.LittleEndian.PutUint32(trailer[0:4], src.t.FileListOffset)
+	binary.LittleEndian.PutUint32(trailer[4:8], src.t.FileCount)
+	trailer[8] = src.f.Signature
+	w.Write(trailer[:])
+	return w.Flush()
+}
+
+// VerifyRekey checks that dst, read with the new key, has the same files as
+// src: the same paths, file types, offsets and sizes, in the same order.
+func VerifyRekey(src, dst *Reader) error {
+	type tableentry struct {
+		path  []byte
+		entry FileEntryData
+	}
+	entries := []tableentry{}
+	err := src.ReadRawFileTable(func(raw RawEntry) bool {
+		entries = append(entries, tableentry{raw.PathBytes, raw.Entry})
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("reading source file table: %w", err)
+	}
+
+	i := 0
+	var mismatch error
+	err = dst.ReadRawFileTable(func(raw RawEntry) bool {
+		if i >= len(entries) {
+			mismatch = fmt.Errorf("file entry %d: not in source", raw.Index)
+			return false
+		}
+		want, got := entries[i], raw.Entry
+		i++
+		switch {
+		case !bytes.Equal(want.path, raw.PathBytes):
+			mismatch = fmt.Errorf("file entry %d: path %q, want %q", raw.Index, raw.PathBytes, want.path)
+		case want.entry.Type&FileTypeMask != got.Type&FileTypeMask:
+			mismatch = fmt.Errorf("file entry %d (%q): file type 0x%02x, want 0x%02x", raw.Index, raw.PathBytes, got.Type&FileTypeMask, want.entry.Type&FileTypeMask)
+		case want.entry.Offset != got.Offset || want.entry.PackedFileSize != got.PackedFileSize || want.entry.RealFileSize != got.RealFileSize:
+			mismatch = fmt.Errorf("file entry %d (%q): data differs", raw.Index, raw.PathBytes)
+		}
+		return mismatch == nil
+	})
+	if mismatch != nil {
+		return mismatch
+	}
+	if err != nil {
+		return fmt.Errorf("reading rekeyed file table: %w", err)
+	}
+	if i != len(entries) {
+		return fmt.Errorf("rekeyed file table has %d entries, want %d", i, len(entries))
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package pak_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/pangbox/pangfiles/crypto/pyxtea"
+	"github.com/pangbox/pangfiles/pak"
+	"github.com/pangbox/pangfiles/pak/paktest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRekey(t *testing.T) {
+	for _, from := range testEntryTypes {
+		for _, to := range testEntryTypes {
+			src := mustReader(t, paktest.Pak{Key: testKey, Files: testFiles(from)})
+
+			buf := bytes.Buffer{}
+			require.NoError(t, pak.Rekey(&buf, src, pyxtea.KeyKR, &pak.RekeyOptions{EntryType: to}))
+			dst, err := pak.NewReaderFromBytes(pyxtea.KeyKR, buf.Bytes())
+			require.NoError(t, err)
+			require.NoError(t, pak.VerifyRekey(src, dst))
+
+			wantType := to
+			if to == 0 {
+				wantType = from
+			}
+			if wantType == 0 {
+				wantType = pak.EntryTypeXOR
+			}
+			err = dst.ReadFileTable(func(path string, entry pak.FileEntryData) bool {
+				assert.Equal(t, wantType, entry.Type&pak.EntryTypeMask, path)
+				if entry.Type&pak.FileTypeMask != pak.FileTypeDir {
+					want, err := src.ReadFile(entry)
+					require.NoError(t, err)
+					got, err := dst.ReadFile(entry)
+					require.NoError(t, err)
+					assert.Equal(t, want, got, path)
+				}
+				return true
+			})
+			require.NoError(t, err)
+		}
+	}
+}
+
+func TestRekeyKeepsLegacyEntries(t *testing.T) {
+	image := paktest.Pak{Key: testKey, Files: testFiles(0)}
+	src := mustReader(t, image)
+
+	buf := bytes.Buffer{}
+	require.NoError(t, pak.Rekey(&buf, src, pyxtea.KeyKR, nil))
+	assert.Equal(t, image.Bytes(), buf.Bytes())
+}
+
+func TestRekeyPathTooLong(t *testing.T) {
+	src := mustReader(t, paktest.Pak{Key: testKey, Files: []paktest.File{
+		{Path: strings.Repeat("a", 250), Data: []byte("long"), EntryType: pak.EntryTypeXOR},
+	}})
+
+	buf := bytes.Buffer{}
+	err := pak.Rekey(&buf, src, pyxtea.KeyKR, &pak.RekeyOptions{EntryType: pak.EntryTypeXTEA})
+	assert.ErrorIs(t, err, pak.ErrPathTooLong)
+}
+
+func TestVerifyRekeyWrongKey(t *testing.T) {
+	src := mustReader(t, paktest.Pak{Key: testKey, Files: testFiles(pak.EntryTypeXTEA)})
+
+	buf := bytes.Buffer{}
+	require.NoError(t, pak.Rekey(&buf, src, pyxtea.KeyKR, nil))
+	dst, err := pak.NewReaderFromBytes(testKey, buf.Bytes())
+	require.NoError(t, err)
+	assert.Error(t, pak.VerifyRekey(src, dst))
+}
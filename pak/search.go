@@ -0,0 +1,226 @@
+package pak
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// Matcher returns the start and end offsets of each match in data, in the
+// same form as regexp.Regexp.FindAllIndex.
+type Matcher func(data []byte) [][]int
+
+// BytesMatcher returns a Matcher that finds occurrences of any of the given
+// byte patterns. Overlapping matches are not reported.
+func BytesMatcher(patterns ...[]byte) Matcher {
+	return func(data []byte) [][]int {
+		matches := [][]int{}
+		for pos := 0; pos < len(data); {
+			start, end := -1, -1
+			for _, pattern := range patterns {
+				if len(pattern) == 0 {
+					continue
+				}
+				i := bytes.Index(data[pos:], pattern)
+				if i != -1 && (start == -1 || pos+i < start) {
+					start, end = pos+i, pos+i+len(pattern)
+				}
+			}
+			if start == -1 {
+				break
+			}
+			matches = append(matches, []int{start, end})
+			pos = end
+		}
+		return matches
+	}
+}
+
+// RegexpMatcher returns a Matcher that finds matches of a regular expression.
+func RegexpMatcher(re *regexp.Regexp) Matcher {
+	return func(data []byte) [][]int {
+		return re.FindAllIndex(data, -1)
+	}
+}
+
+// Match is an occurrence of a pattern in a file.
+type Match struct {
+	// Path is the path of the file.
+	Path string
+	// Offset is the offset of the match in the decompressed file.
+	Offset int
+	// Data holds the matched bytes.
+	Data []byte
+	// Before and After hold the bytes surrounding the match, up to the
+	// amount of context requested.
+	Before []byte
+	After  []byte
+}
+
+// SearchOptions configures FS.Search.
+type SearchOptions struct {
+	// Include, if not empty, limits the search to files matching one of
+	// the patterns, as used by path.Match. Patterns without a slash are
+	// matched against the base name of files, others against their path.
+	Include []string
+
+	// Exclude skips files matching one of the patterns, as with Include.
+	Exclude []string
+
+	// SkipExts skips files with one of the extensions, such as ".dds".
+	// Extensions are compared case-insensitively.
+	SkipExts []string
+
+	// Context is the number of bytes of context to return around each
+	// match.
+	Context int
+
+	// Workers is the number of files searched in parallel. Defaults to the
+	// number of CPUs.
+	Workers int
+}
+
+// matchPath returns true if a file path matches one of the patterns.
+func matchPath(patterns []string, fullpath string) bool {
+	for _, pattern := range patterns {
+		subject := fullpath
+		if !strings.Contains(pattern, "/") {
+			subject = basename(fullpath)
+		}
+		if ok, _ := path.Match(pattern, subject); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// filter returns true if a file should be searched.
+func (opts *SearchOptions) filter(fullpath string) bool {
+	if len(opts.Include) > 0 && !matchPath(opts.Include, fullpath) {
+		return false
+	}
+	if matchPath(opts.Exclude, fullpath) {
+		return false
+	}
+	ext := path.Ext(fullpath)
+	for _, skip := range opts.SkipExts {
+		if strings.EqualFold(ext, skip) {
+			return false
+		}
+	}
+	return true
+}
+
+// searchqueue is the size of the queue of matches for each file. Workers
+// block once it is full, until the file is next in line to be reported.
+const searchqueue = 64
+
+// searchresult holds the matches of a single file as they are found. err
+// is set before matches is closed.
+type searchresult struct {
+	matches chan Match
+	err     error
+}
+
+// Search searches the decompressed contents of every file in the filesystem
+// using m. Files are searched in parallel, but fn is called from a single
+// goroutine, in path order, as matches are found. The slices in each Match
+// hold a copy of the match and its context, and do not keep the file data
+// alive. If files fail to be read, the search continues and the first error
+// is returned.
+func (fs *FS) Search(m Matcher, opts *SearchOptions, fn func(Match)) error {
+	if opts == nil {
+		opts = &SearchOptions{}
+	}
+	for _, pattern := range append(opts.Include, opts.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	t := fs.current()
+	files := []fsfile{}
+	for i, p := range t.files.paths {
+		if opts.filter(p) {
+			files = append(files, t.fileat(i))
+		}
+	}
+
+	// Each file has its own queue of matches, so that results can be
+	// delivered in order while later files are still being searched.
+	results := make([]searchresult, len(files))
+	for i := range results {
+		results[i].matches = make(chan Match, searchqueue)
+	}
+	jobs := make(chan int)
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Matches are copied out of the file data, so the buffer can
+			// be reused for the next file.
+			var buf []byte
+			for i := range jobs {
+				buf, results[i].err = searchfile(files[i], m, opts.Context, buf, results[i].matches)
+				close(results[i].matches)
+			}
+		}()
+	}
+	go func() {
+		for i := range files {
+			jobs <- i
+		}
+		close(jobs)
+	}()
+
+	var firsterr error
+	for i := range files {
+		for match := range results[i].matches {
+			fn(match)
+		}
+		if err := results[i].err; err != nil && firsterr == nil {
+			firsterr = fmt.Errorf("reading %q: %w", files[i].path, err)
+		}
+	}
+	wg.Wait()
+	return firsterr
+}
+
+// searchfile searches the data of a single file, sending each match to out.
+// The file is read into buf, which is returned for reuse.
+func searchfile(file fsfile, m Matcher, context int, buf []byte, out chan<- Match) ([]byte, error) {
+	data, err := file.reader.ReadFileInto(file.entry, buf)
+	if err != nil {
+		return buf, err
+	}
+	for _, loc := range m(data) {
+		start, end := loc[0], loc[1]
+		before, after := start-context, end+context
+		if before < 0 {
+			before = 0
+		}
+		if after > len(data) {
+			after = len(data)
+		}
+		region := make([]byte, after-before)
+		copy(region, data[before:after])
+		start, end = start-before, end-before
+		out <- Match{
+			Path:   file.path,
+			Offset: loc[0],
+			Data:   region[start:end:end],
+			Before: region[:start:start],
+			After:  region[end:],
+		}
+	}
+	return data, nil
+}
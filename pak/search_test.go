@@ -0,0 +1,100 @@
+package pak_test
+
+import (
+	"bytes"
+	"regexp"
+	"testing"
+
+	"github.com/pangbox/pangfiles/pak"
+	"github.com/pangbox/pangfiles/pak/paktest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func searchTestFS(t *testing.T) *pak.FS {
+	fs := pak.NewFS(testKey)
+	require.NoError(t, fs.AddPak(mustReader(t, paktest.Pak{Key: testKey, Files: []paktest.File{
+		{Path: "data/item.iff", Data: []byte("..tex_ball.dds..tex_club.dds"), FileType: pak.FileTypeLz, EntryType: pak.EntryTypeXTEA},
+		{Path: "model/ball.mpet", Data: []byte("mesh tex_ball.dds"), FileType: pak.FileTypeLz2, EntryType: pak.EntryTypeXTEA},
+		{Path: "ui/tex_ball.dds", Data: []byte("DDS |tex_ball.dds"), EntryType: pak.EntryTypeXTEA},
+	}})))
+	return fs
+}
+
+func searchPaths(t *testing.T, fs *pak.FS, m pak.Matcher, opts *pak.SearchOptions) []string {
+	t.Helper()
+	paths := []string{}
+	require.NoError(t, fs.Search(m, opts, func(match pak.Match) {
+		paths = append(paths, match.Path)
+	}))
+	return paths
+}
+
+func TestSearch(t *testing.T) {
+	fs := searchTestFS(t)
+
+	matches := []pak.Match{}
+	err := fs.Search(pak.BytesMatcher([]byte("tex_ball")), &pak.SearchOptions{Context: 2, Workers: 2}, func(m pak.Match) {
+		matches = append(matches, m)
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []pak.Match{
+		{Path: "data/item.iff", Offset: 2, Data: []byte("tex_ball"), Before: []byte(".."), After: []byte(".d")},
+		{Path: "model/ball.mpet", Offset: 5, Data: []byte("tex_ball"), Before: []byte("h "), After: []byte(".d")},
+		{Path: "ui/tex_ball.dds", Offset: 5, Data: []byte("tex_ball"), Before: []byte(" |"), After: []byte(".d")},
+	}, matches)
+}
+
+func TestSearchMatchers(t *testing.T) {
+	fs := searchTestFS(t)
+
+	assert.Equal(t,
+		[]string{"data/item.iff", "data/item.iff", "model/ball.mpet", "ui/tex_ball.dds"},
+		searchPaths(t, fs, pak.RegexpMatcher(regexp.MustCompile(`tex_[a-z]+\.dds`)), nil))
+	assert.Equal(t,
+		[]string{"data/item.iff", "ui/tex_ball.dds"},
+		searchPaths(t, fs, pak.BytesMatcher([]byte("club"), []byte("DDS")), nil))
+}
+
+func TestSearchFilters(t *testing.T) {
+	fs := searchTestFS(t)
+	m := pak.BytesMatcher([]byte("tex_ball"))
+
+	assert.Equal(t, []string{"model/ball.mpet"}, searchPaths(t, fs, m, &pak.SearchOptions{Include: []string{"model/*"}}))
+	assert.Equal(t, []string{"data/item.iff"}, searchPaths(t, fs, m, &pak.SearchOptions{Include: []string{"*.iff"}}))
+	assert.Equal(t, []string{"data/item.iff", "model/ball.mpet"}, searchPaths(t, fs, m, &pak.SearchOptions{SkipExts: []string{".DDS"}}))
+	assert.Equal(t, []string{"ui/tex_ball.dds"}, searchPaths(t, fs, m, &pak.SearchOptions{Exclude: []string{"data/*", "*.mpet"}}))
+
+	err := fs.Search(m, &pak.SearchOptions{Include: []string{"["}}, func(pak.Match) {})
+	assert.Error(t, err)
+}
+
+func TestSearchCopiesMatches(t *testing.T) {
+	big := bytes.Repeat([]byte{'.'}, 1<<20)
+	copy(big[1000:], "tex_ball")
+	many := bytes.Repeat([]byte("ab"), 500)
+	fs := pak.NewFS(testKey)
+	require.NoError(t, fs.AddPak(mustReader(t, paktest.Pak{Key: testKey, Files: []paktest.File{
+		{Path: "a/big.bin", Data: big, FileType: pak.FileTypeLz, EntryType: pak.EntryTypeXTEA},
+		{Path: "b/many.bin", Data: many, EntryType: pak.EntryTypeXTEA},
+	}})))
+
+	matches := []pak.Match{}
+	err := fs.Search(pak.BytesMatcher([]byte("tex_ball"), []byte("b")), &pak.SearchOptions{Context: 2, Workers: 1}, func(m pak.Match) {
+		matches = append(matches, m)
+	})
+	require.NoError(t, err)
+	require.Len(t, matches, 1+len(many)/2)
+
+	// Only the match and its context are kept, not the file data.
+	first := matches[0]
+	assert.Equal(t, pak.Match{Path: "a/big.bin", Offset: 1000, Data: []byte("tex_ball"), Before: []byte(".."), After: []byte("..")}, first)
+	assert.Equal(t, 2, cap(first.Before))
+	assert.Equal(t, 8, cap(first.Data))
+	assert.Equal(t, 2, cap(first.After))
+
+	for i, m := range matches[1:] {
+		assert.Equal(t, "b/many.bin", m.Path)
+		assert.Equal(t, 2*i+1, m.Offset)
+	}
+}
@@ -0,0 +1,458 @@
+package pak
+
+import (
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// fsfile is a file in the filesystem. It is a copy of a row of a filetable,
+// so changes to it do not affect the tree it came from.
+type fsfile struct {
+	path   string
+	entry  FileEntryData
+	reader *Reader
+	inode  uint64
+}
+
+func (f *fsfile) size() (int64, error) {
+	return f.reader.CalcFileSize(f.entry)
+}
+
+// fsdir is a directory in the filesystem. Directories are implied by the
+// paths of files, but may also have an entry of their own in a file table.
+// Like fsfile, it is a copy of a row of a dirtable.
+type fsdir struct {
+	path  string
+	inode uint64
+
+	// entry and reader are set if the directory has a file table entry.
+	entry  *FileEntryData
+	reader *Reader
+}
+
+// noreader marks rows of a dirtable without a file table entry.
+const noreader = -1
+
+// filetable holds the files of a tree as parallel arrays, sorted by path.
+// Readers are stored as indexes into the readers of the tree.
+type filetable struct {
+	paths   []string
+	entries []FileEntryData
+	readers []int32
+	inodes  []uint64
+}
+
+func (f *filetable) len() int {
+	return len(f.paths)
+}
+
+func (f *filetable) append(path string, entry FileEntryData, reader int32, inode uint64) {
+	f.paths = append(f.paths, path)
+	f.entries = append(f.entries, entry)
+	f.readers = append(f.readers, reader)
+	f.inodes = append(f.inodes, inode)
+}
+
+// dirtable holds the directories of a tree as parallel arrays, sorted by
+// path. Directories without a file table entry have a reader of noreader.
+type dirtable struct {
+	paths   []string
+	entries []FileEntryData
+	readers []int32
+	inodes  []uint64
+}
+
+func (d *dirtable) len() int {
+	return len(d.paths)
+}
+
+func (d *dirtable) append(path string, entry FileEntryData, reader int32, inode uint64) {
+	d.paths = append(d.paths, path)
+	d.entries = append(d.entries, entry)
+	d.readers = append(d.readers, reader)
+	d.inodes = append(d.inodes, inode)
+}
+
+// fstree is a snapshot of the contents of an FS. Once published, a tree is
+// never modified; changes are made by building a new tree, which then
+// replaces it. Only paths, layers and byname are shared between trees, as
+// they are never written to after a tree is built.
+type fstree struct {
+	files   filetable
+	dirs    dirtable
+	readers []*Reader
+
+	// layers holds the file table of each reader, so that the tree can be
+	// rebuilt without reading the file tables again.
+	layers []*layer
+
+	// byname maps file base names to indexes into files. Files are found
+	// by base name, as they are by the client.
+	byname map[string]int32
+}
+
+// newtree returns a tree containing only the root directory.
+func (fs *FS) newtree() *fstree {
+	t := &fstree{byname: map[string]int32{}}
+	t.dirs.append("", FileEntryData{}, noreader, fs.newinodes(1))
+	return t
+}
+
+// newinodes allocates n consecutive inode numbers, returning the first.
+func (fs *FS) newinodes(n int) uint64 {
+	return atomic.AddUint64(&fs.inodes, uint64(n)) - uint64(n) + 1
+}
+
+func (t *fstree) fileat(i int) fsfile {
+	return fsfile{t.files.paths[i], t.files.entries[i], t.readers[t.files.readers[i]], t.files.inodes[i]}
+}
+
+func (t *fstree) dirat(i int) fsdir {
+	dir := fsdir{path: t.dirs.paths[i], inode: t.dirs.inodes[i]}
+	if r := t.dirs.readers[i]; r != noreader {
+		entry := t.dirs.entries[i]
+		dir.entry, dir.reader = &entry, t.readers[r]
+	}
+	return dir
+}
+
+// root returns the root directory.
+func (t *fstree) root() fsdir {
+	return t.dirat(0)
+}
+
+// searchfiles returns the index of the first file with a path not less
+// than p.
+func (t *fstree) searchfiles(p string) int {
+	return sort.SearchStrings(t.files.paths, p)
+}
+
+// searchdirs returns the index of the first directory with a path not less
+// than p.
+func (t *fstree) searchdirs(p string) int {
+	return sort.SearchStrings(t.dirs.paths, p)
+}
+
+// dir returns the directory at path.
+func (t *fstree) dir(path string) (fsdir, bool) {
+	if i := t.searchdirs(path); i < t.dirs.len() && t.dirs.paths[i] == path {
+		return t.dirat(i), true
+	}
+	return fsdir{}, false
+}
+
+// file returns the file at path.
+func (t *fstree) file(path string) (fsfile, bool) {
+	if i := t.searchfiles(path); i < t.files.len() && t.files.paths[i] == path {
+		return t.fileat(i), true
+	}
+	return fsfile{}, false
+}
+
+// filebyname returns the file with the given base name.
+func (t *fstree) filebyname(name string) (fsfile, bool) {
+	if i, ok := t.byname[name]; ok {
+		return t.fileat(int(i)), true
+	}
+	return fsfile{}, false
+}
+
+// allfiles returns the files in every layer of the tree, sorted by path.
+// Unlike the files of the tree, files with the same base name in different
+// directories are all kept; only a file at the same path replaces an
+// earlier one. Trees built without layers, such as flat views, return
+// their own files.
+func (t *fstree) allfiles() []pendingentry {
+	files := []pendingentry{}
+	if len(t.layers) != len(t.readers) {
+		for i, p := range t.files.paths {
+			files = append(files, pendingentry{p, t.files.entries[i], t.files.readers[i]})
+		}
+		return files
+	}
+	index := map[string]int{}
+	for i, l := range t.layers {
+		for j, p := range l.files.paths {
+			f := pendingentry{p, l.files.entries[j], int32(i)}
+			if k, ok := index[p]; ok {
+				files[k] = f
+				continue
+			}
+			index[p] = len(files)
+			files = append(files, f)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].path < files[j].path })
+	return files
+}
+
+// visible returns true if f, from allfiles, is the file the tree serves under
+// its base name, as returned by filebyname.
+func (t *fstree) visible(f pendingentry) bool {
+	i, ok := t.byname[basename(f.path)]
+	return ok && t.files.readers[i] == f.reader && t.files.entries[i] == f.entry
+}
+
+// pendingentry is a file table entry waiting to be added to a tree.
+type pendingentry struct {
+	path   string
+	entry  FileEntryData
+	reader int32
+}
+
+// layer is the file table of a pak, split into files and directories. It
+// is never modified once read, and is shared between trees.
+type layer struct {
+	files, dirs entrylist
+}
+
+// entrylist holds file table entries as parallel arrays, in table order.
+type entrylist struct {
+	paths   []string
+	entries []FileEntryData
+}
+
+func (e *entrylist) append(path string, entry FileEntryData) {
+	e.paths = append(e.paths, path)
+	e.entries = append(e.entries, entry)
+}
+
+// collect reads the file tables of readers, returning a layer for each.
+func collect(readers []*Reader) ([]*layer, error) {
+	layers := make([]*layer, 0, len(readers))
+	for _, reader := range readers {
+		l := &layer{}
+		err := reader.ReadFileTable(func(path string, entry FileEntryData) bool {
+			if entry.Type&FileTypeMask == FileTypeDir {
+				l.dirs.append(cleanpath(path), entry)
+			} else {
+				l.files.append(path, entry)
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		compactpaths(l.files.paths)
+		compactpaths(l.dirs.paths)
+		layers = append(layers, l)
+	}
+	return layers, nil
+}
+
+// pending returns the file and directory entries of layers in order.
+// Readers are numbered starting from first.
+func pending(layers []*layer, first int) (files, dirs []pendingentry) {
+	for i, l := range layers {
+		index := int32(first + i)
+		for j, p := range l.files.paths {
+			files = append(files, pendingentry{p, l.files.entries[j], index})
+		}
+		for j, p := range l.dirs.paths {
+			dirs = append(dirs, pendingentry{p, l.dirs.entries[j], index})
+		}
+	}
+	return files, dirs
+}
+
+// build returns a new tree with the paks of readers layered on top of base.
+func (fs *FS) build(base *fstree, readers []*Reader) (*fstree, error) {
+	layers, err := collect(readers)
+	if err != nil {
+		return nil, err
+	}
+	return fs.buildlayers(base, readers, layers), nil
+}
+
+// buildlayers returns a new tree with the already read layers of readers
+// added on top of base.
+func (fs *FS) buildlayers(base *fstree, readers []*Reader, layers []*layer) *fstree {
+	files, dirs := pending(layers, len(base.readers))
+	all := make([]*Reader, 0, len(base.readers)+len(readers))
+	all = append(append(all, base.readers...), readers...)
+	t := fs.buildentries(base, all, files, dirs)
+	t.layers = make([]*layer, 0, len(all))
+	t.layers = append(append(t.layers, base.layers...), layers...)
+	return t
+}
+
+// buildentries returns a new tree with files and dirs added on top of base,
+// with the given readers. Files replace earlier files with the same base
+// name, keeping the earlier path, and directory entries replace earlier
+// entries with the same path. Entries are resolved in a single pass, and
+// only new paths are sorted.
+func (fs *FS) buildentries(base *fstree, readers []*Reader, files, dirs []pendingentry) *fstree {
+	t := &fstree{readers: readers}
+
+	// Resolve files against the base tree by name. Overrides are applied
+	// to a copy of the base table; new files are appended to another.
+	t.files = filetable{
+		paths:   base.files.paths,
+		entries: append([]FileEntryData{}, base.files.entries...),
+		readers: append([]int32{}, base.files.readers...),
+		inodes:  append([]uint64{}, base.files.inodes...),
+	}
+	added := filetable{}
+	addedbyname := make(map[string]int32, len(files))
+	dirpaths := map[string]bool{}
+	lastdir := ""
+	for _, f := range files {
+		// Directories are created for every path, even if the file
+		// replaces one at another path. Files are mostly grouped by
+		// directory, so repeats are skipped cheaply.
+		if i := strings.LastIndexByte(f.path, '/'); i != -1 && f.path[:i] != lastdir {
+			lastdir = f.path[:i]
+			adddirpaths(dirpaths, lastdir)
+		}
+		name := basename(f.path)
+		if i, ok := base.byname[name]; ok {
+			t.files.entries[i], t.files.readers[i] = f.entry, f.reader
+		} else if i, ok := addedbyname[name]; ok {
+			added.entries[i], added.readers[i] = f.entry, f.reader
+		} else {
+			addedbyname[name] = int32(added.len())
+			added.append(f.path, f.entry, f.reader, 0)
+		}
+	}
+
+	if added.len() == 0 {
+		// Indexes are unchanged, so the name map can be shared.
+		t.byname = base.byname
+	} else {
+		inode := fs.newinodes(added.len())
+		for i := range added.inodes {
+			added.inodes[i] = inode + uint64(i)
+		}
+		t.files = mergefiles(t.files, sortfiles(added))
+		t.byname = make(map[string]int32, t.files.len())
+		for i, p := range t.files.paths {
+			t.byname[basename(p)] = int32(i)
+		}
+	}
+
+	// Directories are few compared to files, so they are simply merged
+	// through a map.
+	for _, d := range dirs {
+		adddirpaths(dirpaths, d.path)
+	}
+	dirindex := make(map[string]int, base.dirs.len())
+	for i, p := range base.dirs.paths {
+		dirindex[p] = i
+	}
+	t.dirs = dirtable{
+		paths:   append([]string{}, base.dirs.paths...),
+		entries: append([]FileEntryData{}, base.dirs.entries...),
+		readers: append([]int32{}, base.dirs.readers...),
+		inodes:  append([]uint64{}, base.dirs.inodes...),
+	}
+	adddir := func(p string) int {
+		if i, ok := dirindex[p]; ok {
+			return i
+		}
+		dirindex[p] = t.dirs.len()
+		t.dirs.append(p, FileEntryData{}, noreader, fs.newinodes(1))
+		return dirindex[p]
+	}
+	for p := range dirpaths {
+		adddir(p)
+	}
+	for _, d := range dirs {
+		i := adddir(d.path)
+		t.dirs.entries[i], t.dirs.readers[i] = d.entry, d.reader
+	}
+	if t.dirs.len() != base.dirs.len() {
+		t.dirs = sortdirs(t.dirs)
+	}
+	return t
+}
+
+// adddirpaths adds dir and each of its parents to dirpaths.
+func adddirpaths(dirpaths map[string]bool, dir string) {
+	for i := 0; i < len(dir); i++ {
+		if dir[i] == '/' {
+			dirpaths[dir[:i]] = true
+		}
+	}
+	dirpaths[dir] = true
+}
+
+// sortfiles returns a copy of f sorted by path.
+func sortfiles(f filetable) filetable {
+	order := make([]int32, f.len())
+	for i := range order {
+		order[i] = int32(i)
+	}
+	sort.Slice(order, func(i, j int) bool { return f.paths[order[i]] < f.paths[order[j]] })
+
+	sorted := filetable{
+		paths:   make([]string, 0, len(order)),
+		entries: make([]FileEntryData, 0, len(order)),
+		readers: make([]int32, 0, len(order)),
+		inodes:  make([]uint64, 0, len(order)),
+	}
+	for _, i := range order {
+		sorted.append(f.paths[i], f.entries[i], f.readers[i], f.inodes[i])
+	}
+	return sorted
+}
+
+// mergefiles merges two tables sorted by path with no paths in common. The
+// paths of the result are compacted, so the table holds few heap objects no
+// matter how many files it has.
+func mergefiles(a, b filetable) filetable {
+	n := a.len() + b.len()
+	m := filetable{
+		paths:   make([]string, 0, n),
+		entries: make([]FileEntryData, 0, n),
+		readers: make([]int32, 0, n),
+		inodes:  make([]uint64, 0, n),
+	}
+	i, j := 0, 0
+	for i < a.len() || j < b.len() {
+		if j >= b.len() || (i < a.len() && a.paths[i] < b.paths[j]) {
+			m.append(a.paths[i], a.entries[i], a.readers[i], a.inodes[i])
+			i++
+		} else {
+			m.append(b.paths[j], b.entries[j], b.readers[j], b.inodes[j])
+			j++
+		}
+	}
+
+	compactpaths(m.paths)
+	return m
+}
+
+// compactpaths copies paths into a single allocation, so that they are held
+// by one heap object no matter how many there are.
+func compactpaths(paths []string) {
+	size := 0
+	for _, p := range paths {
+		size += len(p)
+	}
+	all := strings.Builder{}
+	all.Grow(size)
+	for _, p := range paths {
+		all.WriteString(p)
+	}
+	s, offset := all.String(), 0
+	for i, p := range paths {
+		paths[i] = s[offset : offset+len(p)]
+		offset += len(p)
+	}
+}
+
+// sortdirs returns a copy of d sorted by path.
+func sortdirs(d dirtable) dirtable {
+	order := make([]int, d.len())
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return d.paths[order[i]] < d.paths[order[j]] })
+
+	sorted := dirtable{}
+	for _, i := range order {
+		sorted.append(d.paths[i], d.entries[i], d.readers[i], d.inodes[i])
+	}
+	return sorted
+}
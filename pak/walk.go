@@ -0,0 +1,206 @@
+package pak
+
+import (
+	"errors"
+	"path"
+	"sort"
+	"strings"
+)
+
+// SkipDir can be returned by the function passed to Walk to skip the
+// contents of the directory it was called for.
+var SkipDir = errors.New("skip this directory")
+
+// DirEntry describes a file or directory in the filesystem.
+type DirEntry struct {
+	// Name is the base name of the entry.
+	Name string
+	// Path is the full path of the entry. The root directory has an empty
+	// path.
+	Path string
+	// IsDir is true for directories.
+	IsDir bool
+	// Size is the decompressed size of files.
+	Size int64
+}
+
+// cleanpath converts a path to the form used in the filesystem, which has no
+// leading or trailing slashes.
+func cleanpath(p string) string {
+	return strings.Trim(path.Clean("/"+p), "/")
+}
+
+// readdir returns the directories and files directly within the directory
+// at dirpath, in path order.
+func (t *fstree) readdir(dirpath string) ([]fsdir, []fsfile) {
+	prefix := dirpath
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	dirs := []fsdir{}
+	for i := t.searchdirs(prefix); i < t.dirs.len(); i++ {
+		subdir := t.dirs.paths[i]
+		if !strings.HasPrefix(subdir, prefix) {
+			break
+		}
+		if subdir == "" || strings.ContainsRune(subdir[len(prefix):], '/') {
+			continue
+		}
+		dirs = append(dirs, t.dirat(i))
+	}
+
+	files := []fsfile{}
+	for i := t.searchfiles(prefix); i < t.files.len(); i++ {
+		file := t.files.paths[i]
+		if !strings.HasPrefix(file, prefix) {
+			break
+		}
+		if strings.ContainsRune(file[len(prefix):], '/') {
+			continue
+		}
+		files = append(files, t.fileat(i))
+	}
+	return dirs, files
+}
+
+func direntry(dir fsdir) DirEntry {
+	return DirEntry{Name: basename(dir.path), Path: dir.path, IsDir: true}
+}
+
+func fileentry(file fsfile) DirEntry {
+	size, _ := file.size()
+	return DirEntry{Name: basename(file.path), Path: file.path, Size: size}
+}
+
+// direntries returns the entries of a directory of t, sorted by name.
+func (t *fstree) direntries(dirpath string) []DirEntry {
+	dirs, files := t.readdir(dirpath)
+	entries := make([]DirEntry, 0, len(dirs)+len(files))
+	for _, dir := range dirs {
+		entries = append(entries, direntry(dir))
+	}
+	for _, file := range files {
+		entries = append(entries, fileentry(file))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries
+}
+
+// ReadDir returns the entries of the directory at dirpath, sorted by name.
+func (fs *FS) ReadDir(dirpath string) ([]DirEntry, error) {
+	t := fs.current()
+	dirpath = cleanpath(dirpath)
+	if _, ok := t.dir(dirpath); !ok {
+		return nil, ErrNotExist
+	}
+	return t.direntries(dirpath), nil
+}
+
+// Stat returns the entry for the file or directory at p.
+func (fs *FS) Stat(p string) (DirEntry, error) {
+	t := fs.current()
+	p = cleanpath(p)
+	if dir, ok := t.dir(p); ok {
+		return direntry(dir), nil
+	}
+	if file, ok := t.file(p); ok {
+		return fileentry(file), nil
+	}
+	return DirEntry{}, ErrNotExist
+}
+
+// Entry returns the file table entry of the file or directory at p. ok is
+// false if there is nothing at p, or if p is a directory that is only implied
+// by the paths of files.
+func (fs *FS) Entry(p string) (entry FileEntryData, ok bool) {
+	t := fs.current()
+	p = cleanpath(p)
+	if dir, ok := t.dir(p); ok {
+		if dir.entry == nil {
+			return FileEntryData{}, false
+		}
+		return *dir.entry, true
+	}
+	if file, ok := t.file(p); ok {
+		return file.entry, true
+	}
+	return FileEntryData{}, false
+}
+
+// Walk calls fn for the file or directory at root, and for everything below
+// it, in lexical order. If root does not exist, fn is called with
+// ErrNotExist. If fn returns SkipDir for a directory, its contents are
+// skipped. If fn returns SkipDir for a file, the remaining entries of the
+// directory containing it are skipped, as with filepath.Walk. Any other error
+// stops the walk and is returned.
+func (fs *FS) Walk(root string, fn func(path string, entry DirEntry, err error) error) error {
+	t := fs.current()
+	root = cleanpath(root)
+
+	var entry DirEntry
+	if dir, ok := t.dir(root); ok {
+		entry = direntry(dir)
+	} else if file, ok := t.file(root); ok {
+		entry = fileentry(file)
+	} else {
+		return fn(root, DirEntry{}, ErrNotExist)
+	}
+
+	err := walk(t, entry, fn)
+	if err == SkipDir {
+		return nil
+	}
+	return err
+}
+
+func walk(t *fstree, entry DirEntry, fn func(path string, entry DirEntry, err error) error) error {
+	if err := fn(entry.Path, entry, nil); err != nil || !entry.IsDir {
+		return err
+	}
+	for _, child := range t.direntries(entry.Path) {
+		err := walk(t, child, fn)
+		if err == SkipDir {
+			if child.IsDir {
+				continue
+			}
+			// SkipDir from a file skips the rest of this directory only.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Glob returns the paths of all files and directories matching pattern, in
+// lexical order, using the syntax of path.Match. The only possible error is
+// path.ErrBadPattern.
+func (fs *FS) Glob(pattern string) ([]string, error) {
+	t := fs.current()
+	pattern = strings.TrimPrefix(pattern, "/")
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+
+	// Only paths starting with the literal part of the pattern can match.
+	prefix := pattern
+	if i := strings.IndexAny(pattern, `*?[\`); i != -1 {
+		prefix = pattern[:i]
+	}
+
+	matches := []string{}
+	for i := t.searchdirs(prefix); i < t.dirs.len() && strings.HasPrefix(t.dirs.paths[i], prefix); i++ {
+		if ok, _ := path.Match(pattern, t.dirs.paths[i]); ok && t.dirs.paths[i] != "" {
+			matches = append(matches, t.dirs.paths[i])
+		}
+	}
+	for i := t.searchfiles(prefix); i < t.files.len() && strings.HasPrefix(t.files.paths[i], prefix); i++ {
+		if ok, _ := path.Match(pattern, t.files.paths[i]); ok {
+			matches = append(matches, t.files.paths[i])
+		}
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
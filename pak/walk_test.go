@@ -0,0 +1,131 @@
+package pak_test
+
+import (
+	"path"
+	"testing"
+
+	"github.com/pangbox/pangfiles/pak"
+	"github.com/pangbox/pangfiles/pak/paktest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func walkTestFS(t *testing.T) *pak.FS {
+	fs := pak.NewFS(testKey)
+	require.NoError(t, fs.AddPak(mustReader(t, paktest.Pak{Key: testKey, Files: []paktest.File{
+		{Path: "data/item.iff", Data: []byte("item")},
+		{Path: "data/sub/a.dat", Data: []byte("a")},
+		{Path: "data-extra.txt", Data: []byte("extra")},
+		{Path: "model/ball.mpet", Data: []byte("ball")},
+		{Path: "model/club.mpet", Data: []byte("club")},
+		{Path: "readme.txt", Data: []byte("readme")},
+	}})))
+	return fs
+}
+
+func TestReadDir(t *testing.T) {
+	fs := walkTestFS(t)
+
+	entries, err := fs.ReadDir("/")
+	require.NoError(t, err)
+	assert.Equal(t, []pak.DirEntry{
+		{Name: "data", Path: "data", IsDir: true},
+		{Name: "data-extra.txt", Path: "data-extra.txt", Size: 5},
+		{Name: "model", Path: "model", IsDir: true},
+		{Name: "readme.txt", Path: "readme.txt", Size: 6},
+	}, entries)
+
+	entries, err = fs.ReadDir("data/")
+	require.NoError(t, err)
+	assert.Equal(t, []pak.DirEntry{
+		{Name: "item.iff", Path: "data/item.iff", Size: 4},
+		{Name: "sub", Path: "data/sub", IsDir: true},
+	}, entries)
+
+	_, err = fs.ReadDir("missing")
+	assert.ErrorIs(t, err, pak.ErrNotExist)
+	_, err = fs.ReadDir("readme.txt")
+	assert.ErrorIs(t, err, pak.ErrNotExist)
+}
+
+func TestWalk(t *testing.T) {
+	fs := walkTestFS(t)
+
+	visited := []string{}
+	err := fs.Walk("", func(p string, entry pak.DirEntry, err error) error {
+		require.NoError(t, err)
+		visited = append(visited, p)
+		if entry.Name == "sub" {
+			return pak.SkipDir
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"", "data", "data/item.iff", "data/sub", "data-extra.txt",
+		"model", "model/ball.mpet", "model/club.mpet", "readme.txt",
+	}, visited)
+
+	// SkipDir from a file skips the rest of its directory.
+	visited = visited[:0]
+	err = fs.Walk("model", func(p string, entry pak.DirEntry, err error) error {
+		visited = append(visited, p)
+		if path.Ext(p) == ".mpet" {
+			return pak.SkipDir
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"model", "model/ball.mpet"}, visited)
+
+	// The walk continues after the directory containing the file.
+	visited = visited[:0]
+	err = fs.Walk("", func(p string, entry pak.DirEntry, err error) error {
+		visited = append(visited, p)
+		if p == "data/item.iff" {
+			return pak.SkipDir
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"", "data", "data/item.iff", "data-extra.txt",
+		"model", "model/ball.mpet", "model/club.mpet", "readme.txt",
+	}, visited)
+
+	// A file at the root of the walk can return SkipDir too.
+	err = fs.Walk("readme.txt", func(p string, entry pak.DirEntry, err error) error {
+		return pak.SkipDir
+	})
+	assert.NoError(t, err)
+
+	err = fs.Walk("missing", func(p string, entry pak.DirEntry, err error) error {
+		return err
+	})
+	assert.ErrorIs(t, err, pak.ErrNotExist)
+}
+
+func TestGlob(t *testing.T) {
+	fs := walkTestFS(t)
+
+	tests := []struct {
+		pattern string
+		matches []string
+	}{
+		{"*", []string{"data", "data-extra.txt", "model", "readme.txt"}},
+		{"*.txt", []string{"data-extra.txt", "readme.txt"}},
+		{"model/*.mpet", []string{"model/ball.mpet", "model/club.mpet"}},
+		{"/model/b*", []string{"model/ball.mpet"}},
+		{"data/*/*", []string{"data/sub/a.dat"}},
+		{"data/[is]*", []string{"data/item.iff", "data/sub"}},
+		{"none/*", []string{}},
+	}
+	for _, test := range tests {
+		matches, err := fs.Glob(test.pattern)
+		require.NoError(t, err)
+		assert.Equal(t, test.matches, matches, test.pattern)
+	}
+
+	_, err := fs.Glob("[")
+	assert.ErrorIs(t, err, path.ErrBadPattern)
+}
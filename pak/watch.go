@@ -0,0 +1,312 @@
+package pak
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// changeOp is the kind of change made to a path by a reload.
+type changeOp int
+
+const (
+	changeAdded changeOp = iota
+	changeRemoved
+	changeModified
+)
+
+// fschange describes a change made to a path in the filesystem by a reload.
+type fschange struct {
+	op    changeOp
+	path  string
+	inode uint64
+	dir   bool
+}
+
+// subscribe registers fn to be called with the list of changes after each
+// reload of the filesystem. fn is called without fs.mu held, and may be
+// called concurrently by reloads that finish at the same time. The returned
+// function removes the subscription.
+func (fs *FS) subscribe(fn func([]fschange)) func() {
+	fs.listenmu.Lock()
+	defer fs.listenmu.Unlock()
+	if fs.listeners == nil {
+		fs.listeners = map[int]func([]fschange){}
+	}
+	id := fs.listenid
+	fs.listenid++
+	fs.listeners[id] = fn
+	return func() {
+		fs.listenmu.Lock()
+		defer fs.listenmu.Unlock()
+		delete(fs.listeners, id)
+	}
+}
+
+// replace atomically replaces the contents of the filesystem with t. Paths
+// present both before and after keep their inode numbers. The changes are
+// returned, and must be passed to notify once fs.mu is released. fs.mu must
+// be held.
+func (fs *FS) replace(t *fstree) []fschange {
+	old := fs.current()
+	changes := []fschange{}
+
+	i, j := 0, 0
+	od, nd := &old.dirs, &t.dirs
+	for i < od.len() || j < nd.len() {
+		switch {
+		case j >= nd.len() || (i < od.len() && od.paths[i] < nd.paths[j]):
+			changes = append(changes, fschange{changeRemoved, od.paths[i], od.inodes[i], true})
+			i++
+		case i >= od.len() || nd.paths[j] < od.paths[i]:
+			changes = append(changes, fschange{changeAdded, nd.paths[j], nd.inodes[j], true})
+			j++
+		default:
+			nd.inodes[j] = od.inodes[i]
+			i++
+			j++
+		}
+	}
+
+	i, j = 0, 0
+	of, nf := &old.files, &t.files
+	for i < of.len() || j < nf.len() {
+		switch {
+		case j >= nf.len() || (i < of.len() && of.paths[i] < nf.paths[j]):
+			changes = append(changes, fschange{changeRemoved, of.paths[i], of.inodes[i], false})
+			i++
+		case i >= of.len() || nf.paths[j] < of.paths[i]:
+			changes = append(changes, fschange{changeAdded, nf.paths[j], nf.inodes[j], false})
+			j++
+		default:
+			nf.inodes[j] = of.inodes[i]
+			if t.readers[nf.readers[j]] != old.readers[of.readers[i]] || nf.entries[j] != of.entries[i] {
+				changes = append(changes, fschange{changeModified, nf.paths[j], nf.inodes[j], false})
+			}
+			i++
+			j++
+		}
+	}
+
+	fs.tree.Store(t)
+	return changes
+}
+
+// notify calls the subscribers with changes returned by replace. fs.mu must
+// not be held, as subscribers may read or reload the filesystem.
+func (fs *FS) notify(changes []fschange) {
+	if len(changes) == 0 {
+		return
+	}
+	fs.listenmu.Lock()
+	listeners := make([]func([]fschange), 0, len(fs.listeners))
+	for _, fn := range fs.listeners {
+		listeners = append(listeners, fn)
+	}
+	fs.listenmu.Unlock()
+	for _, fn := range listeners {
+		fn(changes)
+	}
+}
+
+type watchedPak struct {
+	size   int64
+	mtime  time.Time
+	reader *Reader
+	layer  *layer
+}
+
+// modified returns true if the pak file has changed since it was loaded.
+// Paks on HTTP servers have no stat, and are never considered changed.
+func (p *watchedPak) modified(stat os.FileInfo) bool {
+	return stat != nil && (p.size != stat.Size() || !p.mtime.Equal(stat.ModTime()))
+}
+
+// Watcher keeps the contents of an FS in sync with a set of pak files on
+// disk. Pak files are considered changed when they appear, disappear, or
+// their size or modification time changes. Paks added to the FS by other
+// means are kept, below the watched paks. Patterns that are HTTP URLs are
+// loaded once, and then kept as they are.
+type Watcher struct {
+	mu       sync.Mutex
+	fs       *FS
+	patterns []string
+	paks     map[string]*watchedPak
+}
+
+// NewWatcher returns a watcher that loads the pak files matching patterns
+// into fs. The first call to Update performs the initial load.
+func NewWatcher(fs *FS, patterns []string) *Watcher {
+	return &Watcher{
+		fs:       fs,
+		patterns: patterns,
+		paks:     map[string]*watchedPak{},
+	}
+}
+
+// glob returns the pak paths matching the patterns, in load order.
+func (w *Watcher) glob() ([]string, error) {
+	result := []string{}
+	for _, pattern := range w.patterns {
+		if isURL(pattern) {
+			result = append(result, pattern)
+			continue
+		}
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(paths)
+		result = append(result, paths...)
+	}
+	return result, nil
+}
+
+// open opens a watched pak file. stat is nil for HTTP URLs.
+func (w *Watcher) open(path string, stat os.FileInfo) (*watchedPak, error) {
+	key, err := w.fs.loadkey(path)
+	if err != nil {
+		return nil, err
+	}
+	if stat == nil {
+		reader, err := NewReaderFromURL(key, path, nil)
+		if err != nil {
+			return nil, err
+		}
+		return w.load(&watchedPak{reader: reader})
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	// The file may have changed since it was checked, so it is stat again.
+	fstat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	// Watched paks are read with ordinary reads rather than mapped, as they
+	// may be truncated or rewritten while in use, which would fault a memory
+	// mapping.
+	reader, err := NewReaderFromReaderAt(key, file, fstat.Size())
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if index := w.fs.IndexCache(); index != nil {
+		if err := index.Attach(path, reader); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return w.load(&watchedPak{size: stat.Size(), mtime: stat.ModTime(), reader: reader})
+}
+
+// load reads the file table of a newly opened pak.
+func (w *Watcher) load(pak *watchedPak) (*watchedPak, error) {
+	layers, err := collect([]*Reader{pak.reader})
+	if err != nil {
+		return nil, err
+	}
+	pak.layer = layers[0]
+	return pak, nil
+}
+
+// Update checks the pak files for changes and, if any are found, rebuilds
+// the filesystem and swaps it in atomically. The number of changed paths in
+// the filesystem is returned. On error, the filesystem is left untouched.
+func (w *Watcher) Update() (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	paths, err := w.glob()
+	if err != nil {
+		return 0, err
+	}
+
+	changed := len(paths) != len(w.paks)
+	stats := make([]os.FileInfo, len(paths))
+	for i, path := range paths {
+		if !isURL(path) {
+			stats[i], err = os.Stat(path)
+			if err != nil {
+				return 0, err
+			}
+		}
+		pak, ok := w.paks[path]
+		if !ok || pak.modified(stats[i]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return 0, nil
+	}
+
+	// Changed paks are opened and read before the filesystem is locked.
+	paks := map[string]*watchedPak{}
+	for i, path := range paths {
+		pak, ok := w.paks[path]
+		if !ok || pak.modified(stats[i]) {
+			pak, err = w.open(path, stats[i])
+			if err != nil {
+				return 0, err
+			}
+		}
+		paks[path] = pak
+	}
+
+	// The new tree is built under fs.mu, so that paks added to the
+	// filesystem directly, even concurrently, are kept below the watched
+	// paks.
+	w.fs.mu.Lock()
+	watched := map[*Reader]bool{}
+	for _, pak := range w.paks {
+		watched[pak.reader] = true
+	}
+	old := w.fs.current()
+	readers := []*Reader{}
+	layers := []*layer{}
+	for i, l := range old.layers {
+		if r := old.readers[i]; !watched[r] {
+			readers = append(readers, r)
+			layers = append(layers, l)
+		}
+	}
+	for _, path := range paths {
+		readers = append(readers, paks[path].reader)
+		layers = append(layers, paks[path].layer)
+	}
+
+	// Old files are not closed here, as they may still be in use by readers
+	// of the previous tree. They are closed when garbage collected.
+	w.paks = paks
+	changes := w.fs.replace(w.fs.buildlayers(w.fs.newtree(), readers, layers))
+	w.fs.mu.Unlock()
+	w.fs.notify(changes)
+	return len(changes), nil
+}
+
+// Run calls Update every interval until ctx is done. Errors are logged, and
+// the previous contents are kept until a reload succeeds.
+func (w *Watcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := w.Update()
+			if err != nil {
+				log.Printf("Error reloading pak files: %v", err)
+			} else if n > 0 {
+				log.Printf("Reloaded pak files (%d paths changed.)", n)
+			}
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package pak_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pangbox/pangfiles/pak"
+	"github.com/pangbox/pangfiles/pak/paktest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestPak(t *testing.T, path string, mtime time.Time, files ...paktest.File) {
+	t.Helper()
+	require.NoError(t, ioutil.WriteFile(path, paktest.Pak{Key: testKey, Files: files}.Bytes(), 0o644))
+	require.NoError(t, os.Chtimes(path, mtime, mtime))
+}
+
+func TestWatcherUpdate(t *testing.T) {
+	dir := t.TempDir()
+	mtime := time.Now().Add(-time.Hour)
+	basePak := filepath.Join(dir, "projectg100.pak")
+	patchPak := filepath.Join(dir, "projectg101.pak")
+
+	writeTestPak(t, basePak, mtime,
+		paktest.File{Path: "data/a.txt", Data: []byte("base a"), EntryType: pak.EntryTypeXTEA},
+		paktest.File{Path: "data/b.txt", Data: []byte("base b"), EntryType: pak.EntryTypeXTEA},
+	)
+
+	fs := pak.NewFS(testKey)
+	w := pak.NewWatcher(fs, []string{filepath.Join(dir, "projectg*.pak")})
+
+	n, err := w.Update()
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+	data, err := fs.ReadFile("a.txt")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("base a"), data)
+
+	// Nothing changed on disk.
+	n, err = w.Update()
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	// New pak overrides a file and adds a directory.
+	writeTestPak(t, patchPak, mtime,
+		paktest.File{Path: "data/a.txt", Data: []byte("patched a"), EntryType: pak.EntryTypeXTEA},
+		paktest.File{Path: "new/c.txt", Data: []byte("new c"), EntryType: pak.EntryTypeXTEA},
+	)
+	n, err = w.Update()
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+	data, err = fs.ReadFile("a.txt")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("patched a"), data)
+	assert.Equal(t, 3, fs.NumFiles())
+
+	// Modified pak with the same size is detected by its modification time.
+	writeTestPak(t, patchPak, mtime.Add(time.Minute),
+		paktest.File{Path: "data/a.txt", Data: []byte("patched A"), EntryType: pak.EntryTypeXTEA},
+		paktest.File{Path: "new/c.txt", Data: []byte("new C"), EntryType: pak.EntryTypeXTEA},
+	)
+	n, err = w.Update()
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	data, err = fs.ReadFile("c.txt")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("new C"), data)
+
+	// Removed pak restores the base layer.
+	require.NoError(t, os.Remove(patchPak))
+	n, err = w.Update()
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+	data, err = fs.ReadFile("a.txt")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("base a"), data)
+	assert.Equal(t, 2, fs.NumFiles())
+	assert.Equal(t, 2, fs.NumDirectories())
+}
+
+func TestWatcherKeepsTreeOnError(t *testing.T) {
+	dir := t.TempDir()
+	writeTestPak(t, filepath.Join(dir, "projectg100.pak"), time.Now().Add(-time.Hour), paktest.File{Path: "a.txt", Data: []byte("a")})
+
+	fs := pak.NewFS(testKey)
+	w := pak.NewWatcher(fs, []string{filepath.Join(dir, "projectg*.pak")})
+	_, err := w.Update()
+	require.NoError(t, err)
+
+	// A partially written pak fails to load; the old contents remain.
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "projectg101.pak"), []byte("partial"), 0o644))
+	_, err = w.Update()
+	assert.Error(t, err)
+	data, err := fs.ReadFile("a.txt")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("a"), data)
+}
+
+func TestWatcherTruncatedPak(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "projectg100.pak")
+	writeTestPak(t, path, time.Now().Add(-time.Hour), paktest.File{Path: "a.txt", Data: []byte("a")})
+
+	fs := pak.NewFS(testKey)
+	w := pak.NewWatcher(fs, []string{path})
+	_, err := w.Update()
+	require.NoError(t, err)
+
+	// Truncating a pak in use results in read errors, not a crash.
+	require.NoError(t, os.Truncate(path, 0))
+	_, err = fs.ReadFile("a.txt")
+	assert.Error(t, err)
+}
+
+func TestWatcherURLPattern(t *testing.T) {
+	server, _, _ := servePak(t, largeTestPak())
+	dir := t.TempDir()
+	writeTestPak(t, filepath.Join(dir, "projectg100.pak"), time.Now().Add(-time.Hour), paktest.File{Path: "a.txt", Data: []byte("a")})
+
+	fs := pak.NewFS(testKey)
+	w := pak.NewWatcher(fs, []string{server.URL + "/test.pak", filepath.Join(dir, "projectg*.pak")})
+	_, err := w.Update()
+	require.NoError(t, err)
+	assert.Equal(t, 3, fs.NumFiles())
+
+	// The pak on the server stays loaded when local paks change.
+	writeTestPak(t, filepath.Join(dir, "projectg101.pak"), time.Now().Add(-time.Hour), paktest.File{Path: "b.txt", Data: []byte("b")})
+	_, err = w.Update()
+	require.NoError(t, err)
+	assert.Equal(t, 4, fs.NumFiles())
+	data, err := fs.ReadFile("small.txt")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("small"), data)
+}
@@ -0,0 +1,282 @@
+package pak
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/pangbox/pangfiles/crypto/pyxtea"
+	"golang.org/x/text/encoding/korean"
+)
+
+// Errors returned by the writer.
+var (
+	// ErrPathTooLong is returned when a path does not fit in a file entry.
+	ErrPathTooLong = errors.New("path too long")
+	// ErrPakTooLarge is returned when data would be written past the
+	// offsets that can be stored in a pak file.
+	ErrPakTooLarge = errors.New("pak file too large")
+	// ErrWriterClosed is returned when writing to a closed Writer.
+	ErrWriterClosed = errors.New("writer closed")
+)
+
+// WriterOptions configures a Writer.
+type WriterOptions struct {
+	// EntryType is the obfuscation used for file entries; one of
+	// EntryTypeXOR, EntryTypeXTEA or EntryTypeBasic. Defaults to
+	// EntryTypeXTEA.
+	EntryType byte
+
+	// FileType is the compression used by WriteFile; one of FileTypeBasic,
+	// FileTypeLz or FileTypeLz2. Defaults to FileTypeBasic.
+	FileType byte
+
+	// Dedup stores files with identical contents only once, with each of
+	// their file entries pointing at the same data.
+	Dedup bool
+}
+
+// WriterStats contains statistics about the files written by a Writer.
+type WriterStats struct {
+	// Files is the number of files written.
+	Files int
+	// Deduplicated is the number of files whose data was already stored.
+	Deduplicated int
+	// Bytes is the number of bytes of file data stored.
+	Bytes int64
+	// SavedBytes is the number of bytes of file data not stored due to
+	// deduplication.
+	SavedBytes int64
+}
+
+// writerentry is a file entry waiting to be written to the file table.
+type writerentry struct {
+	path  []byte
+	entry FileEntryData
+}
+
+// Writer writes pak files. File data is written as files are added; the
+// file table and trailer are written by Close.
+type Writer struct {
+	k      pyxtea.Key
+	w      io.Writer
+	opts   WriterOptions
+	offset int64
+	table  []writerentry
+	stored map[[sha256.Size]byte]FileEntryData
+	stats  WriterStats
+	closed bool
+}
+
+// NewWriter returns a new writer writing a pak file to w. If opts is nil,
+// default options are used.
+func NewWriter(k pyxtea.Key, w io.Writer, opts *WriterOptions) *Writer {
+	n := &Writer{k: k, w: w, stored: map[[sha256.Size]byte]FileEntryData{}}
+	if opts != nil {
+		n.opts = *opts
+	}
+	if n.opts.EntryType == 0 {
+		n.opts.EntryType = EntryTypeXTEA
+	}
+	return n
+}
+
+// Stats returns statistics about the files written so far.
+func (w *Writer) Stats() WriterStats {
+	return w.stats
+}
+
+// WriteFile adds a file to the pak, compressing it as configured.
+func (w *Writer) WriteFile(path string, data []byte) error {
+	fileType := w.opts.FileType & FileTypeMask
+	packed := data
+	if fileType == FileTypeLz || fileType == FileTypeLz2 {
+		packed = Compress(data, fileType)
+	}
+	entry := FileEntryData{Type: fileType, RealFileSize: uint32(len(data))}
+	return w.write(path, entry, packed, sha256.Sum256(data))
+}
+
+// WriteRaw adds a file whose data is already packed, such as data read
+// using Reader.ReadPacked. The type and real file size are taken from entry,
+// and the offset and packed file size are set by the writer. If entry has no
+// entry type, the configured entry type is used.
+func (w *Writer) WriteRaw(path string, entry FileEntryData, packed []byte) error {
+	var hash [sha256.Size]byte
+	if w.opts.Dedup {
+		data, err := decompress(FileEntryData{Type: entry.Type, PackedFileSize: uint32(len(packed))}, bytes.NewReader(packed))
+		if err != nil {
+			// Data that can not be decoded can only be shared with
+			// identical packed data.
+			hash = sha256.Sum256(append([]byte{entry.Type & FileTypeMask}, packed...))
+		} else {
+			hash = sha256.Sum256(data)
+		}
+	}
+	return w.write(path, entry, packed, hash)
+}
+
+func (w *Writer) write(path string, entry FileEntryData, packed []byte, hash [sha256.Size]byte) error {
+	if w.closed {
+		return ErrWriterClosed
+	}
+	if entry.Type&EntryTypeMask == 0 {
+		entry.Type |= w.opts.EntryType
+	}
+	encoded, err := encodePath(path, entry.Type)
+	if err != nil {
+		return err
+	}
+
+	w.stats.Files++
+	if stored, ok := w.stored[hash]; ok && w.opts.Dedup {
+		entry.Type = entry.Type&EntryTypeMask | stored.Type&FileTypeMask
+		entry.Offset = stored.Offset
+		entry.PackedFileSize = stored.PackedFileSize
+		entry.RealFileSize = stored.RealFileSize
+		w.table = append(w.table, writerentry{encoded, entry})
+		w.stats.Deduplicated++
+		w.stats.SavedBytes += int64(len(packed))
+		return nil
+	}
+
+	if w.offset+int64(len(packed)) > math.MaxUint32 {
+		return ErrPakTooLarge
+	}
+	if _, err := w.w.Write(packed); err != nil {
+		return err
+	}
+	entry.Offset = uint32(w.offset)
+	entry.PackedFileSize = uint32(len(packed))
+	w.offset += int64(len(packed))
+	w.table = append(w.table, writerentry{encoded, entry})
+	w.stats.Bytes += int64(len(packed))
+	if w.opts.Dedup {
+		w.stored[hash] = entry
+	}
+	return nil
+}
+
+// WriteDir adds a directory entry. Directory entries have no data, so the
+// offset and sizes of entry are stored as given. If entry has no entry type,
+// the configured entry type is used.
+func (w *Writer) WriteDir(path string, entry FileEntryData) error {
+	if w.closed {
+		return ErrWriterClosed
+	}
+	entry.Type = entry.Type&EntryTypeMask | FileTypeDir
+	if entry.Type&EntryTypeMask == 0 {
+		entry.Type |= w.opts.EntryType
+	}
+	encoded, err := encodePath(path, entry.Type)
+	if err != nil {
+		return err
+	}
+	w.table = append(w.table, writerentry{encoded, entry})
+	return nil
+}
+
+// encodePath encodes a path as EUC-KR, checking that it fits in an entry of
+// the given type.
+func encodePath(path string, entryType byte) ([]byte, error) {
+	encoded, err := korean.EUCKR.NewEncoder().Bytes([]byte(path))
+	if err != nil {
+		return nil, fmt.Errorf("encoding path %q: %w", path, err)
+	}
+	max := math.MaxUint8
+	if entryType&EntryTypeMask == EntryTypeXTEA {
+		max -= max % pyxtea.BlockSize
+	}
+	if len(encoded) > max {
+		return nil, fmt.Errorf("%q: %w", path, ErrPathTooLong)
+	}
+	return encoded, nil
+}
+
+// encodeEntry encodes a file entry and its path as stored in the file table.
+func encodeEntry(k pyxtea.Key, entry FileEntryData, path []byte) []byte {
+	return encodePaddedEntry(k, entry, path, nil)
+}
+
+// encodePaddedEntry is like encodeEntry, but if padding is not nil, it is
+// stored after the path in place of the usual XTEA padding or terminator.
+func encodePaddedEntry(k pyxtea.Key, entry FileEntryData, path, padding []byte) []byte {
+	path = append([]byte{}, path...)
+	switch entry.Type & EntryTypeMask {
+	case EntryTypeXTEA:
+		if padding != nil {
+			path = append(path, padding...)
+		} else if pad := len(path) % pyxtea.BlockSize; pad != 0 || len(path) == 0 {
+			path = append(path, make([]byte, pyxtea.BlockSize-pad)...)
+		}
+		entry.PathLength = byte(len(path))
+	case EntryTypeXOR, 0:
+		// Entries with no entry type are read as XOR entries.
+		entry.PathLength = byte(len(path))
+		entry.RealFileSize ^= 0x71
+		path = append(path, terminator(padding))
+		for i := range path {
+			path[i] ^= 0x71
+		}
+	default:
+		entry.PathLength = byte(len(path))
+		path = append(path, terminator(padding))
+	}
+
+	hdr := [FileEntryLen]byte{}
+	hdr[0] = entry.PathLength
+	hdr[1] = entry.Type
+	binary.LittleEndian.PutUint32(hdr[2:6], entry.Offset)
+	binary.LittleEndian.PutUint32(hdr[6:10], entry.PackedFileSize)
+	binary.LittleEndian.PutUint32(hdr[10:14], entry.RealFileSize)
+
+	if entry.Type&EntryTypeMask == EntryTypeXTEA {
+		tmp := [8]byte{}
+		copy(tmp[0:4], hdr[2:6])
+		copy(tmp[4:8], hdr[10:14])
+		pyxtea.EncryptBlock(k, tmp[:])
+		copy(hdr[2:6], tmp[0:4])
+		copy(hdr[10:14], tmp[4:8])
+		for i := 0; i+pyxtea.BlockSize <= len(path); i += pyxtea.BlockSize {
+			pyxtea.EncryptBlock(k, path[i:i+pyxtea.BlockSize])
+		}
+	}
+
+	return append(hdr[:], path...)
+}
+
+// Close writes the file table and trailer. It does not close the underlying
+// writer.
+func (w *Writer) Close() error {
+	if w.closed {
+		return ErrWriterClosed
+	}
+	w.closed = true
+
+	table := bytes.Buffer{}
+	for _, e := range w.table {
+		table.Write(encodeEntry(w.k, e.entry, e.path))
+	}
+	if _, err := w.w.Write(table.Bytes()); err != nil {
+		return err
+	}
+
+	trailer := [TrailerLen]byte{}
+	binary.LittleEndian.PutUint32(trailer[0:4], uint32(w.offset))
+	binary.LittleEndian.PutUint32(trailer[4:8], uint32(len(w.table)))
+	trailer[8] = StandardFormat.Signature
+	_, err := w.w.Write(trailer[:])
+	return err
+}
+
+// terminator returns the byte ending a path, as given by padding.
+func terminator(padding []byte) byte {
+	if len(padding) > 0 {
+		return padding[0]
+	}
+	return 0
+}
@@ -0,0 +1,115 @@
+package pak_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/pangbox/pangfiles/pak"
+	"github.com/pangbox/pangfiles/pak/paktest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readAll reads every file of a pak, keyed by path.
+func readAll(t *testing.T, r *pak.Reader) (map[string][]byte, map[string]pak.FileEntryData) {
+	t.Helper()
+	data := map[string][]byte{}
+	entries := map[string]pak.FileEntryData{}
+	require.NoError(t, r.ReadFileTable(func(path string, entry pak.FileEntryData) bool {
+		entries[path] = entry
+		if entry.Type&pak.FileTypeMask != pak.FileTypeDir {
+			d, err := r.ReadFile(entry)
+			require.NoError(t, err)
+			data[path] = d
+		}
+		return true
+	}))
+	return data, entries
+}
+
+func TestWriterRoundTrip(t *testing.T) {
+	for _, entryType := range []byte{pak.EntryTypeXOR, pak.EntryTypeXTEA, pak.EntryTypeBasic} {
+		for _, fileType := range []byte{pak.FileTypeBasic, pak.FileTypeLz, pak.FileTypeLz2} {
+			buf := bytes.Buffer{}
+			w := pak.NewWriter(testKey, &buf, &pak.WriterOptions{EntryType: entryType, FileType: fileType})
+			files := testFiles(entryType)
+			for _, file := range files {
+				if file.FileType != pak.FileTypeDir {
+					require.NoError(t, w.WriteFile(file.Path, file.Data))
+				}
+			}
+			require.NoError(t, w.Close())
+
+			r, err := pak.NewReaderFromBytes(testKey, buf.Bytes())
+			require.NoError(t, err)
+			data, entries := readAll(t, r)
+			for _, file := range files {
+				if file.FileType != pak.FileTypeDir {
+					assert.Equal(t, file.Data, data[file.Path], file.Path)
+					assert.Equal(t, entryType|fileType, entries[file.Path].Type, file.Path)
+				}
+			}
+		}
+	}
+}
+
+func TestWriterRaw(t *testing.T) {
+	src := mustReader(t, paktest.Pak{Key: testKey, Files: testFiles(pak.EntryTypeXOR)})
+	buf := bytes.Buffer{}
+	w := pak.NewWriter(testKey, &buf, nil)
+	require.NoError(t, src.ReadFileTable(func(path string, entry pak.FileEntryData) bool {
+		if entry.Type&pak.FileTypeMask == pak.FileTypeDir {
+			return true
+		}
+		packed, err := src.ReadPacked(entry)
+		require.NoError(t, err)
+		entry.Type &= pak.FileTypeMask
+		require.NoError(t, w.WriteRaw(path, entry, packed))
+		return true
+	}))
+	require.NoError(t, w.Close())
+
+	r, err := pak.NewReaderFromBytes(testKey, buf.Bytes())
+	require.NoError(t, err)
+	expected, _ := readAll(t, src)
+	actual, entries := readAll(t, r)
+	assert.Equal(t, expected, actual)
+	for _, entry := range entries {
+		assert.Equal(t, byte(pak.EntryTypeXTEA), entry.Type&pak.EntryTypeMask)
+	}
+}
+
+func TestWriterDedup(t *testing.T) {
+	content := bytes.Repeat([]byte("shared texture "), 64)
+	buf := bytes.Buffer{}
+	w := pak.NewWriter(testKey, &buf, &pak.WriterOptions{FileType: pak.FileTypeLz, Dedup: true})
+	require.NoError(t, w.WriteFile("a/tex.dds", content))
+	require.NoError(t, w.WriteFile("b/tex.dds", content))
+	require.NoError(t, w.WriteFile("c/other.dds", []byte("other")))
+	// Raw data with the same contents, stored differently, is also shared.
+	require.NoError(t, w.WriteRaw("d/tex.dds", pak.FileEntryData{Type: pak.FileTypeBasic, RealFileSize: uint32(len(content))}, content))
+	require.NoError(t, w.Close())
+
+	stats := w.Stats()
+	assert.Equal(t, 4, stats.Files)
+	assert.Equal(t, 2, stats.Deduplicated)
+
+	r, err := pak.NewReaderFromBytes(testKey, buf.Bytes())
+	require.NoError(t, err)
+	data, entries := readAll(t, r)
+	assert.Equal(t, content, data["b/tex.dds"])
+	assert.Equal(t, content, data["d/tex.dds"])
+	assert.Equal(t, entries["a/tex.dds"].Offset, entries["b/tex.dds"].Offset)
+	assert.Equal(t, entries["a/tex.dds"].Offset, entries["d/tex.dds"].Offset)
+	assert.NotEqual(t, entries["a/tex.dds"].Offset, entries["c/other.dds"].Offset)
+}
+
+func TestWriterErrors(t *testing.T) {
+	w := pak.NewWriter(testKey, &bytes.Buffer{}, nil)
+	assert.ErrorIs(t, w.WriteFile(strings.Repeat("a", 249), nil), pak.ErrPathTooLong)
+	assert.NoError(t, w.WriteFile(strings.Repeat("a", 248), nil))
+	require.NoError(t, w.Close())
+	assert.ErrorIs(t, w.WriteFile("late.txt", nil), pak.ErrWriterClosed)
+	assert.ErrorIs(t, w.Close(), pak.ErrWriterClosed)
+}